@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/go-kit/kit/log"
+	"github.com/seagullbird/headr-k8s-helper/admin"
+	"github.com/seagullbird/headr-k8s-helper/client"
+	"github.com/seagullbird/headr-k8s-helper/schema"
+	"time"
+)
+
+// adminSites creates and deletes the sites of the admin API and the site command like new_site_server and
+// del_site_server do, recording each request in the event ledger as an event received when it's made.
+type adminSites struct {
+	c      client.Client
+	bg     *background
+	logger log.Logger
+}
+
+func (s adminSites) CreateSite(ctx context.Context, site client.Site) error {
+	event := adminEvent(site)
+	if err := event.Validate(schema.NeedSite | schema.NeedUser); err != nil {
+		return err
+	}
+	defer lockUser(site.UserID)()
+	refused, err := createSite(ctx, s.c, nil, s.bg, event, site.Domains, ledgerEntry(event), s.logger)
+	if refused {
+		return admin.ErrQuotaExceeded
+	}
+	return err
+}
+
+func (s adminSites) DeleteSite(ctx context.Context, siteID uint) error {
+	return deleteSite(ctx, s.c, siteID, ledgerEntry(adminEvent(client.Site{SiteID: siteID})), s.logger)
+}
+
+// adminSiteResources is adminSites in operator mode, where sites are declared as HeadrSites.
+type adminSiteResources struct {
+	c      client.Client
+	sites  client.HeadrSites
+	logger log.Logger
+}
+
+func (s adminSiteResources) CreateSite(ctx context.Context, site client.Site) error {
+	event := adminEvent(site)
+	if err := event.Validate(schema.NeedSite | schema.NeedUser); err != nil {
+		return err
+	}
+	defer lockUser(site.UserID)()
+	refused, err := applySite(ctx, s.c, s.sites, nil, event, site.Domains, ledgerEntry(event), s.logger)
+	if refused {
+		return admin.ErrQuotaExceeded
+	}
+	return err
+}
+
+func (s adminSiteResources) DeleteSite(ctx context.Context, siteID uint) error {
+	return deleteSiteResource(ctx, s.c, s.sites, siteID, ledgerEntry(adminEvent(client.Site{SiteID: siteID})), s.logger)
+}
+
+// adminEvent is the site event an admin API request stands for, received now; the site's domains don't fit in one.
+func adminEvent(site client.Site) schema.Site {
+	now := time.Now()
+	return schema.Site{
+		SchemaVersion: schema.CurrentVersion,
+		EventID:       fmt.Sprintf("admin-%d", now.UnixNano()),
+		UserID:        site.UserID,
+		SiteID:        site.SiteID,
+		Theme:         site.Theme,
+		Plan:          site.Plan,
+		ReceivedOn:    now.Unix(),
+	}
+}
+
+// ledgerEntry is what the event ledger records of an admin API request.
+func ledgerEntry(event schema.Site) client.AppliedEvent {
+	return client.AppliedEvent{ReceivedOn: event.ReceivedOn, EventID: event.EventID}
+}
@@ -0,0 +1,168 @@
+package admin
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"github.com/go-kit/kit/log"
+	"github.com/seagullbird/headr-k8s-helper/client"
+	"github.com/seagullbird/headr-k8s-helper/schema"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// ErrQuotaExceeded is returned by Sites.CreateSite when the user has no sites left in their quota.
+var ErrQuotaExceeded = errors.New("site quota exceeded")
+
+// Sites creates and deletes sites the way site events do, through the event ledger, site lifecycle and quota.
+// CreateSite fails with a schema.InvalidError for a site whose event would be rejected, such as one with an unknown
+// theme, and with ErrQuotaExceeded for one over its user's quota.
+type Sites interface {
+	CreateSite(ctx context.Context, site client.Site) error
+	DeleteSite(ctx context.Context, siteID uint) error
+}
+
+// NewHandler returns the admin API handler; sites creates and deletes the sites. Every request must carry the token as `Authorization: Bearer <token>`.
+//
+//	GET    /sites       list all sites
+//	GET    /sites/{id}  show a site's deployment status, replica counts, service port and ingress paths
+//	POST   /sites/{id}  create a site, the body is {"user_id": 1, "plan": "free", "theme": "hyde", "domains": ["blog.example.com"]}
+//	DELETE /sites/{id}  delete a site
+//	POST   /reconcile   repair missing or orphaned services and ingress paths
+func NewHandler(c client.Client, sites Sites, token string, logger log.Logger) http.Handler {
+	h := handler{c: c, store: sites, logger: logger}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/sites", h.sites)
+	mux.HandleFunc("/sites/", h.site)
+	mux.HandleFunc("/reconcile", h.reconcile)
+	return authenticate(token, mux)
+}
+
+type handler struct {
+	c      client.Client
+	store  Sites
+	logger log.Logger
+}
+
+func (h handler) sites(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	statuses, err := h.c.ListSites(r.Context())
+	if err != nil {
+		h.fail(w, r, err)
+		return
+	}
+	if statuses == nil {
+		statuses = []client.SiteStatus{}
+	}
+	writeJSON(w, http.StatusOK, statuses)
+}
+
+func (h handler) site(w http.ResponseWriter, r *http.Request) {
+	siteID, err := strconv.ParseUint(strings.TrimPrefix(r.URL.Path, "/sites/"), 10, 0)
+	if err != nil || siteID == 0 {
+		writeError(w, http.StatusNotFound, "invalid site id")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		status, err := h.c.DescribeSite(r.Context(), uint(siteID))
+		if err != nil {
+			h.fail(w, r, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, status)
+	case http.MethodPost:
+		var site client.Site
+		if err := json.NewDecoder(r.Body).Decode(&site); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid body: "+err.Error())
+			return
+		}
+		if site.UserID == 0 {
+			writeError(w, http.StatusBadRequest, "user_id is required")
+			return
+		}
+		site.SiteID = uint(siteID)
+		if err := h.store.CreateSite(r.Context(), site); err != nil {
+			h.fail(w, r, err)
+			return
+		}
+		h.logger.Log("info", "Created site via admin API", "site_id", siteID, "user_id", site.UserID)
+		writeJSON(w, http.StatusCreated, site)
+	case http.MethodDelete:
+		if err := h.store.DeleteSite(r.Context(), uint(siteID)); err != nil {
+			h.fail(w, r, err)
+			return
+		}
+		h.logger.Log("info", "Deleted site via admin API", "site_id", siteID)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+func (h handler) reconcile(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	fixes, err := h.c.Reconcile(r.Context())
+	if err != nil {
+		h.fail(w, r, err)
+		return
+	}
+	if fixes == nil {
+		fixes = []client.Fix{}
+	}
+	writeJSON(w, http.StatusOK, fixes)
+}
+
+// fail maps a client or Sites error to a response.
+func (h handler) fail(w http.ResponseWriter, r *http.Request, err error) {
+	switch err.(type) {
+	case client.IllegalTransitionError:
+		writeError(w, http.StatusConflict, err.Error())
+		return
+	case schema.InvalidError:
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	switch err {
+	case client.ErrSiteNotFound:
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	case ErrQuotaExceeded:
+		writeError(w, http.StatusForbidden, err.Error())
+		return
+	}
+	h.logger.Log("error_desc", "admin request failed", "method", r.Method, "path", r.URL.Path, "error", err)
+	writeError(w, http.StatusInternalServerError, err.Error())
+}
+
+// authenticate rejects requests that don't carry the bearer token.
+func authenticate(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if token == "" || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeError(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, code int, msg string) {
+	writeJSON(w, code, map[string]string{"error": msg})
+}
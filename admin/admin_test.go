@@ -0,0 +1,173 @@
+package admin
+
+import (
+	"context"
+	"errors"
+	"github.com/go-kit/kit/log"
+	"github.com/seagullbird/headr-k8s-helper/client"
+	"github.com/seagullbird/headr-k8s-helper/client/fake"
+	"github.com/seagullbird/headr-k8s-helper/schema"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// fakeSites creates and deletes sites in a fake.Client, or fails with err when it's set.
+type fakeSites struct {
+	c   *fake.Client
+	err error
+}
+
+func (s fakeSites) CreateSite(ctx context.Context, site client.Site) error {
+	if s.err != nil {
+		return s.err
+	}
+	return s.c.CreateCaddyService(ctx, site)
+}
+
+func (s fakeSites) DeleteSite(ctx context.Context, siteID uint) error {
+	if s.err != nil {
+		return s.err
+	}
+	return s.c.DeleteCaddyService(ctx, siteID)
+}
+
+func TestHandler(t *testing.T) {
+	tests := []struct {
+		name     string
+		method   string
+		path     string
+		body     string
+		token    string
+		sitesErr error
+		wantCode int
+		// wantChanged is set when the request creates site 7 or deletes site 8
+		wantChanged bool
+	}{
+		{
+			name:     "no token",
+			method:   http.MethodPost,
+			path:     "/sites/7",
+			body:     `{"user_id": 1}`,
+			wantCode: http.StatusUnauthorized,
+		},
+		{
+			name:     "wrong token",
+			method:   http.MethodPost,
+			path:     "/sites/7",
+			body:     `{"user_id": 1}`,
+			token:    "wrong",
+			wantCode: http.StatusUnauthorized,
+		},
+		{
+			name:        "creates a site",
+			method:      http.MethodPost,
+			path:        "/sites/7",
+			body:        `{"user_id": 1, "plan": "free"}`,
+			token:       "secret",
+			wantCode:    http.StatusCreated,
+			wantChanged: true,
+		},
+		{
+			name:     "create without a user",
+			method:   http.MethodPost,
+			path:     "/sites/7",
+			body:     `{"plan": "free"}`,
+			token:    "secret",
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:     "create over quota",
+			method:   http.MethodPost,
+			path:     "/sites/7",
+			body:     `{"user_id": 1}`,
+			token:    "secret",
+			sitesErr: ErrQuotaExceeded,
+			wantCode: http.StatusForbidden,
+		},
+		{
+			name:     "create a site being deleted",
+			method:   http.MethodPost,
+			path:     "/sites/7",
+			body:     `{"user_id": 1}`,
+			token:    "secret",
+			sitesErr: client.IllegalTransitionError{SiteID: 7, From: client.StateDeleting, To: client.StatePending},
+			wantCode: http.StatusConflict,
+		},
+		{
+			name:     "create with an unknown theme",
+			method:   http.MethodPost,
+			path:     "/sites/7",
+			body:     `{"user_id": 1, "theme": "nope"}`,
+			token:    "secret",
+			sitesErr: schema.InvalidError{Reason: "unknown_theme", Err: errors.New("theme nope isn't known")},
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:     "create fails",
+			method:   http.MethodPost,
+			path:     "/sites/7",
+			body:     `{"user_id": 1}`,
+			token:    "secret",
+			sitesErr: errors.New("boom"),
+			wantCode: http.StatusInternalServerError,
+		},
+		{
+			name:        "deletes a site",
+			method:      http.MethodDelete,
+			path:        "/sites/8",
+			token:       "secret",
+			wantCode:    http.StatusNoContent,
+			wantChanged: true,
+		},
+		{
+			name:     "delete an unknown site",
+			method:   http.MethodDelete,
+			path:     "/sites/9",
+			token:    "secret",
+			sitesErr: client.ErrSiteNotFound,
+			wantCode: http.StatusNotFound,
+		},
+		{
+			name:     "describe an unknown site",
+			method:   http.MethodGet,
+			path:     "/sites/9",
+			token:    "secret",
+			wantCode: http.StatusNotFound,
+		},
+		{
+			name:     "invalid site id",
+			method:   http.MethodPost,
+			path:     "/sites/seven",
+			body:     `{"user_id": 1}`,
+			token:    "secret",
+			wantCode: http.StatusNotFound,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := fake.New()
+			// site 7 is created by the tests, 8 is there to be deleted
+			c.AddSite(client.Site{UserID: 1, SiteID: 8})
+			h := NewHandler(c, fakeSites{c: c, err: tt.sitesErr}, "secret", log.NewNopLogger())
+
+			r := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+			if tt.token != "" {
+				r.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+
+			if w.Code != tt.wantCode {
+				t.Errorf("code = %d, want %d: %s", w.Code, tt.wantCode, w.Body)
+			}
+			created, _, _ := c.State(7)
+			kept, _, _ := c.State(8)
+			if changed := created || !kept; changed != tt.wantChanged {
+				t.Errorf("changed = %v, want %v", changed, tt.wantChanged)
+			}
+		})
+	}
+}
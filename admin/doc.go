@@ -0,0 +1,2 @@
+// Package admin serves an authenticated HTTP API for inspecting and operating on sites through client.Client
+package admin
@@ -0,0 +1,47 @@
+package client
+
+import (
+	"context"
+	"github.com/ericchiang/k8s"
+)
+
+// api is the API server client. The vendored client doesn't pass ctx on to its requests, so api checks it before
+// each one: a cancelled or expired operation stops at its next request. config.RequestTimeout bounds the requests themselves.
+type api struct {
+	*k8s.Client
+}
+
+func (a api) Create(ctx context.Context, r k8s.Resource, options ...k8s.Option) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return a.Client.Create(ctx, r, options...)
+}
+
+func (a api) Update(ctx context.Context, r k8s.Resource, options ...k8s.Option) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return a.Client.Update(ctx, r, options...)
+}
+
+func (a api) Delete(ctx context.Context, r k8s.Resource, options ...k8s.Option) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return a.Client.Delete(ctx, r, options...)
+}
+
+func (a api) Get(ctx context.Context, namespace, name string, r k8s.Resource, options ...k8s.Option) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return a.Client.Get(ctx, namespace, name, r, options...)
+}
+
+func (a api) List(ctx context.Context, namespace string, r k8s.ResourceList, options ...k8s.Option) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return a.Client.List(ctx, namespace, r, options...)
+}
@@ -2,242 +2,493 @@ package client
 
 import (
 	"context"
+	"fmt"
 	"github.com/ericchiang/k8s"
 	appsv1 "github.com/ericchiang/k8s/apis/apps/v1"
 	corev1 "github.com/ericchiang/k8s/apis/core/v1"
 	extensionsv1beta1 "github.com/ericchiang/k8s/apis/extensions/v1beta1"
 	metav1 "github.com/ericchiang/k8s/apis/meta/v1"
-	"github.com/ericchiang/k8s/util/intstr"
 	"github.com/go-kit/kit/log"
 	"github.com/seagullbird/headr-k8s-helper/config"
-	"path/filepath"
+	"net/http"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
+)
+
+// Labels put on every resource the helper creates, so a user's or a site's resources can be found with label selectors.
+const (
+	labelManagedBy = "headr.io/managed-by"
+	labelUserID    = "headr.io/user-id"
+	labelSiteID    = "headr.io/site-id"
+	managerName    = "k8s-helper"
+	// annotationPlan, annotationTheme and annotationDomains record the spec a site was created with,
+	// so it can be recreated elsewhere.
+	annotationPlan    = "headr.io/plan"
+	annotationTheme   = "headr.io/theme"
+	annotationDomains = "headr.io/domains"
 )
 
 // Client represents a headr-k8s-client that is responsible for create/delete a caddy server container in the cluster.
 type Client interface {
-	CreateCaddyService(siteID uint) error
-	DeleteCaddyService(siteID uint) error
+	CreateCaddyService(ctx context.Context, site Site) error
+	// UpdateCaddyService updates the theme, plan and domains of an existing site in place
+	UpdateCaddyService(ctx context.Context, site Site) error
+	DeleteCaddyService(ctx context.Context, siteID uint) error
+	DeleteUserSites(ctx context.Context, userID uint) ([]SiteResult, error)
+	// CountUserSites counts the sites of a user other than the site except, so a site being created again
+	// doesn't count against its own quota
+	CountUserSites(ctx context.Context, userID, except uint) (int, error)
+	DescribeSite(ctx context.Context, siteID uint) (SiteStatus, error)
+	ListSites(ctx context.Context) ([]SiteStatus, error)
+	Reconcile(ctx context.Context) ([]Fix, error)
+	// Check verifies the API server is reachable and grants the helper the permissions it needs
+	Check(ctx context.Context) error
+	// Preflight reports whether the helper can run: whether the API server is reachable, grants it its permissions,
+	// and holds the objects sites rely on
+	Preflight(ctx context.Context) []Finding
+	// LastApplied returns the last event applied to the site or user named by a SiteKey or UserKey,
+	// or the zero AppliedEvent when none was recorded
+	LastApplied(ctx context.Context, key string) (AppliedEvent, error)
+	// RecordApplied records an event as the last applied to a site or user
+	RecordApplied(ctx context.Context, key string, event AppliedEvent) error
+	// SiteState returns the lifecycle state of a site
+	SiteState(ctx context.Context, siteID uint) (SiteState, error)
+	// SetSiteState moves a site to a state, failing with an IllegalTransitionError when its lifecycle doesn't allow it
+	SetSiteState(ctx context.Context, siteID uint, to SiteState) error
+}
+
+// Site describes a user site to be served by a caddy deployment.
+type Site struct {
+	UserID uint `json:"user_id"`
+	SiteID uint `json:"site_id"`
+	// Plan names the user's plan in config.Plans; it sizes the user's namespace in namespace tenancy mode.
+	Plan string `json:"plan,omitempty"`
+	// Theme is passed on to the caddy container as THEME
+	Theme string `json:"theme,omitempty"`
+	// Domains are served by an ingress of the site's own, besides its usersites-ingress path
+	Domains []string `json:"domains,omitempty"`
+}
+
+// SiteResult reports the outcome of tearing down one site during a bulk operation.
+type SiteResult struct {
+	SiteID uint
+	Err    error
 }
 
+// ingressMtx serializes the reads and updates of usersites-ingress by concurrent events,
+// which would otherwise fail each other's updates with conflicts.
+var ingressMtx sync.Mutex
+
 type k8sclient struct {
-	client *k8s.Client
+	client api
 	logger log.Logger
 }
 
-func (c k8sclient) CreateCaddyService(siteID uint) error {
-	siteIDstr := strconv.Itoa(int(siteID))
-	// create deployment
-	var (
-		name      = "siteid-" + siteIDstr + "-service"
-		namespace = "default"
-		labels    = map[string]string{
-			"app": name,
-		}
-		replicas        int32 = 1
-		volumeName            = "data"
-		mountPath             = "/www"
-		serverRootPath        = ""
-		image                 = "seagullbird/headr-caddy:2.0.0"
-		imagePullPolicy       = "Always"
-		hostPath              = "/home/docker/data/sites/" + siteIDstr + "/public"
-		nfsPvcName            = "nfs"
-	)
-
-	var volumeSource corev1.VolumeSource
-	switch config.Dev {
-	case "true":
-		volumeSource = corev1.VolumeSource{
-			HostPath: &corev1.HostPathVolumeSource{
-				Path: &hostPath,
-			},
-		}
-		serverRootPath = mountPath
-	case "false":
-		volumeSource = corev1.VolumeSource{
-			PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
-				ClaimName: &nfsPvcName,
-			},
+// CreateCaddyService creates the objects of a site. Objects that already exist were created by an earlier attempt
+// and are kept, so a retry completes a site left half created.
+func (c k8sclient) CreateCaddyService(ctx context.Context, site Site) error {
+	m := BuildManifest(site)
+	if m.Namespace != nil {
+		if err := c.ensureUserNamespace(ctx, m); err != nil {
+			c.logger.Log("error_desc", "failed to prepare user namespace", "namespace", m.Namespace.Metadata.GetName(), "error", err)
+			return err
 		}
-		serverRootPath = filepath.Join(mountPath, "sites", siteIDstr, "public")
-	}
-
-	command := []string{"/bin/parent", "caddy", "--conf", "/etc/Caddyfile", "-root", serverRootPath, "--log", "stdout"}
-
-	env_name := "SITENAME"
-	env_val := "/" + siteIDstr
-	env := corev1.EnvVar{Name: &env_name, Value: &env_val}
-
-	dp := &appsv1.Deployment{
-		Metadata: &metav1.ObjectMeta{
-			Name:      &name,
-			Namespace: &namespace,
-			Labels:    labels,
-		},
-		Spec: &appsv1.DeploymentSpec{
-			Replicas: &replicas,
-			Selector: &metav1.LabelSelector{
-				MatchLabels: labels,
-			},
-			Template: &corev1.PodTemplateSpec{
-				Metadata: &metav1.ObjectMeta{
-					Labels: labels,
-				},
-				Spec: &corev1.PodSpec{
-					Volumes: []*corev1.Volume{
-						{
-							Name:         &volumeName,
-							VolumeSource: &volumeSource,
-						},
-					},
-					Containers: []*corev1.Container{
-						{
-							Name:            &name,
-							Image:           &image,
-							Command:         command,
-							Env:             []*corev1.EnvVar{&env},
-							ImagePullPolicy: &imagePullPolicy,
-							VolumeMounts: []*corev1.VolumeMount{
-								{
-									Name:      &volumeName,
-									MountPath: &mountPath,
-								},
-							},
-						},
-					},
-				},
-			},
-		},
-	}
-	if err := c.client.Create(context.TODO(), dp); err != nil {
+	}
+	// create deployment
+	if err := c.createObject(ctx, m.Deployment); err != nil {
 		return err
 	}
-
 	// create service
-	var (
-		svcType          = "NodePort"
-		svcProto         = "TCP"
-		port       int32 = 2018
-		targetPort int32 = 2015
-	)
+	if err := c.createObject(ctx, m.Service); err != nil {
+		return err
+	}
+	if m.ExternalName != nil {
+		if err := c.createObject(ctx, m.ExternalName); err != nil {
+			return err
+		}
+	}
+	if m.Ingress != nil {
+		if err := c.createObject(ctx, m.Ingress); err != nil {
+			return err
+		}
+	}
 
-	svc := &corev1.Service{
-		Metadata: &metav1.ObjectMeta{
-			Name:      &name,
-			Namespace: &namespace,
-			Labels:    labels,
-		},
-		Spec: &corev1.ServiceSpec{
-			Selector: labels,
-			Type:     &svcType,
-			Ports: []*corev1.ServicePort{
-				{
-					Protocol: &svcProto,
-					Port:     &port,
-					TargetPort: &intstr.IntOrString{
-						IntVal: &targetPort,
-					},
-				},
-			},
-		},
-	}
-	if err := c.client.Create(context.TODO(), svc); err != nil {
-		return err
-	}
-
-	if config.Dev == "true" {
+	if m.IngressPath == nil {
 		return nil
 	}
 
 	// Add usersites-ingress entry
+	ingressMtx.Lock()
+	defer ingressMtx.Unlock()
 	var ing extensionsv1beta1.Ingress
-	if err := c.client.Get(context.TODO(), "default", "usersites-ingress", &ing); err != nil {
+	if err := c.client.Get(ctx, "default", "usersites-ingress", &ing); err != nil {
 		return err
 	}
-	backendPath := "/" + siteIDstr
-	backend := extensionsv1beta1.IngressBackend{
-		ServiceName: &name,
-		ServicePort: &intstr.IntOrString{
-			IntVal: &port,
-		},
-	}
-	newHTTPPath := extensionsv1beta1.HTTPIngressPath{
-		Path:    &backendPath,
-		Backend: &backend,
-	}
 	if ing.Spec.Rules[0].IngressRuleValue.Http == nil {
 		ing.Spec.Rules[0].IngressRuleValue.Http = &extensionsv1beta1.HTTPIngressRuleValue{}
 		ing.Spec.Rules[0].IngressRuleValue.Http.Paths = []*extensionsv1beta1.HTTPIngressPath{}
 	}
-	ing.Spec.Rules[0].IngressRuleValue.Http.Paths = append(ing.Spec.Rules[0].IngressRuleValue.Http.Paths, &newHTTPPath)
-	return c.client.Update(context.TODO(), &ing)
+	for _, p := range ing.Spec.Rules[0].IngressRuleValue.Http.Paths {
+		if p.GetPath() == m.IngressPath.GetPath() && p.Backend.GetServiceName() == m.IngressPath.Backend.GetServiceName() {
+			return nil
+		}
+	}
+	ing.Spec.Rules[0].IngressRuleValue.Http.Paths = append(ing.Spec.Rules[0].IngressRuleValue.Http.Paths, m.IngressPath)
+	return c.updateIngress(ctx, &ing, []string{"+" + ingressPathString(m.IngressPath)})
 }
 
-func (c k8sclient) DeleteCaddyService(siteID uint) error {
-	// delete deployment
-	name := "siteid-" + strconv.Itoa(int(siteID)) + "-service"
+// UpdateCaddyService updates the deployment and domain ingress of an existing site to its theme, plan and domains,
+// so its pods are rolled over rather than deleted. The user of a site is part of its deployment's selector, which
+// can't change: a site moving to another user must be created again.
+func (c k8sclient) UpdateCaddyService(ctx context.Context, site Site) error {
+	m := BuildManifest(site)
+	name := serviceName(site.SiteID)
+	namespace, err := c.siteNamespace(ctx, site.SiteID)
+	if err != nil {
+		c.logger.Log("error_desc", "failed to find site namespace", "error", err)
+		return err
+	}
 
 	var dp appsv1.Deployment
-	if err := c.client.Get(context.TODO(), "default", name, &dp); err != nil {
+	if err := c.client.Get(ctx, namespace, name, &dp); err != nil {
 		c.logger.Log("error_desc", "failed to get deployment resource", "error", err)
 		return err
 	}
-	if err := c.client.Delete(context.TODO(), &dp); err != nil {
+	if dp.Metadata.GetLabels()[labelUserID] != m.Deployment.Metadata.GetLabels()[labelUserID] {
+		return fmt.Errorf("site %d belongs to user %s, not %d", site.SiteID, dp.Metadata.GetLabels()[labelUserID], site.UserID)
+	}
+	// annotations the helper doesn't own, such as the deployment's revision, are kept
+	if dp.Metadata.Annotations == nil {
+		dp.Metadata.Annotations = make(map[string]string)
+	}
+	for _, key := range []string{annotationPlan, annotationTheme, annotationDomains} {
+		delete(dp.Metadata.Annotations, key)
+	}
+	for key, value := range m.Deployment.Metadata.GetAnnotations() {
+		dp.Metadata.Annotations[key] = value
+	}
+	dp.Spec.Template = m.Deployment.Spec.Template
+	if err := c.update(ctx, &dp); err != nil {
+		c.logger.Log("error_desc", "failed to update deployment resource", "error", err)
+		return err
+	}
+
+	if m.Ingress == nil {
+		return c.deleteObject(ctx, namespace, name, new(extensionsv1beta1.Ingress))
+	}
+	m.Ingress.Metadata.Namespace = &namespace
+	var ing extensionsv1beta1.Ingress
+	if err := c.client.Get(ctx, namespace, name, &ing); err != nil {
+		if isNotFound(err) {
+			return c.create(ctx, m.Ingress)
+		}
+		return err
+	}
+	ing.Spec = m.Ingress.Spec
+	return c.update(ctx, &ing)
+}
+
+// DeleteCaddyService deletes the objects of a site. Objects that are already gone were deleted by an earlier attempt,
+// so a retry completes a site left half deleted.
+func (c k8sclient) DeleteCaddyService(ctx context.Context, siteID uint) error {
+	// delete deployment
+	name := serviceName(siteID)
+	namespace, err := c.siteNamespace(ctx, siteID)
+	if err != nil {
+		c.logger.Log("error_desc", "failed to find site namespace", "error", err)
+		return err
+	}
+
+	if err := c.deleteObject(ctx, namespace, name, new(appsv1.Deployment)); err != nil {
 		c.logger.Log("error_desc", "failed to delete deployment resource", "error", err)
 		return err
 	}
 	// delete service
-	var svc corev1.Service
-	if err := c.client.Get(context.TODO(), "default", name, &svc); err != nil {
-		c.logger.Log("error_desc", "failed to get service resource", "error", err)
+	if err := c.deleteObject(ctx, namespace, name, new(corev1.Service)); err != nil {
+		c.logger.Log("error_desc", "failed to delete service resource", "error", err)
 		return err
 	}
-	if err := c.client.Delete(context.TODO(), &svc); err != nil {
-		c.logger.Log("error_desc", "failed to delete service resource", "error", err)
+
+	if config.Dev != "true" {
+		// delete usersites-ingress entry
+		if err := c.removeIngressPaths(ctx, name); err != nil {
+			return err
+		}
+	}
+
+	if err := c.deleteDomainIngress(ctx, namespace, name); err != nil {
+		c.logger.Log("error_desc", "failed to delete domain ingress", "error", err)
 		return err
 	}
 
-	if config.Dev == "true" {
+	if namespace == "default" {
 		return nil
 	}
-
-	// delete usersites-ingress entry
-	var ing extensionsv1beta1.Ingress
-	if err := c.client.Get(context.TODO(), "default", "usersites-ingress", &ing); err != nil {
-		c.logger.Log("error_desc", "failed to get usersites-ingress resource", "error", err)
+	if err := c.deleteSiteResources(ctx, "default", name); err != nil {
+		c.logger.Log("error_desc", "failed to delete externalname service", "error", err)
 		return err
 	}
+	return c.releaseUserNamespace(ctx, namespace)
+}
 
-	index := 0
-	found := false
-	for i, v := range ing.Spec.Rules[0].IngressRuleValue.Http.Paths {
-		if *v.Backend.ServiceName == name {
-			found = true
-			index = i
+func (c k8sclient) DeleteUserSites(ctx context.Context, userID uint) ([]SiteResult, error) {
+	selector := new(k8s.LabelSelector)
+	selector.Eq(labelManagedBy, managerName)
+	selector.Eq(labelUserID, strconv.Itoa(int(userID)))
+
+	namespaces := []string{"default"}
+	if config.Tenancy == config.TenancyNamespace {
+		namespaces = append(namespaces, userNamespace(userID))
+	}
+
+	// Sites are discovered from both deployments and services, so a site half torn down by an earlier attempt is still found.
+	siteIDs := make(map[uint]bool)
+	for _, namespace := range namespaces {
+		var dps appsv1.DeploymentList
+		if err := c.client.List(ctx, namespace, &dps, selector.Selector()); err != nil {
+			c.logger.Log("error_desc", "failed to list deployment resources", "namespace", namespace, "error", err)
+			return nil, err
+		}
+		var svcs corev1.ServiceList
+		if err := c.client.List(ctx, namespace, &svcs, selector.Selector()); err != nil {
+			c.logger.Log("error_desc", "failed to list service resources", "namespace", namespace, "error", err)
+			return nil, err
+		}
+		for _, dp := range dps.Items {
+			if id, ok := siteIDOf(dp.Metadata); ok {
+				siteIDs[id] = true
+			}
 		}
+		for _, svc := range svcs.Items {
+			if id, ok := siteIDOf(svc.Metadata); ok {
+				siteIDs[id] = true
+			}
+		}
+	}
+	if len(siteIDs) == 0 {
+		return nil, c.releaseUserNamespace(ctx, namespaces[len(namespaces)-1])
 	}
-	if found {
-		ing.Spec.Rules[0].IngressRuleValue.Http.Paths[index] = ing.Spec.Rules[0].IngressRuleValue.Http.Paths[len(ing.Spec.Rules[0].IngressRuleValue.Http.Paths)-1]
-		ing.Spec.Rules[0].IngressRuleValue.Http.Paths = ing.Spec.Rules[0].IngressRuleValue.Http.Paths[:len(ing.Spec.Rules[0].IngressRuleValue.Http.Paths)-1]
-		if len(ing.Spec.Rules[0].IngressRuleValue.Http.Paths) == 0 {
-			ing.Spec.Rules[0].IngressRuleValue.Http = nil
+
+	results := make([]SiteResult, 0, len(siteIDs))
+	names := make([]string, 0, len(siteIDs))
+	for id := range siteIDs {
+		results = append(results, SiteResult{SiteID: id})
+		names = append(names, serviceName(id))
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].SiteID < results[j].SiteID })
+
+	// The ingress paths carry no labels, so they go first: while the labeled resources remain, a replay can still find them.
+	if config.Dev != "true" {
+		if err := c.removeIngressPaths(ctx, names...); err != nil {
+			c.logger.Log("error_desc", "failed to remove usersites-ingress entries", "error", err)
+			return nil, err
 		}
-		if err := c.client.Update(context.TODO(), &ing); err != nil {
-			return err
+	}
+	failed := false
+	for i := range results {
+		for _, namespace := range namespaces {
+			if err := c.deleteSiteResources(ctx, namespace, serviceName(results[i].SiteID)); err != nil {
+				results[i].Err = err
+				failed = true
+				break
+			}
+		}
+	}
+	if failed {
+		return results, nil
+	}
+	return results, c.releaseUserNamespace(ctx, namespaces[len(namespaces)-1])
+}
+
+func (c k8sclient) CountUserSites(ctx context.Context, userID, except uint) (int, error) {
+	namespace := "default"
+	if config.Tenancy == config.TenancyNamespace {
+		namespace = userNamespace(userID)
+	}
+	selector := new(k8s.LabelSelector)
+	selector.Eq(labelManagedBy, managerName)
+	selector.Eq(labelUserID, strconv.Itoa(int(userID)))
+
+	var dps appsv1.DeploymentList
+	if err := c.client.List(ctx, namespace, &dps, selector.Selector()); err != nil {
+		c.logger.Log("error_desc", "failed to list deployment resources", "namespace", namespace, "error", err)
+		return 0, err
+	}
+	count := 0
+	for _, dp := range dps.Items {
+		if id, _ := siteIDOf(dp.Metadata); id != except {
+			count++
 		}
 	}
+	return count, nil
+}
+
+// managedSites lists the deployments of the helper's sites, optionally narrowed to one site.
+func (c k8sclient) managedSites(ctx context.Context, siteID uint) ([]*appsv1.Deployment, error) {
+	selector := new(k8s.LabelSelector)
+	selector.Eq(labelManagedBy, managerName)
+	if siteID != 0 {
+		selector.Eq(labelSiteID, strconv.Itoa(int(siteID)))
+	}
+	var dps appsv1.DeploymentList
+	if err := c.client.List(ctx, sitesNamespace(), &dps, selector.Selector()); err != nil {
+		return nil, err
+	}
+	return dps.Items, nil
+}
+
+// siteSpec recovers the Site a deployment was created from.
+func siteSpec(dp *appsv1.Deployment) (Site, error) {
+	siteID, ok := siteIDOf(dp.Metadata)
+	if !ok {
+		return Site{}, fmt.Errorf("deployment %s has no %s label", dp.Metadata.GetName(), labelSiteID)
+	}
+	userID, err := strconv.ParseUint(dp.Metadata.GetLabels()[labelUserID], 10, 0)
+	if err != nil {
+		return Site{}, fmt.Errorf("deployment %s has no valid %s label", dp.Metadata.GetName(), labelUserID)
+	}
+	site := Site{
+		UserID: uint(userID),
+		SiteID: siteID,
+		Plan:   dp.Metadata.GetAnnotations()[annotationPlan],
+		Theme:  dp.Metadata.GetAnnotations()[annotationTheme],
+	}
+	if domains := dp.Metadata.GetAnnotations()[annotationDomains]; domains != "" {
+		site.Domains = strings.Split(domains, ",")
+	}
+	return site, nil
+}
+
+// deleteSiteResources deletes the service and deployment of a site, and its domain ingress in operator mode,
+// treating resources that are already gone as deleted.
+func (c k8sclient) deleteSiteResources(ctx context.Context, namespace, name string) error {
+	if err := c.deleteDomainIngress(ctx, namespace, name); err != nil {
+		return err
+	}
+	if err := c.deleteObject(ctx, namespace, name, new(corev1.Service)); err != nil {
+		return err
+	}
+	return c.deleteObject(ctx, namespace, name, new(appsv1.Deployment))
+}
+
+// deleteDomainIngress deletes the ingress of a site's domains, if there is one.
+func (c k8sclient) deleteDomainIngress(ctx context.Context, namespace, name string) error {
+	return c.deleteObject(ctx, namespace, name, new(extensionsv1beta1.Ingress))
+}
+
+// createObject creates an object, treating one that already exists as created.
+func (c k8sclient) createObject(ctx context.Context, r k8s.Resource) error {
+	if err := c.create(ctx, r); err != nil && !isAlreadyExists(err) {
+		return err
+	}
 	return nil
 }
 
+// deleteObject reads the named object into r and deletes it, treating an object that is already gone as deleted.
+func (c k8sclient) deleteObject(ctx context.Context, namespace, name string, r k8s.Resource) error {
+	if err := c.client.Get(ctx, namespace, name, r); err != nil {
+		if isNotFound(err) {
+			return nil
+		}
+		return err
+	}
+	if err := c.delete(ctx, r); err != nil && !isNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+// removeIngressPaths removes every usersites-ingress path backed by one of the named services.
+func (c k8sclient) removeIngressPaths(ctx context.Context, names ...string) error {
+	ingressMtx.Lock()
+	defer ingressMtx.Unlock()
+	var ing extensionsv1beta1.Ingress
+	if err := c.client.Get(ctx, "default", "usersites-ingress", &ing); err != nil {
+		c.logger.Log("error_desc", "failed to get usersites-ingress resource", "error", err)
+		return err
+	}
+	if ing.Spec.Rules[0].IngressRuleValue.Http == nil {
+		return nil
+	}
+
+	remove := make(map[string]bool, len(names))
+	for _, name := range names {
+		remove[name] = true
+	}
+	var (
+		kept []*extensionsv1beta1.HTTPIngressPath
+		diff []string
+	)
+	for _, v := range ing.Spec.Rules[0].IngressRuleValue.Http.Paths {
+		if remove[v.Backend.GetServiceName()] {
+			diff = append(diff, "-"+ingressPathString(v))
+			continue
+		}
+		kept = append(kept, v)
+	}
+	if len(diff) == 0 {
+		return nil
+	}
+	if len(kept) == 0 {
+		ing.Spec.Rules[0].IngressRuleValue.Http = nil
+	} else {
+		ing.Spec.Rules[0].IngressRuleValue.Http.Paths = kept
+	}
+	return c.updateIngress(ctx, &ing, diff)
+}
+
+func siteLabels(site Site) map[string]string {
+	return map[string]string{
+		"app":          serviceName(site.SiteID),
+		labelManagedBy: managerName,
+		labelUserID:    strconv.Itoa(int(site.UserID)),
+		labelSiteID:    strconv.Itoa(int(site.SiteID)),
+	}
+}
+
+func serviceName(siteID uint) string {
+	return "siteid-" + strconv.Itoa(int(siteID)) + "-service"
+}
+
+func siteIDOf(meta *metav1.ObjectMeta) (uint, bool) {
+	id, err := strconv.ParseUint(meta.GetLabels()[labelSiteID], 10, 0)
+	if err != nil {
+		return 0, false
+	}
+	return uint(id), true
+}
+
+func isNotFound(err error) bool {
+	apiErr, ok := err.(*k8s.APIError)
+	return ok && apiErr.Code == http.StatusNotFound
+}
+
+func isAlreadyExists(err error) bool {
+	return isConflict(err)
+}
+
+// isConflict reports a 409, which the API server returns both for existing names and stale resource versions.
+func isConflict(err error) bool {
+	apiErr, ok := err.(*k8s.APIError)
+	return ok && apiErr.Code == http.StatusConflict
+}
+
 // NewClient returns a Client instance with given logger.
+// It connects with config.Kubeconfig and config.KubeContext when a kubeconfig is set, and in-cluster otherwise.
+// When config.Clusters is set, the returned Client spans those clusters and also implements Rebalancer.
 func NewClient(logger log.Logger) (Client, error) {
-	client, err := k8s.NewInClusterClient()
+	if config.Clusters != "" {
+		return newMultiClusterClient(logger)
+	}
+	client, err := newK8sClient(config.Kubeconfig, config.KubeContext)
 	if err != nil {
 		return nil, err
 	}
 
 	return k8sclient{
-		client: client,
+		client: api{client},
 		logger: logger,
 	}, nil
 }
@@ -0,0 +1,589 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	appsv1 "github.com/ericchiang/k8s/apis/apps/v1"
+	corev1 "github.com/ericchiang/k8s/apis/core/v1"
+	extensionsv1beta1 "github.com/ericchiang/k8s/apis/extensions/v1beta1"
+	metav1 "github.com/ericchiang/k8s/apis/meta/v1"
+	rbacv1 "github.com/ericchiang/k8s/apis/rbac/v1"
+	"github.com/go-kit/kit/log"
+	"github.com/seagullbird/headr-k8s-helper/client/fakeapi"
+	"github.com/seagullbird/headr-k8s-helper/config"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// newTestClient returns a client of a fake API server holding an empty usersites-ingress, in prod shared tenancy mode.
+// Call done to stop the server and restore the config.
+func newTestClient() (s *fakeapi.Server, c k8sclient, done func()) {
+	dev, tenancy, dryRun := config.Dev, config.Tenancy, config.DryRun
+	config.Dev, config.Tenancy, config.DryRun = "false", config.TenancyShared, false
+
+	s = fakeapi.NewServer()
+	done = func() {
+		s.Close()
+		config.Dev, config.Tenancy, config.DryRun = dev, tenancy, dryRun
+	}
+
+	name, namespace := "usersites-ingress", "default"
+	s.Seed(&extensionsv1beta1.Ingress{
+		Metadata: &metav1.ObjectMeta{Name: &name, Namespace: &namespace},
+		Spec: &extensionsv1beta1.IngressSpec{
+			Rules: []*extensionsv1beta1.IngressRule{{IngressRuleValue: &extensionsv1beta1.IngressRuleValue{}}},
+		},
+	})
+	return s, k8sclient{client: api{s.Client()}, logger: log.NewNopLogger()}, done
+}
+
+func paths(t *testing.T, c k8sclient) []string {
+	var ing extensionsv1beta1.Ingress
+	if err := c.client.Get(context.Background(), "default", "usersites-ingress", &ing); err != nil {
+		t.Fatalf("get ingress: %v", err)
+	}
+	var paths []string
+	if http := ing.Spec.Rules[0].IngressRuleValue.Http; http != nil {
+		for _, p := range http.Paths {
+			paths = append(paths, p.GetPath()+" "+p.Backend.GetServiceName())
+		}
+	}
+	return paths
+}
+
+func exists(t *testing.T, c k8sclient, r interface{}, name string) bool {
+	var err error
+	switch r := r.(type) {
+	case *appsv1.Deployment:
+		err = c.client.Get(context.Background(), "default", name, r)
+	case *corev1.Service:
+		err = c.client.Get(context.Background(), "default", name, r)
+	}
+	if err != nil && !isNotFound(err) {
+		t.Fatalf("get %s: %v", name, err)
+	}
+	return err == nil
+}
+
+func TestCreateCaddyService(t *testing.T) {
+	_, c, done := newTestClient()
+	defer done()
+	ctx := context.Background()
+
+	if err := c.CreateCaddyService(ctx, Site{UserID: 1, SiteID: 7, Plan: "pro"}); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	var dp appsv1.Deployment
+	if !exists(t, c, &dp, "siteid-7-service") {
+		t.Fatal("deployment not created")
+	}
+	if dp.Metadata.GetLabels()[labelSiteID] != "7" || dp.Metadata.GetAnnotations()[annotationPlan] != "pro" {
+		t.Errorf("deployment labels %v and annotations %v lack the site and plan", dp.Metadata.GetLabels(), dp.Metadata.GetAnnotations())
+	}
+	if !exists(t, c, new(corev1.Service), "siteid-7-service") {
+		t.Error("service not created")
+	}
+	if got, want := paths(t, c), []string{"/7 siteid-7-service"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ingress paths = %v, want %v", got, want)
+	}
+
+	// a redelivery finds the site complete
+	if err := c.CreateCaddyService(ctx, Site{UserID: 1, SiteID: 7}); err != nil {
+		t.Errorf("second create: %v", err)
+	}
+	if got, want := paths(t, c), []string{"/7 siteid-7-service"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ingress paths after the second create = %v, want %v", got, want)
+	}
+}
+
+func TestCreateCaddyServiceRetry(t *testing.T) {
+	s, c, done := newTestClient()
+	defer done()
+	ctx := context.Background()
+	s.FailNext("create", "services", http.StatusInternalServerError)
+
+	if err := c.CreateCaddyService(ctx, Site{UserID: 1, SiteID: 7}); err == nil {
+		t.Fatal("create succeeded, want the service error")
+	}
+	if !exists(t, c, new(appsv1.Deployment), "siteid-7-service") || exists(t, c, new(corev1.Service), "siteid-7-service") {
+		t.Fatal("want only the deployment created")
+	}
+	if err := c.CreateCaddyService(ctx, Site{UserID: 1, SiteID: 7}); err != nil {
+		t.Fatalf("retry: %v", err)
+	}
+	if !exists(t, c, new(corev1.Service), "siteid-7-service") {
+		t.Error("service not created by the retry")
+	}
+	if got, want := paths(t, c), []string{"/7 siteid-7-service"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ingress paths = %v, want %v", got, want)
+	}
+}
+
+func TestCreateCaddyServiceIngressConflict(t *testing.T) {
+	s, c, done := newTestClient()
+	defer done()
+	s.FailNext("update", "ingresses", http.StatusConflict)
+
+	err := c.CreateCaddyService(context.Background(), Site{UserID: 1, SiteID: 7})
+	if !isConflict(err) {
+		t.Fatalf("create error = %v, want conflict", err)
+	}
+	if len(paths(t, c)) != 0 {
+		t.Error("ingress path added despite the conflict")
+	}
+}
+
+func TestDeleteCaddyService(t *testing.T) {
+	_, c, done := newTestClient()
+	defer done()
+	ctx := context.Background()
+	for _, id := range []uint{7, 8} {
+		if err := c.CreateCaddyService(ctx, Site{UserID: 1, SiteID: id}); err != nil {
+			t.Fatalf("create site %d: %v", id, err)
+		}
+	}
+
+	if err := c.DeleteCaddyService(ctx, 7); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if exists(t, c, new(appsv1.Deployment), "siteid-7-service") || exists(t, c, new(corev1.Service), "siteid-7-service") {
+		t.Error("site 7 objects left behind")
+	}
+	if got, want := paths(t, c), []string{"/8 siteid-8-service"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ingress paths = %v, want %v", got, want)
+	}
+
+	// a redelivery finds the site gone
+	if err := c.DeleteCaddyService(ctx, 7); err != nil {
+		t.Errorf("second delete: %v", err)
+	}
+}
+
+func TestDeleteCaddyServiceRetry(t *testing.T) {
+	s, c, done := newTestClient()
+	defer done()
+	ctx := context.Background()
+	if err := c.CreateCaddyService(ctx, Site{UserID: 1, SiteID: 7}); err != nil {
+		t.Fatal(err)
+	}
+	s.FailNext("delete", "services", http.StatusInternalServerError)
+
+	if err := c.DeleteCaddyService(ctx, 7); err == nil {
+		t.Fatal("delete succeeded, want the service error")
+	}
+	if exists(t, c, new(appsv1.Deployment), "siteid-7-service") || !exists(t, c, new(corev1.Service), "siteid-7-service") {
+		t.Fatal("want only the deployment deleted")
+	}
+	if err := c.DeleteCaddyService(ctx, 7); err != nil {
+		t.Fatalf("retry: %v", err)
+	}
+	if exists(t, c, new(corev1.Service), "siteid-7-service") || len(paths(t, c)) != 0 {
+		t.Error("service or ingress path left behind by the retry")
+	}
+}
+
+func TestSiteDomains(t *testing.T) {
+	_, c, done := newTestClient()
+	defer done()
+	ctx := context.Background()
+
+	site := Site{UserID: 1, SiteID: 7, Theme: "hugo-theme-a", Domains: []string{"blog.example.com", "www.example.com"}}
+	if err := c.CreateCaddyService(ctx, site); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	var ing extensionsv1beta1.Ingress
+	if err := c.client.Get(ctx, "default", "siteid-7-service", &ing); err != nil {
+		t.Fatalf("domain ingress: %v", err)
+	}
+	var hosts []string
+	for _, rule := range ing.Spec.Rules {
+		hosts = append(hosts, rule.GetHost()+" "+rule.IngressRuleValue.Http.Paths[0].Backend.GetServiceName())
+	}
+	if want := []string{"blog.example.com siteid-7-service", "www.example.com siteid-7-service"}; !reflect.DeepEqual(hosts, want) {
+		t.Errorf("ingress rules = %v, want %v", hosts, want)
+	}
+	status, err := c.DescribeSite(ctx, 7)
+	if err != nil {
+		t.Fatalf("describe: %v", err)
+	}
+	if status.Theme != site.Theme || !reflect.DeepEqual(status.Domains, site.Domains) {
+		t.Errorf("described site = %+v, want the theme and domains it was created with", status.Site)
+	}
+
+	if err := c.DeleteCaddyService(ctx, 7); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if err := c.client.Get(ctx, "default", "siteid-7-service", &ing); !isNotFound(err) {
+		t.Errorf("domain ingress after delete: %v, want not found", err)
+	}
+}
+
+func TestDeleteUserSitesHalfDeleted(t *testing.T) {
+	_, c, done := newTestClient()
+	defer done()
+	ctx := context.Background()
+	for _, site := range []Site{{UserID: 1, SiteID: 7}, {UserID: 1, SiteID: 8}, {UserID: 2, SiteID: 9}} {
+		if err := c.CreateCaddyService(ctx, site); err != nil {
+			t.Fatalf("create site %d: %v", site.SiteID, err)
+		}
+	}
+	// an earlier attempt got as far as the deployment of site 8
+	var dp appsv1.Deployment
+	exists(t, c, &dp, "siteid-8-service")
+	if err := c.client.Delete(ctx, &dp); err != nil {
+		t.Fatal(err)
+	}
+
+	results, err := c.DeleteUserSites(ctx, 1)
+	if err != nil {
+		t.Fatalf("delete user sites: %v", err)
+	}
+	if len(results) != 2 || results[0].SiteID != 7 || results[1].SiteID != 8 || results[0].Err != nil || results[1].Err != nil {
+		t.Fatalf("results = %+v, want sites 7 and 8 deleted", results)
+	}
+	if exists(t, c, new(corev1.Service), "siteid-8-service") {
+		t.Error("service of site 8 left behind")
+	}
+	if got, want := paths(t, c), []string{"/9 siteid-9-service"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ingress paths = %v, want %v", got, want)
+	}
+	if n, err := c.CountUserSites(ctx, 2, 0); err != nil || n != 1 {
+		t.Errorf("sites of user 2 = %d, %v, want 1", n, err)
+	}
+	if n, err := c.CountUserSites(ctx, 2, 9); err != nil || n != 0 {
+		t.Errorf("sites of user 2 besides site 9 = %d, %v, want 0", n, err)
+	}
+}
+
+func TestDescribeSite(t *testing.T) {
+	_, c, done := newTestClient()
+	defer done()
+	ctx := context.Background()
+	if err := c.CreateCaddyService(ctx, Site{UserID: 1, SiteID: 7}); err != nil {
+		t.Fatal(err)
+	}
+
+	status, err := c.DescribeSite(ctx, 7)
+	if err != nil {
+		t.Fatalf("describe: %v", err)
+	}
+	if status.UserID != 1 || status.Namespace != "default" || status.ServicePort != 2018 || !reflect.DeepEqual(status.IngressPaths, []string{"/7"}) {
+		t.Errorf("status = %+v, want user 1 in default on port 2018 behind /7", status)
+	}
+	if _, err := c.DescribeSite(ctx, 8); err != ErrSiteNotFound {
+		t.Errorf("describe missing site error = %v, want %v", err, ErrSiteNotFound)
+	}
+}
+
+func TestReconcile(t *testing.T) {
+	_, c, done := newTestClient()
+	defer done()
+	ctx := context.Background()
+	for _, id := range []uint{7, 9} {
+		if err := c.CreateCaddyService(ctx, Site{UserID: 1, SiteID: id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// site 7 lost its service, site 9 everything but its ingress path
+	for _, r := range []struct {
+		obj  interface{}
+		name string
+	}{{new(corev1.Service), "siteid-7-service"}, {new(corev1.Service), "siteid-9-service"}, {new(appsv1.Deployment), "siteid-9-service"}} {
+		exists(t, c, r.obj, r.name)
+		var err error
+		switch obj := r.obj.(type) {
+		case *corev1.Service:
+			err = c.client.Delete(ctx, obj)
+		case *appsv1.Deployment:
+			err = c.client.Delete(ctx, obj)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	fixes, err := c.Reconcile(ctx)
+	if err != nil {
+		t.Fatalf("reconcile: %v", err)
+	}
+	var actions []string
+	for _, f := range fixes {
+		if f.Err != nil {
+			t.Errorf("fix %q failed: %v", f.Action, f.Err)
+		}
+		actions = append(actions, f.Action)
+	}
+	if got, want := strings.Join(actions, "; "), "create service; remove ingress path /9"; got != want {
+		t.Errorf("fixes = %q, want %q", got, want)
+	}
+	if !exists(t, c, new(corev1.Service), "siteid-7-service") {
+		t.Error("service of site 7 not recreated")
+	}
+	if got, want := paths(t, c), []string{"/7 siteid-7-service"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ingress paths = %v, want %v", got, want)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	s, c, done := newTestClient()
+	defer done()
+	if err := c.Check(context.Background()); err != nil {
+		t.Fatalf("check: %v", err)
+	}
+	s.Deny("delete", "apps", "deployments")
+	err := c.Check(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "delete apps/deployments") {
+		t.Fatalf("check error = %v, want missing delete apps/deployments", err)
+	}
+}
+
+func TestPreflight(t *testing.T) {
+	s, c, done := newTestClient()
+	defer done()
+	failed := func() map[string]Finding {
+		failed := make(map[string]Finding)
+		for _, f := range c.Preflight(context.Background()) {
+			if f.Err != nil {
+				failed[f.Check] = f
+			}
+		}
+		return failed
+	}
+
+	got := failed()
+	if f, ok := got["persistent volume claim default/nfs"]; len(got) != 1 || !ok || !f.Fatal || f.Fix == "" {
+		t.Fatalf("failed checks = %v, want the missing nfs claim", got)
+	}
+
+	name, namespace, pending := "nfs", "default", "Pending"
+	s.Seed(&corev1.PersistentVolumeClaim{
+		Metadata: &metav1.ObjectMeta{Name: &name, Namespace: &namespace},
+		Status:   &corev1.PersistentVolumeClaimStatus{Phase: &pending},
+	})
+	s.Deny("create", "apps", "deployments")
+	got = failed()
+	if f := got["persistent volume claim default/nfs"]; len(got) != 2 || f.Err == nil || f.Fatal {
+		t.Errorf("failed checks = %v, want a warning for the unbound claim", got)
+	}
+	if f := got["permission to create apps/deployments in namespace default"]; !f.Fatal || !strings.Contains(f.Fix, "create on apps/deployments") {
+		t.Errorf("failed checks = %v, want the denied permission", got)
+	}
+}
+
+func TestRBAC(t *testing.T) {
+	defer func(dev, tenancy string) { config.Dev, config.Tenancy = dev, tenancy }(config.Dev, config.Tenancy)
+	config.Dev, config.Tenancy = "false", config.TenancyNamespace
+
+	// rules lists the resources each role grants, keyed by kind/namespace
+	rules := make(map[string][]string)
+	for _, r := range RBAC("k8s-helper", "headr") {
+		key := kindOf(r) + "/" + r.GetMetadata().GetNamespace()
+		switch r := r.(type) {
+		case *rbacv1.ClusterRole:
+			for _, rule := range r.Rules {
+				rules[key] = append(rules[key], rule.Resources...)
+			}
+		case *rbacv1.Role:
+			for _, rule := range r.Rules {
+				rules[key] = append(rules[key], rule.Resources...)
+			}
+		case *rbacv1.RoleBinding:
+			if s := r.Subjects[0]; s.GetName() != "k8s-helper" || s.GetNamespace() != "headr" {
+				t.Errorf("role binding subject = %v, want the k8s-helper service account in headr", s)
+			}
+		}
+	}
+	want := map[string][]string{
+		"rbac.authorization.k8s.io/v1/ClusterRole/": {
+			"selfsubjectaccessreviews", "deployments", "services", "ingresses", "namespaces", "resourcequotas", "limitranges"},
+		"rbac.authorization.k8s.io/v1/Role/default": {"configmaps", "ingresses"},
+	}
+	if !reflect.DeepEqual(rules, want) {
+		t.Errorf("rules = %v, want %v", rules, want)
+	}
+}
+
+func TestLedger(t *testing.T) {
+	s, c, done := newTestClient()
+	defer done()
+	ctx := context.Background()
+
+	if last, err := c.LastApplied(ctx, SiteKey(7)); err != nil || last != (AppliedEvent{}) {
+		t.Fatalf("last applied = %+v, %v, want none", last, err)
+	}
+	// the first record creates the shard, the second updates it, and a conflict is retried
+	if err := c.RecordApplied(ctx, SiteKey(7), AppliedEvent{ReceivedOn: 10, EventID: "a"}); err != nil {
+		t.Fatalf("record: %v", err)
+	}
+	s.FailNext("update", "configmaps", http.StatusConflict)
+	want := AppliedEvent{ReceivedOn: 20, EventID: "b c"}
+	if err := c.RecordApplied(ctx, SiteKey(7), want); err != nil {
+		t.Fatalf("record: %v", err)
+	}
+	if last, err := c.LastApplied(ctx, SiteKey(7)); err != nil || last != want {
+		t.Errorf("last applied = %+v, %v, want %+v", last, err, want)
+	}
+	if last, err := c.LastApplied(ctx, UserKey(7)); err != nil || last != (AppliedEvent{}) {
+		t.Errorf("last applied to user 7 = %+v, %v, want none", last, err)
+	}
+}
+
+func TestSiteState(t *testing.T) {
+	_, c, done := newTestClient()
+	defer done()
+	ctx := context.Background()
+
+	for _, to := range []SiteState{StatePending, StateProvisioning, StateProvisioning, StateReady, StateDeleting} {
+		if err := c.SetSiteState(ctx, 7, to); err != nil {
+			t.Fatalf("move to %s: %v", to, err)
+		}
+	}
+	err := c.SetSiteState(ctx, 7, StateUpdating)
+	if want := (IllegalTransitionError{SiteID: 7, From: StateDeleting, To: StateUpdating}); err != want {
+		t.Fatalf("update during delete error = %v, want %v", err, want)
+	}
+	if state, err := c.SiteState(ctx, 7); err != nil || state != StateDeleting {
+		t.Errorf("state = %q, %v, want %s", state, err, StateDeleting)
+	}
+	if state, err := c.SiteState(ctx, 8); err != nil || state != StateNone {
+		t.Errorf("state of unknown site = %q, %v, want none", state, err)
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	_, c, done := newTestClient()
+	defer done()
+	config.DryRun = true
+
+	if err := c.CreateCaddyService(context.Background(), Site{UserID: 1, SiteID: 7}); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if exists(t, c, new(appsv1.Deployment), "siteid-7-service") || len(paths(t, c)) != 0 {
+		t.Error("dry run changed the cluster")
+	}
+}
+
+func TestMultiClusterDescribeSite(t *testing.T) {
+	east, eastClient, doneEast := newTestClient()
+	defer doneEast()
+	_, westClient, doneWest := newTestClient()
+	defer doneWest()
+	c := multiClusterClient{
+		names:    []string{"east", "west"},
+		clusters: map[string]k8sclient{"east": eastClient, "west": westClient},
+		logger:   log.NewNopLogger(),
+	}
+	ctx := context.Background()
+	if err := westClient.CreateCaddyService(ctx, Site{UserID: 1, SiteID: 7}); err != nil {
+		t.Fatal(err)
+	}
+
+	status, err := c.DescribeSite(ctx, 7)
+	if err != nil || status.Cluster != "west" {
+		t.Fatalf("describe = %+v, %v, want site 7 in west", status, err)
+	}
+	if _, err := c.DescribeSite(ctx, 8); err != ErrSiteNotFound {
+		t.Errorf("describe missing site error = %v, want %v", err, ErrSiteNotFound)
+	}
+	// the registry lives in the first cluster
+	east.FailNext("get", "configmaps", http.StatusInternalServerError)
+	if _, err := c.DescribeSite(ctx, 7); err == nil || err == ErrSiteNotFound {
+		t.Errorf("describe with an unreadable registry error = %v, want the API error", err)
+	}
+}
+
+func TestParseClusters(t *testing.T) {
+	contexts, err := parseClusters("east=gke-east, west=gke-west")
+	if err != nil || !reflect.DeepEqual(contexts, map[string]string{"east": "gke-east", "west": "gke-west"}) {
+		t.Errorf("parse = %v, %v, want east and west", contexts, err)
+	}
+	for _, clusters := range []string{"east", "=gke-east", "east=gke-east,east=gke-west"} {
+		if _, err := parseClusters(clusters); err == nil {
+			t.Errorf("parse %q succeeded, want an error", clusters)
+		}
+	}
+}
+
+func TestRenderDomains(t *testing.T) {
+	defer func(dev, tenancy string) { config.Dev, config.Tenancy = dev, tenancy }(config.Dev, config.Tenancy)
+	config.Dev, config.Tenancy = "false", config.TenancyShared
+
+	out, err := Render(BuildManifest(Site{UserID: 1, SiteID: 7, Domains: []string{"blog.example.com"}}), "json")
+	if err != nil {
+		t.Fatalf("render: %v", err)
+	}
+	var rendered struct {
+		Objects []struct {
+			Kind string `json:"kind"`
+			Spec struct {
+				Rules []struct {
+					Host string `json:"host"`
+				} `json:"rules"`
+			} `json:"spec"`
+		} `json:"objects"`
+	}
+	if err := json.Unmarshal(out, &rendered); err != nil {
+		t.Fatalf("decode %s: %v", out, err)
+	}
+	var kinds []string
+	for _, o := range rendered.Objects {
+		kinds = append(kinds, o.Kind)
+	}
+	if want := []string{"Deployment", "Service", "Ingress"}; !reflect.DeepEqual(kinds, want) {
+		t.Fatalf("rendered kinds = %v, want %v", kinds, want)
+	}
+	if rules := rendered.Objects[2].Spec.Rules; len(rules) != 1 || rules[0].Host != "blog.example.com" {
+		t.Errorf("ingress rules = %+v, want one for blog.example.com", rules)
+	}
+}
+
+func TestLoadKubeconfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kubeconfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config")
+	kubeconfig := `apiVersion: v1
+kind: Config
+preferences: {}
+clusters:
+- name: dev
+  cluster: &dev
+    server: https://dev.example.com
+    certificate-authority: ca.crt
+- name: dev-copy
+  cluster: *dev
+users:
+- name: dev
+  user: {token: secret}
+contexts:
+- name: dev
+  context:
+    cluster: dev
+    user: dev
+current-context: dev
+`
+	if err := ioutil.WriteFile(path, []byte(kubeconfig), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := loadKubeconfig(filepath.Join(dir, "missing") + string(filepath.ListSeparator) + path)
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if cfg.CurrentContext != "dev" || len(cfg.Clusters) != 2 || cfg.Clusters[1].Cluster.Server != "https://dev.example.com" {
+		t.Errorf("config = %+v, want the dev cluster", cfg)
+	}
+	if want := filepath.Join(dir, "ca.crt"); cfg.Clusters[0].Cluster.CertificateAuthority != want {
+		t.Errorf("certificate authority = %q, want %q", cfg.Clusters[0].Cluster.CertificateAuthority, want)
+	}
+	if len(cfg.AuthInfos) != 1 || cfg.AuthInfos[0].AuthInfo.Token != "secret" {
+		t.Errorf("users = %+v, want the dev token", cfg.AuthInfos)
+	}
+}
@@ -0,0 +1,2 @@
+// Package fake provides an in-memory client.Client for tests of code that provisions sites
+package fake
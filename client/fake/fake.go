@@ -0,0 +1,374 @@
+package fake
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/seagullbird/headr-k8s-helper/client"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// Errors returned like the API server would, for objects that don't exist and for stale updates.
+var (
+	ErrNotFound = errors.New("not found")
+	ErrConflict = errors.New("conflict")
+)
+
+// Op names an API call of the fake that errors can be injected into.
+type Op string
+
+// The calls that can be made to fail.
+const (
+	OpCreateDeployment Op = "create deployment"
+	OpCreateService    Op = "create service"
+	OpUpdateDeployment Op = "update deployment"
+	OpDeleteDeployment Op = "delete deployment"
+	OpDeleteService    Op = "delete service"
+	OpListDeployments  Op = "list deployments"
+	OpUpdateIngress    Op = "update ingress"
+	OpCheck            Op = "check"
+	OpRecordApplied    Op = "record applied"
+)
+
+// Client is a client.Client that keeps the Deployments, Services and usersites-ingress paths of sites in memory,
+// as the shared tenancy mode lays them out. It is safe for concurrent use.
+type Client struct {
+	mtx         sync.Mutex
+	deployments map[uint]client.Site
+	services    map[uint]bool
+	// ingress maps paths to the service they route to
+	ingress  map[string]string
+	ledger   map[string]client.AppliedEvent
+	states   map[uint]client.SiteState
+	failures map[failure]error
+}
+
+type failure struct {
+	op     Op
+	siteID uint
+}
+
+var _ client.Client = (*Client)(nil)
+
+// New returns an empty fake.
+func New() *Client {
+	return &Client{
+		deployments: make(map[uint]client.Site),
+		services:    make(map[uint]bool),
+		ingress:     make(map[string]string),
+		ledger:      make(map[string]client.AppliedEvent),
+		states:      make(map[uint]client.SiteState),
+		failures:    make(map[failure]error),
+	}
+}
+
+// Fail makes op return err for the given site, or for every site when siteID is 0, until it is cleared with a nil err.
+func (f *Client) Fail(op Op, siteID uint, err error) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	if err == nil {
+		delete(f.failures, failure{op, siteID})
+		return
+	}
+	f.failures[failure{op, siteID}] = err
+}
+
+// AddSite stores a complete site, as if it had been created earlier.
+func (f *Client) AddSite(site client.Site) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	f.deployments[site.SiteID] = site
+	f.services[site.SiteID] = true
+	f.ingress[ingressPath(site.SiteID)] = serviceName(site.SiteID)
+}
+
+// State reports which of a site's objects exist.
+func (f *Client) State(siteID uint) (deployment, service, ingress bool) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	_, deployment = f.deployments[siteID]
+	_, ingress = f.ingress[ingressPath(siteID)]
+	return deployment, f.services[siteID], ingress
+}
+
+func (f *Client) fail(op Op, siteID uint) error {
+	if err, ok := f.failures[failure{op, siteID}]; ok {
+		return err
+	}
+	return f.failures[failure{op, 0}]
+}
+
+func (f *Client) CreateCaddyService(ctx context.Context, site client.Site) error {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	if err := f.fail(OpCreateDeployment, site.SiteID); err != nil {
+		return err
+	}
+	// objects that already exist are kept, like the real client does
+	if _, ok := f.deployments[site.SiteID]; !ok {
+		f.deployments[site.SiteID] = site
+	}
+
+	if err := f.fail(OpCreateService, site.SiteID); err != nil {
+		return err
+	}
+	f.services[site.SiteID] = true
+
+	if err := f.fail(OpUpdateIngress, site.SiteID); err != nil {
+		return err
+	}
+	f.ingress[ingressPath(site.SiteID)] = serviceName(site.SiteID)
+	return nil
+}
+
+func (f *Client) UpdateCaddyService(ctx context.Context, site client.Site) error {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	existing, ok := f.deployments[site.SiteID]
+	if !ok {
+		return ErrNotFound
+	}
+	if existing.UserID != site.UserID {
+		return fmt.Errorf("site %d belongs to user %d, not %d", site.SiteID, existing.UserID, site.UserID)
+	}
+	if err := f.fail(OpUpdateDeployment, site.SiteID); err != nil {
+		return err
+	}
+	f.deployments[site.SiteID] = site
+	return nil
+}
+
+func (f *Client) DeleteCaddyService(ctx context.Context, siteID uint) error {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	// objects already gone count as deleted, like the real client does
+	if _, ok := f.deployments[siteID]; ok {
+		if err := f.fail(OpDeleteDeployment, siteID); err != nil {
+			return err
+		}
+		delete(f.deployments, siteID)
+	}
+
+	if f.services[siteID] {
+		if err := f.fail(OpDeleteService, siteID); err != nil {
+			return err
+		}
+		delete(f.services, siteID)
+	}
+
+	return f.removeIngressPaths(siteID)
+}
+
+func (f *Client) DeleteUserSites(ctx context.Context, userID uint) ([]client.SiteResult, error) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	if err := f.fail(OpListDeployments, 0); err != nil {
+		return nil, err
+	}
+	var results []client.SiteResult
+	for siteID, site := range f.deployments {
+		if site.UserID == userID {
+			results = append(results, client.SiteResult{SiteID: siteID})
+		}
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].SiteID < results[j].SiteID })
+
+	for i, r := range results {
+		if err := f.removeIngressPaths(r.SiteID); err != nil {
+			return nil, err
+		}
+		if f.services[r.SiteID] {
+			if err := f.fail(OpDeleteService, r.SiteID); err != nil {
+				results[i].Err = err
+				continue
+			}
+			delete(f.services, r.SiteID)
+		}
+		if err := f.fail(OpDeleteDeployment, r.SiteID); err != nil {
+			results[i].Err = err
+			continue
+		}
+		delete(f.deployments, r.SiteID)
+	}
+	return results, nil
+}
+
+func (f *Client) CountUserSites(ctx context.Context, userID, except uint) (int, error) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	if err := f.fail(OpListDeployments, 0); err != nil {
+		return 0, err
+	}
+	count := 0
+	for _, site := range f.deployments {
+		if site.UserID == userID && site.SiteID != except {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (f *Client) DescribeSite(ctx context.Context, siteID uint) (client.SiteStatus, error) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	if err := f.fail(OpListDeployments, siteID); err != nil {
+		return client.SiteStatus{}, err
+	}
+	if _, ok := f.deployments[siteID]; !ok {
+		return client.SiteStatus{}, client.ErrSiteNotFound
+	}
+	status := f.status(siteID)
+	status.State = f.states[siteID]
+	return status, nil
+}
+
+func (f *Client) ListSites(ctx context.Context) ([]client.SiteStatus, error) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	if err := f.fail(OpListDeployments, 0); err != nil {
+		return nil, err
+	}
+	statuses := make([]client.SiteStatus, 0, len(f.deployments))
+	for siteID := range f.deployments {
+		statuses = append(statuses, f.status(siteID))
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].SiteID < statuses[j].SiteID })
+	return statuses, nil
+}
+
+// Reconcile creates the missing services and ingress paths of sites and removes those of sites that are gone.
+func (f *Client) Reconcile(ctx context.Context) ([]client.Fix, error) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	if err := f.fail(OpListDeployments, 0); err != nil {
+		return nil, err
+	}
+	var fixes []client.Fix
+	for siteID := range f.deployments {
+		if !f.services[siteID] {
+			err := f.fail(OpCreateService, siteID)
+			if err == nil {
+				f.services[siteID] = true
+			}
+			fixes = append(fixes, client.Fix{SiteID: siteID, Action: "create service", Err: err})
+		}
+		if _, ok := f.ingress[ingressPath(siteID)]; !ok {
+			err := f.fail(OpUpdateIngress, siteID)
+			if err == nil {
+				f.ingress[ingressPath(siteID)] = serviceName(siteID)
+			}
+			fixes = append(fixes, client.Fix{SiteID: siteID, Action: "add ingress path " + ingressPath(siteID), Err: err})
+		}
+	}
+	for siteID := range f.services {
+		if _, ok := f.deployments[siteID]; !ok {
+			err := f.fail(OpDeleteService, siteID)
+			if err == nil {
+				delete(f.services, siteID)
+			}
+			fixes = append(fixes, client.Fix{SiteID: siteID, Action: "delete orphaned service default/" + serviceName(siteID), Err: err})
+		}
+	}
+	for path := range f.ingress {
+		siteID := siteIDOfPath(path)
+		if _, ok := f.deployments[siteID]; !ok {
+			err := f.fail(OpUpdateIngress, siteID)
+			if err == nil {
+				delete(f.ingress, path)
+			}
+			fixes = append(fixes, client.Fix{SiteID: siteID, Action: "remove ingress path " + path, Err: err})
+		}
+	}
+	sort.SliceStable(fixes, func(i, j int) bool { return fixes[i].SiteID < fixes[j].SiteID })
+	return fixes, nil
+}
+
+func (f *Client) Check(ctx context.Context) error {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	return f.fail(OpCheck, 0)
+}
+
+// Preflight reports a failed Kubernetes API check when OpCheck fails, and passes otherwise.
+func (f *Client) Preflight(ctx context.Context) []client.Finding {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	return []client.Finding{{Check: "Kubernetes API", Err: f.fail(OpCheck, 0), Fatal: true}}
+}
+
+func (f *Client) LastApplied(ctx context.Context, key string) (client.AppliedEvent, error) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	return f.ledger[key], nil
+}
+
+// RecordApplied fails with the error set for OpRecordApplied with site ID 0.
+func (f *Client) RecordApplied(ctx context.Context, key string, event client.AppliedEvent) error {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	if err := f.fail(OpRecordApplied, 0); err != nil {
+		return err
+	}
+	f.ledger[key] = event
+	return nil
+}
+
+func (f *Client) SiteState(ctx context.Context, siteID uint) (client.SiteState, error) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	return f.states[siteID], nil
+}
+
+func (f *Client) SetSiteState(ctx context.Context, siteID uint, to client.SiteState) error {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	if err := client.CheckTransition(siteID, f.states[siteID], to); err != nil {
+		return err
+	}
+	f.states[siteID] = to
+	return nil
+}
+
+func (f *Client) status(siteID uint) client.SiteStatus {
+	status := client.SiteStatus{
+		Site:              f.deployments[siteID],
+		Namespace:         "default",
+		Replicas:          1,
+		ReadyReplicas:     1,
+		AvailableReplicas: 1,
+		IngressPaths:      []string{},
+	}
+	if f.services[siteID] {
+		status.ServicePort = 2018
+	}
+	if _, ok := f.ingress[ingressPath(siteID)]; ok {
+		status.IngressPaths = append(status.IngressPaths, ingressPath(siteID))
+	}
+	return status
+}
+
+func (f *Client) removeIngressPaths(siteID uint) error {
+	if _, ok := f.ingress[ingressPath(siteID)]; !ok {
+		return nil
+	}
+	if err := f.fail(OpUpdateIngress, siteID); err != nil {
+		return err
+	}
+	delete(f.ingress, ingressPath(siteID))
+	return nil
+}
+
+func serviceName(siteID uint) string {
+	return fmt.Sprintf("siteid-%d-service", siteID)
+}
+
+func ingressPath(siteID uint) string {
+	return "/" + strconv.Itoa(int(siteID))
+}
+
+func siteIDOfPath(path string) uint {
+	id, _ := strconv.ParseUint(path[1:], 10, 0)
+	return uint(id)
+}
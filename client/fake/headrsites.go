@@ -0,0 +1,130 @@
+package fake
+
+import (
+	"context"
+	"encoding/json"
+	metav1 "github.com/ericchiang/k8s/apis/meta/v1"
+	"github.com/seagullbird/headr-k8s-helper/client"
+	"reflect"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// HeadrSites is a client.HeadrSites that keeps HeadrSites in memory. Like the API server, it only marks a deleted
+// HeadrSite with finalizers as deleting, and drops it once an update removed them. It is safe for concurrent use.
+type HeadrSites struct {
+	mtx     sync.Mutex
+	version int
+	sites   map[uint]*client.HeadrSite
+}
+
+var _ client.HeadrSites = (*HeadrSites)(nil)
+
+// NewHeadrSites returns an empty fake.
+func NewHeadrSites() *HeadrSites {
+	return &HeadrSites{sites: make(map[uint]*client.HeadrSite)}
+}
+
+// Get returns a copy of the HeadrSite of a site, and whether it exists.
+func (f *HeadrSites) Get(siteID uint) (*client.HeadrSite, bool) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	site, ok := f.sites[siteID]
+	if !ok {
+		return nil, false
+	}
+	return clone(site), true
+}
+
+func (f *HeadrSites) Apply(ctx context.Context, spec client.HeadrSiteSpec) error {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	site, ok := f.sites[spec.SiteID]
+	if !ok {
+		site = client.NewHeadrSite(spec)
+		f.sites[spec.SiteID] = site
+	} else if len(spec.Domains) == 0 {
+		spec.Domains = site.Spec.Domains
+	}
+	site.Spec = spec
+	f.bump(site, true)
+	return nil
+}
+
+func (f *HeadrSites) Delete(ctx context.Context, siteID uint) error {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	site, ok := f.sites[siteID]
+	if !ok {
+		return nil
+	}
+	if len(site.Metadata.GetFinalizers()) == 0 {
+		delete(f.sites, siteID)
+		return nil
+	}
+	now := time.Now().Unix()
+	site.Metadata.DeletionTimestamp = &metav1.Time{Seconds: &now}
+	f.bump(site, false)
+	return nil
+}
+
+func (f *HeadrSites) List(ctx context.Context, userID uint) (*client.HeadrSiteList, error) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	version := strconv.Itoa(f.version)
+	list := &client.HeadrSiteList{Metadata: &metav1.ListMeta{ResourceVersion: &version}}
+	for _, site := range f.sites {
+		if userID == 0 || site.Spec.UserID == userID {
+			list.Items = append(list.Items, clone(site))
+		}
+	}
+	return list, nil
+}
+
+func (f *HeadrSites) Update(ctx context.Context, site *client.HeadrSite) error {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	// HeadrSites are stored by name, which needn't match their spec
+	id, _ := site.SiteID()
+	stored, ok := f.sites[id]
+	if !ok {
+		return ErrNotFound
+	}
+	if stored.Metadata.GetResourceVersion() != site.Metadata.GetResourceVersion() {
+		return ErrConflict
+	}
+	if site.Deleting() && len(site.Metadata.GetFinalizers()) == 0 {
+		delete(f.sites, id)
+		return nil
+	}
+	updated := clone(site)
+	f.bump(updated, !reflect.DeepEqual(stored.Spec, site.Spec))
+	f.sites[id] = updated
+	site.Metadata.ResourceVersion = updated.Metadata.ResourceVersion
+	return nil
+}
+
+// Watch sends nothing, and ends with ctx.
+func (f *HeadrSites) Watch(ctx context.Context, resourceVersion string, each func(eventType string, site *client.HeadrSite)) error {
+	<-ctx.Done()
+	return nil
+}
+
+// bump gives a changed HeadrSite a new resource version, and a new generation when its spec changed.
+func (f *HeadrSites) bump(site *client.HeadrSite, spec bool) {
+	f.version++
+	version := strconv.Itoa(f.version)
+	site.Metadata.ResourceVersion = &version
+	if spec {
+		generation := site.Metadata.GetGeneration() + 1
+		site.Metadata.Generation = &generation
+	}
+}
+
+func clone(site *client.HeadrSite) *client.HeadrSite {
+	data, _ := json.Marshal(site)
+	c := new(client.HeadrSite)
+	json.Unmarshal(data, c)
+	return c
+}
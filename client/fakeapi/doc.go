@@ -0,0 +1,2 @@
+// Package fakeapi runs an in-process stand-in for the Kubernetes API server, for testing code built on ericchiang/k8s offline
+package fakeapi
@@ -0,0 +1,636 @@
+package fakeapi
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"github.com/ericchiang/k8s"
+	appsv1 "github.com/ericchiang/k8s/apis/apps/v1"
+	authorizationv1 "github.com/ericchiang/k8s/apis/authorization/v1"
+	corev1 "github.com/ericchiang/k8s/apis/core/v1"
+	extensionsv1beta1 "github.com/ericchiang/k8s/apis/extensions/v1beta1"
+	metav1 "github.com/ericchiang/k8s/apis/meta/v1"
+	"github.com/ericchiang/k8s/runtime"
+	"github.com/ericchiang/k8s/watch/versioned"
+	"github.com/golang/protobuf/proto"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	contentTypePB   = "application/vnd.kubernetes.protobuf"
+	contentTypeJSON = "application/json"
+)
+
+var magic = []byte{0x6b, 0x38, 0x73, 0x00}
+
+// object is a generated API type.
+type object interface {
+	k8s.Resource
+	proto.Message
+}
+
+// kind describes a resource the server stores.
+type kind struct {
+	newObject  func() object
+	newList    func() proto.Message
+	namespaced bool
+}
+
+// kinds maps group/version/resource to the resources served.
+var kinds = map[string]kind{
+	"apps/v1/deployments": {
+		func() object { return new(appsv1.Deployment) }, func() proto.Message { return new(appsv1.DeploymentList) }, true},
+	"/v1/services": {
+		func() object { return new(corev1.Service) }, func() proto.Message { return new(corev1.ServiceList) }, true},
+	"extensions/v1beta1/ingresses": {
+		func() object { return new(extensionsv1beta1.Ingress) }, func() proto.Message { return new(extensionsv1beta1.IngressList) }, true},
+	"/v1/configmaps": {
+		func() object { return new(corev1.ConfigMap) }, func() proto.Message { return new(corev1.ConfigMapList) }, true},
+	"/v1/namespaces": {
+		func() object { return new(corev1.Namespace) }, func() proto.Message { return new(corev1.NamespaceList) }, false},
+	"/v1/resourcequotas": {
+		func() object { return new(corev1.ResourceQuota) }, func() proto.Message { return new(corev1.ResourceQuotaList) }, true},
+	"/v1/limitranges": {
+		func() object { return new(corev1.LimitRange) }, func() proto.Message { return new(corev1.LimitRangeList) }, true},
+	"/v1/persistentvolumeclaims": {
+		func() object { return new(corev1.PersistentVolumeClaim) }, func() proto.Message { return new(corev1.PersistentVolumeClaimList) }, true},
+}
+
+// Server is a Kubernetes API server that keeps objects in memory. It serves the kinds above in both protobuf and JSON,
+// assigns resource versions, rejects stale updates and duplicate creates with 409, answers 404 for missing objects,
+// streams watches, and answers self subject access reviews.
+type Server struct {
+	srv *httptest.Server
+
+	mtx      sync.Mutex
+	version  int64
+	objects  map[string]object
+	history  []event
+	watchers map[*watcher]bool
+	denied   map[string]bool
+	failures map[string][]int
+}
+
+type event struct {
+	typ     string
+	version int64
+	gvr     string
+	obj     object
+}
+
+type watcher struct {
+	gvr       string
+	namespace string
+	selector  string
+	events    chan event
+}
+
+// NewServer starts a server; Close it when done.
+func NewServer() *Server {
+	s := &Server{
+		objects:  make(map[string]object),
+		watchers: make(map[*watcher]bool),
+		denied:   make(map[string]bool),
+		failures: make(map[string][]int),
+	}
+	s.srv = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+// URL is the server's endpoint.
+func (s *Server) URL() string {
+	return s.srv.URL
+}
+
+// Client returns a client of the server.
+func (s *Server) Client() *k8s.Client {
+	return &k8s.Client{Endpoint: s.srv.URL, Client: s.srv.Client()}
+}
+
+// Close stops the server and ends its watches.
+func (s *Server) Close() {
+	s.mtx.Lock()
+	for w := range s.watchers {
+		close(w.events)
+		delete(s.watchers, w)
+	}
+	s.mtx.Unlock()
+	s.srv.CloseClientConnections()
+	s.srv.Close()
+}
+
+// Seed stores objects as if they had been created through the API.
+func (s *Server) Seed(objects ...k8s.Resource) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	for _, r := range objects {
+		obj := r.(object)
+		gvr := gvrOf(obj)
+		s.store(gvr, proto.Clone(obj).(object), "ADDED")
+	}
+}
+
+// Deny makes self subject access reviews of the verb on the resource, in the group, come back not allowed.
+func (s *Server) Deny(verb, group, resource string) {
+	s.mtx.Lock()
+	s.denied[verb+" "+group+"/"+resource] = true
+	s.mtx.Unlock()
+}
+
+// FailNext makes the next request with the verb (get, list, create, update or delete) on the resource fail with code.
+func (s *Server) FailNext(verb, resource string, code int) {
+	s.mtx.Lock()
+	key := verb + " " + resource
+	s.failures[key] = append(s.failures[key], code)
+	s.mtx.Unlock()
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	gvr, namespace, name, ok := parsePath(r.URL.Path)
+	if !ok {
+		writeStatus(w, r, http.StatusNotFound, "NotFound", "the server could not find the requested resource")
+		return
+	}
+	if gvr == "authorization.k8s.io/v1/selfsubjectaccessreviews" && r.Method == http.MethodPost {
+		s.review(w, r)
+		return
+	}
+	k, ok := kinds[gvr]
+	allNamespaces := r.Method == http.MethodGet && name == ""
+	if !ok || !k.namespaced && namespace != "" || k.namespaced && namespace == "" && !allNamespaces {
+		writeStatus(w, r, http.StatusNotFound, "NotFound", "the server could not find the requested resource")
+		return
+	}
+
+	verb := ""
+	switch {
+	case r.Method == http.MethodGet && r.URL.Query().Get("watch") == "true":
+		s.watch(w, r, gvr, namespace)
+		return
+	case r.Method == http.MethodGet && name == "":
+		verb = "list"
+	case r.Method == http.MethodGet:
+		verb = "get"
+	case r.Method == http.MethodPost && name == "":
+		verb = "create"
+	case r.Method == http.MethodPut && name != "":
+		verb = "update"
+	case r.Method == http.MethodDelete && name != "":
+		verb = "delete"
+	default:
+		writeStatus(w, r, http.StatusMethodNotAllowed, "MethodNotAllowed", "method not allowed")
+		return
+	}
+	resource := gvr[strings.LastIndex(gvr, "/")+1:]
+	if code, ok := s.injectedFailure(verb, resource); ok {
+		writeStatus(w, r, code, http.StatusText(code), "injected failure")
+		return
+	}
+
+	switch verb {
+	case "list":
+		s.list(w, r, gvr, k, namespace)
+	case "get":
+		s.get(w, r, gvr, namespace, name)
+	case "create":
+		s.create(w, r, gvr, k, namespace)
+	case "update":
+		s.update(w, r, gvr, k, namespace, name)
+	case "delete":
+		s.delete(w, r, gvr, namespace, name)
+	}
+}
+
+func (s *Server) injectedFailure(verb, resource string) (int, bool) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	key := verb + " " + resource
+	codes := s.failures[key]
+	if len(codes) == 0 {
+		return 0, false
+	}
+	s.failures[key] = codes[1:]
+	return codes[0], true
+}
+
+func (s *Server) get(w http.ResponseWriter, r *http.Request, gvr, namespace, name string) {
+	s.mtx.Lock()
+	obj, ok := s.objects[key(gvr, namespace, name)]
+	s.mtx.Unlock()
+	if !ok {
+		writeStatus(w, r, http.StatusNotFound, "NotFound", fmt.Sprintf("%s %q not found", gvr, name))
+		return
+	}
+	writeObject(w, r, http.StatusOK, obj)
+}
+
+func (s *Server) list(w http.ResponseWriter, r *http.Request, gvr string, k kind, namespace string) {
+	selector := r.URL.Query().Get("labelSelector")
+	s.mtx.Lock()
+	var keys []string
+	for key, obj := range s.objects {
+		if strings.HasPrefix(key, gvr+"|") && matches(obj, namespace, selector) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	list := k.newList()
+	items := reflect.ValueOf(list).Elem().FieldByName("Items")
+	for _, key := range keys {
+		items.Set(reflect.Append(items, reflect.ValueOf(s.objects[key])))
+	}
+	version := strconv.FormatInt(s.version, 10)
+	s.mtx.Unlock()
+	reflect.ValueOf(list).Elem().FieldByName("Metadata").Set(reflect.ValueOf(&metav1.ListMeta{ResourceVersion: &version}))
+	writeObject(w, r, http.StatusOK, list)
+}
+
+func (s *Server) create(w http.ResponseWriter, r *http.Request, gvr string, k kind, namespace string) {
+	obj := k.newObject()
+	if !decodeBody(w, r, obj) {
+		return
+	}
+	meta := obj.GetMetadata()
+	if meta == nil || meta.GetName() == "" {
+		writeStatus(w, r, http.StatusUnprocessableEntity, "Invalid", "metadata.name is required")
+		return
+	}
+	if meta.GetNamespace() != "" && meta.GetNamespace() != namespace {
+		writeStatus(w, r, http.StatusBadRequest, "BadRequest", "the namespace of the object does not match the namespace of the request")
+		return
+	}
+	if namespace != "" {
+		meta.Namespace = &namespace
+	}
+
+	s.mtx.Lock()
+	if _, exists := s.objects[key(gvr, namespace, meta.GetName())]; exists {
+		s.mtx.Unlock()
+		writeStatus(w, r, http.StatusConflict, "AlreadyExists", fmt.Sprintf("%s %q already exists", gvr, meta.GetName()))
+		return
+	}
+	s.store(gvr, obj, "ADDED")
+	s.mtx.Unlock()
+	writeObject(w, r, http.StatusCreated, obj)
+}
+
+func (s *Server) update(w http.ResponseWriter, r *http.Request, gvr string, k kind, namespace, name string) {
+	obj := k.newObject()
+	if !decodeBody(w, r, obj) {
+		return
+	}
+	meta := obj.GetMetadata()
+	if meta == nil || meta.GetName() != name {
+		writeStatus(w, r, http.StatusBadRequest, "BadRequest", "the name of the object does not match the name in the URL")
+		return
+	}
+	if namespace != "" {
+		meta.Namespace = &namespace
+	}
+
+	s.mtx.Lock()
+	current, ok := s.objects[key(gvr, namespace, name)]
+	if !ok {
+		s.mtx.Unlock()
+		writeStatus(w, r, http.StatusNotFound, "NotFound", fmt.Sprintf("%s %q not found", gvr, name))
+		return
+	}
+	// an update without a resource version overwrites unconditionally, as the API server allows for these kinds
+	if v := meta.GetResourceVersion(); v != "" && v != current.GetMetadata().GetResourceVersion() {
+		s.mtx.Unlock()
+		writeStatus(w, r, http.StatusConflict, "Conflict", fmt.Sprintf("Operation cannot be fulfilled on %s %q: the object has been modified; please apply your changes to the latest version and try again", gvr, name))
+		return
+	}
+	meta.Uid = current.GetMetadata().Uid
+	s.store(gvr, obj, "MODIFIED")
+	s.mtx.Unlock()
+	writeObject(w, r, http.StatusOK, obj)
+}
+
+func (s *Server) delete(w http.ResponseWriter, r *http.Request, gvr, namespace, name string) {
+	s.mtx.Lock()
+	k := key(gvr, namespace, name)
+	obj, ok := s.objects[k]
+	if !ok {
+		s.mtx.Unlock()
+		writeStatus(w, r, http.StatusNotFound, "NotFound", fmt.Sprintf("%s %q not found", gvr, name))
+		return
+	}
+	delete(s.objects, k)
+	s.version++
+	s.publish(event{"DELETED", s.version, gvr, obj})
+	s.mtx.Unlock()
+	writeStatus(w, r, http.StatusOK, "", "")
+}
+
+// store saves the object with a new resource version and publishes the event. s.mtx must be held.
+func (s *Server) store(gvr string, obj object, typ string) {
+	s.version++
+	meta := obj.GetMetadata()
+	version := strconv.FormatInt(s.version, 10)
+	meta.ResourceVersion = &version
+	if meta.Uid == nil {
+		uid := "uid-" + version
+		meta.Uid = &uid
+	}
+	s.objects[key(gvr, meta.GetNamespace(), meta.GetName())] = obj
+	s.publish(event{typ, s.version, gvr, proto.Clone(obj).(object)})
+}
+
+// publish records an event and hands it to the matching watches. s.mtx must be held.
+func (s *Server) publish(e event) {
+	s.history = append(s.history, e)
+	for w := range s.watchers {
+		if w.gvr == e.gvr && matches(e.obj, w.namespace, w.selector) {
+			select {
+			case w.events <- e:
+			default:
+				// a watcher that can't keep up is ended, as the API server would
+				close(w.events)
+				delete(s.watchers, w)
+			}
+		}
+	}
+}
+
+// watch streams events of a kind. Without a resourceVersion it starts with an ADDED event per existing object,
+// with one it replays the events after that version.
+func (s *Server) watch(w http.ResponseWriter, r *http.Request, gvr, namespace string) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeStatus(w, r, http.StatusInternalServerError, "InternalError", "streaming unsupported")
+		return
+	}
+	wt := &watcher{
+		gvr:       gvr,
+		namespace: namespace,
+		selector:  r.URL.Query().Get("labelSelector"),
+		events:    make(chan event, 1000),
+	}
+
+	s.mtx.Lock()
+	var backlog []event
+	if v := r.URL.Query().Get("resourceVersion"); v != "" {
+		since, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			s.mtx.Unlock()
+			writeStatus(w, r, http.StatusBadRequest, "BadRequest", "invalid resourceVersion")
+			return
+		}
+		for _, e := range s.history {
+			if e.version > since && e.gvr == gvr && matches(e.obj, namespace, wt.selector) {
+				backlog = append(backlog, e)
+			}
+		}
+	} else {
+		var keys []string
+		for key, obj := range s.objects {
+			if strings.HasPrefix(key, gvr+"|") && matches(obj, namespace, wt.selector) {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			obj := s.objects[key]
+			backlog = append(backlog, event{"ADDED", s.version, gvr, proto.Clone(obj).(object)})
+		}
+	}
+	s.watchers[wt] = true
+	s.mtx.Unlock()
+
+	defer func() {
+		s.mtx.Lock()
+		if s.watchers[wt] {
+			delete(s.watchers, wt)
+		}
+		s.mtx.Unlock()
+	}()
+
+	pb := wantsProtobuf(r)
+	if pb {
+		w.Header().Set("Content-Type", contentTypePB+";stream=watch")
+	} else {
+		w.Header().Set("Content-Type", contentTypeJSON)
+	}
+	w.WriteHeader(http.StatusOK)
+	send := func(e event) error {
+		var err error
+		if pb {
+			err = writeFrame(w, e)
+		} else {
+			err = json.NewEncoder(w).Encode(struct {
+				Type   string `json:"type"`
+				Object object `json:"object"`
+			}{e.typ, e.obj})
+		}
+		flusher.Flush()
+		return err
+	}
+	for _, e := range backlog {
+		if err := send(e); err != nil {
+			return
+		}
+	}
+	for {
+		select {
+		case e, ok := <-wt.events:
+			if !ok {
+				return
+			}
+			if err := send(e); err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// writeFrame writes a protobuf watch event, prefixed by its length.
+func writeFrame(w http.ResponseWriter, e event) error {
+	raw, err := encodePB(e.obj)
+	if err != nil {
+		return err
+	}
+	typ := e.typ
+	data, err := proto.Marshal(&versioned.Event{Type: &typ, Object: &runtime.RawExtension{Raw: raw}})
+	if err != nil {
+		return err
+	}
+	length := make([]byte, 4)
+	binary.BigEndian.PutUint32(length, uint32(len(data)))
+	if _, err := w.Write(length); err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+func (s *Server) review(w http.ResponseWriter, r *http.Request) {
+	review := new(authorizationv1.SelfSubjectAccessReview)
+	if !decodeBody(w, r, review) {
+		return
+	}
+	attrs := review.GetSpec().GetResourceAttributes()
+	s.mtx.Lock()
+	allowed := !s.denied[attrs.GetVerb()+" "+attrs.GetGroup()+"/"+attrs.GetResource()]
+	s.mtx.Unlock()
+	review.Status = &authorizationv1.SubjectAccessReviewStatus{Allowed: &allowed}
+	writeObject(w, r, http.StatusCreated, review)
+}
+
+// parsePath splits /api/v1/namespaces/ns/services/name or /apis/apps/v1/deployments into group/version/resource, namespace and name.
+func parsePath(path string) (gvr, namespace, name string, ok bool) {
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	switch {
+	case len(parts) >= 3 && parts[0] == "api":
+		gvr, parts = "/"+parts[1], parts[2:]
+	case len(parts) >= 4 && parts[0] == "apis":
+		gvr, parts = parts[1]+"/"+parts[2], parts[3:]
+	default:
+		return "", "", "", false
+	}
+	if len(parts) >= 3 && parts[0] == "namespaces" {
+		namespace, parts = parts[1], parts[2:]
+	}
+	switch len(parts) {
+	case 1:
+		return gvr + "/" + parts[0], namespace, "", true
+	case 2:
+		return gvr + "/" + parts[0], namespace, parts[1], true
+	}
+	return "", "", "", false
+}
+
+func key(gvr, namespace, name string) string {
+	return gvr + "|" + namespace + "|" + name
+}
+
+func gvrOf(obj object) string {
+	for gvr, k := range kinds {
+		if reflect.TypeOf(k.newObject()) == reflect.TypeOf(obj) {
+			return gvr
+		}
+	}
+	panic(fmt.Sprintf("fakeapi: unsupported type %T", obj))
+}
+
+// matches reports whether the object is in the namespace, or any namespace when it is empty, and has the labels
+// of an equality based selector such as "a=b,c!=d".
+func matches(obj object, namespace, selector string) bool {
+	meta := obj.GetMetadata()
+	if namespace != "" && meta.GetNamespace() != namespace {
+		return false
+	}
+	labels := meta.GetLabels()
+	for _, req := range strings.Split(selector, ",") {
+		req = strings.TrimSpace(req)
+		if req == "" {
+			continue
+		}
+		if kv := strings.SplitN(req, "!=", 2); len(kv) == 2 {
+			if labels[kv[0]] == kv[1] {
+				return false
+			}
+			continue
+		}
+		kv := strings.SplitN(strings.Replace(req, "==", "=", 1), "=", 2)
+		if len(kv) != 2 {
+			// only key existence is left
+			if _, ok := labels[req]; !ok {
+				return false
+			}
+			continue
+		}
+		if value, ok := labels[kv[0]]; !ok || value != kv[1] {
+			return false
+		}
+	}
+	return true
+}
+
+func decodeBody(w http.ResponseWriter, r *http.Request, obj proto.Message) bool {
+	data, err := ioutil.ReadAll(r.Body)
+	if err == nil {
+		if strings.HasPrefix(r.Header.Get("Content-Type"), contentTypePB) {
+			err = decodePB(data, obj)
+		} else {
+			err = json.Unmarshal(data, obj)
+		}
+	}
+	if err != nil {
+		writeStatus(w, r, http.StatusBadRequest, "BadRequest", "decode body: "+err.Error())
+		return false
+	}
+	return true
+}
+
+func decodePB(data []byte, obj proto.Message) error {
+	if len(data) < len(magic) || string(data[:len(magic)]) != string(magic) {
+		return fmt.Errorf("not a kubernetes protobuf object")
+	}
+	var u runtime.Unknown
+	if err := proto.Unmarshal(data[len(magic):], &u); err != nil {
+		return err
+	}
+	return proto.Unmarshal(u.Raw, obj)
+}
+
+func encodePB(obj proto.Message) ([]byte, error) {
+	raw, err := proto.Marshal(obj)
+	if err != nil {
+		return nil, err
+	}
+	data, err := proto.Marshal(&runtime.Unknown{Raw: raw})
+	if err != nil {
+		return nil, err
+	}
+	return append(append([]byte{}, magic...), data...), nil
+}
+
+// wantsProtobuf reports whether the response should be protobuf: unless JSON is asked for,
+// since ericchiang/k8s can't decode JSON into the generated types.
+func wantsProtobuf(r *http.Request) bool {
+	return !strings.Contains(r.Header.Get("Accept"), contentTypeJSON)
+}
+
+func writeObject(w http.ResponseWriter, r *http.Request, code int, obj proto.Message) {
+	var (
+		data []byte
+		err  error
+	)
+	if wantsProtobuf(r) {
+		w.Header().Set("Content-Type", contentTypePB)
+		data, err = encodePB(obj)
+	} else {
+		w.Header().Set("Content-Type", contentTypeJSON)
+		data, err = json.Marshal(obj)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(code)
+	w.Write(data)
+}
+
+// writeStatus answers with a metav1.Status, a failure one unless code is 2xx.
+func writeStatus(w http.ResponseWriter, r *http.Request, code int, reason, message string) {
+	status, c := "Success", int32(code)
+	if code/100 != 2 {
+		status = "Failure"
+	}
+	writeObject(w, r, code, &metav1.Status{
+		Status:  &status,
+		Reason:  &reason,
+		Message: &message,
+		Code:    &c,
+	})
+}
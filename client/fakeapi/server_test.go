@@ -0,0 +1,164 @@
+package fakeapi
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/ericchiang/k8s"
+	corev1 "github.com/ericchiang/k8s/apis/core/v1"
+	metav1 "github.com/ericchiang/k8s/apis/meta/v1"
+	"net/http"
+	"testing"
+)
+
+func configMap(name string, data map[string]string) *corev1.ConfigMap {
+	namespace := "default"
+	return &corev1.ConfigMap{
+		Metadata: &metav1.ObjectMeta{Name: &name, Namespace: &namespace, Labels: map[string]string{"app": name}},
+		Data:     data,
+	}
+}
+
+func statusCode(err error) int {
+	if apiErr, ok := err.(*k8s.APIError); ok {
+		return apiErr.Code
+	}
+	return 0
+}
+
+func TestResourceVersions(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	c := s.Client()
+	ctx := context.Background()
+
+	cm := configMap("a", map[string]string{"k": "1"})
+	if err := c.Create(ctx, cm); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if err := c.Create(ctx, configMap("a", nil)); statusCode(err) != http.StatusConflict {
+		t.Fatalf("duplicate create error = %v, want 409", err)
+	}
+
+	var stale corev1.ConfigMap
+	if err := c.Get(ctx, "default", "a", &stale); err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	cm.Data["k"] = "2"
+	if err := c.Update(ctx, cm); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	if cm.Metadata.GetResourceVersion() == stale.Metadata.GetResourceVersion() {
+		t.Fatal("update kept the resource version")
+	}
+	stale.Data["k"] = "3"
+	if err := c.Update(ctx, &stale); statusCode(err) != http.StatusConflict {
+		t.Fatalf("stale update error = %v, want 409", err)
+	}
+
+	if err := c.Delete(ctx, cm); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if err := c.Get(ctx, "default", "a", new(corev1.ConfigMap)); statusCode(err) != http.StatusNotFound {
+		t.Fatalf("get after delete error = %v, want 404", err)
+	}
+	if err := c.Delete(ctx, cm); statusCode(err) != http.StatusNotFound {
+		t.Fatalf("second delete error = %v, want 404", err)
+	}
+}
+
+func TestListSelectors(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	s.Seed(configMap("a", nil), configMap("b", nil))
+
+	selector := new(k8s.LabelSelector)
+	selector.Eq("app", "b")
+	var list corev1.ConfigMapList
+	if err := s.Client().List(context.Background(), k8s.AllNamespaces, &list, selector.Selector()); err != nil {
+		t.Fatalf("list: %v", err)
+	}
+	if len(list.Items) != 1 || list.Items[0].Metadata.GetName() != "b" {
+		t.Fatalf("list returned %d items, want only b", len(list.Items))
+	}
+}
+
+func TestJSON(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+
+	body, _ := json.Marshal(configMap("a", map[string]string{"k": "v"}))
+	req, _ := http.NewRequest("POST", s.URL()+"/api/v1/namespaces/default/configmaps", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("create status = %d, want 201", resp.StatusCode)
+	}
+
+	req, _ = http.NewRequest("GET", s.URL()+"/api/v1/namespaces/default/configmaps/a", nil)
+	req.Header.Set("Accept", "application/json")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var cm corev1.ConfigMap
+	if err := json.NewDecoder(resp.Body).Decode(&cm); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if cm.Data["k"] != "v" || cm.Metadata.GetResourceVersion() == "" {
+		t.Fatalf("got %v, want data k=v and a resource version", cm.String())
+	}
+}
+
+func TestWatch(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	c := s.Client()
+	ctx := context.Background()
+	s.Seed(configMap("a", nil))
+
+	w, err := c.Watch(ctx, "default", new(corev1.ConfigMap))
+	if err != nil {
+		t.Fatalf("watch: %v", err)
+	}
+	defer w.Close()
+
+	b := configMap("b", nil)
+	if err := c.Create(ctx, b); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Delete(ctx, b); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []struct{ typ, name string }{{"ADDED", "a"}, {"ADDED", "b"}, {"DELETED", "b"}} {
+		var cm corev1.ConfigMap
+		typ, err := w.Next(&cm)
+		if err != nil {
+			t.Fatalf("next: %v", err)
+		}
+		if typ != want.typ || cm.Metadata.GetName() != want.name {
+			t.Fatalf("event %s %s, want %s %s", typ, cm.Metadata.GetName(), want.typ, want.name)
+		}
+	}
+}
+
+func TestFailNext(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	s.Seed(configMap("a", nil))
+	s.FailNext("get", "configmaps", http.StatusInternalServerError)
+
+	c := s.Client()
+	if err := c.Get(context.Background(), "default", "a", new(corev1.ConfigMap)); statusCode(err) != http.StatusInternalServerError {
+		t.Fatalf("first get error = %v, want 500", err)
+	}
+	if err := c.Get(context.Background(), "default", "a", new(corev1.ConfigMap)); err != nil {
+		t.Fatalf("second get: %v", err)
+	}
+}
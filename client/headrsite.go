@@ -0,0 +1,319 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"github.com/ericchiang/k8s"
+	apiextensionsv1beta1 "github.com/ericchiang/k8s/apis/apiextensions/v1beta1"
+	metav1 "github.com/ericchiang/k8s/apis/meta/v1"
+	"github.com/go-kit/kit/log"
+	"github.com/seagullbird/headr-k8s-helper/config"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The HeadrSite custom resource, which declares a site in operator mode. HeadrSites live in the default namespace,
+// named by HeadrSiteName.
+const (
+	HeadrSiteGroup   = "headr.io"
+	HeadrSiteVersion = "v1alpha1"
+	headrSitePlural  = "headrsites"
+	// SiteFinalizer holds a HeadrSite back from deletion until the operator tore its site down
+	SiteFinalizer = "headr.io/site-cleanup"
+)
+
+// Condition types of a HeadrSite status.
+const (
+	// ConditionProvisioned is True once the objects of the site exist as its spec declares them
+	ConditionProvisioned = "Provisioned"
+	// ConditionReady is True while the site has a ready replica
+	ConditionReady = "Ready"
+)
+
+func init() {
+	k8s.Register(HeadrSiteGroup, HeadrSiteVersion, headrSitePlural, true, &HeadrSite{})
+	k8s.RegisterList(HeadrSiteGroup, HeadrSiteVersion, headrSitePlural, true, &HeadrSiteList{})
+}
+
+// HeadrSite declares a site: the operator provisions it as its spec says and reports how that went in its status.
+type HeadrSite struct {
+	Kind       string             `json:"kind,omitempty"`
+	APIVersion string             `json:"apiVersion,omitempty"`
+	Metadata   *metav1.ObjectMeta `json:"metadata"`
+	Spec       HeadrSiteSpec      `json:"spec"`
+	Status     HeadrSiteStatus    `json:"status,omitempty"`
+}
+
+// GetMetadata implements k8s.Resource.
+func (s *HeadrSite) GetMetadata() *metav1.ObjectMeta {
+	return s.Metadata
+}
+
+// HeadrSiteSpec is the site a HeadrSite declares.
+type HeadrSiteSpec struct {
+	SiteID  uint     `json:"siteID"`
+	UserID  uint     `json:"userID"`
+	Theme   string   `json:"theme,omitempty"`
+	Plan    string   `json:"plan,omitempty"`
+	Domains []string `json:"domains,omitempty"`
+}
+
+// Site returns the site the spec declares.
+func (s HeadrSiteSpec) Site() Site {
+	return Site{UserID: s.UserID, SiteID: s.SiteID, Plan: s.Plan, Theme: s.Theme, Domains: s.Domains}
+}
+
+// HeadrSiteStatus is what the operator last observed of a HeadrSite.
+type HeadrSiteStatus struct {
+	// ObservedGeneration is the generation of the spec the conditions are about
+	ObservedGeneration int64           `json:"observedGeneration,omitempty"`
+	Conditions         []SiteCondition `json:"conditions,omitempty"`
+}
+
+// SiteCondition is one aspect of a HeadrSite's status, in the usual shape of Kubernetes conditions.
+type SiteCondition struct {
+	Type               string    `json:"type"`
+	Status             string    `json:"status"`
+	Reason             string    `json:"reason,omitempty"`
+	Message            string    `json:"message,omitempty"`
+	LastTransitionTime time.Time `json:"lastTransitionTime"`
+}
+
+// Condition returns the condition of type typ, or nil.
+func (s HeadrSiteStatus) Condition(typ string) *SiteCondition {
+	for i := range s.Conditions {
+		if s.Conditions[i].Type == typ {
+			return &s.Conditions[i]
+		}
+	}
+	return nil
+}
+
+// SetCondition sets the condition of type typ, keeping its transition time unless its status changes.
+func (s *HeadrSiteStatus) SetCondition(typ, status, reason, message string) {
+	if c := s.Condition(typ); c != nil {
+		if c.Status != status {
+			c.LastTransitionTime = time.Now().UTC().Truncate(time.Second)
+		}
+		c.Status, c.Reason, c.Message = status, reason, message
+		return
+	}
+	s.Conditions = append(s.Conditions, SiteCondition{
+		Type:               typ,
+		Status:             status,
+		Reason:             reason,
+		Message:            message,
+		LastTransitionTime: time.Now().UTC().Truncate(time.Second),
+	})
+}
+
+// HeadrSiteList is a list of HeadrSites.
+type HeadrSiteList struct {
+	Metadata *metav1.ListMeta `json:"metadata"`
+	Items    []*HeadrSite     `json:"items"`
+}
+
+// GetMetadata implements k8s.ResourceList.
+func (l *HeadrSiteList) GetMetadata() *metav1.ListMeta {
+	return l.Metadata
+}
+
+// HeadrSiteName names the HeadrSite of a site.
+func HeadrSiteName(siteID uint) string {
+	return "site-" + strconv.Itoa(int(siteID))
+}
+
+// SiteID returns the ID of the site a HeadrSite is named after, which its spec must declare too.
+func (s *HeadrSite) SiteID() (uint, bool) {
+	name := s.Metadata.GetName()
+	if !strings.HasPrefix(name, "site-") {
+		return 0, false
+	}
+	id, err := strconv.ParseUint(strings.TrimPrefix(name, "site-"), 10, 0)
+	if err != nil || id == 0 {
+		return 0, false
+	}
+	return uint(id), true
+}
+
+// NewHeadrSite returns the HeadrSite declaring spec, labeled like the objects of its site.
+func NewHeadrSite(spec HeadrSiteSpec) *HeadrSite {
+	name, namespace := HeadrSiteName(spec.SiteID), "default"
+	labels := siteLabels(spec.Site())
+	delete(labels, "app")
+	return &HeadrSite{
+		Kind:       "HeadrSite",
+		APIVersion: HeadrSiteGroup + "/" + HeadrSiteVersion,
+		Metadata: &metav1.ObjectMeta{
+			Name:      &name,
+			Namespace: &namespace,
+			Labels:    labels,
+		},
+		Spec: spec,
+	}
+}
+
+// HasFinalizer reports whether the HeadrSite carries SiteFinalizer.
+func (s *HeadrSite) HasFinalizer() bool {
+	for _, f := range s.Metadata.GetFinalizers() {
+		if f == SiteFinalizer {
+			return true
+		}
+	}
+	return false
+}
+
+// Deleting reports whether the HeadrSite was deleted and waits for its finalizers.
+func (s *HeadrSite) Deleting() bool {
+	return s.Metadata.GetDeletionTimestamp() != nil
+}
+
+// HeadrSiteCRD returns the CustomResourceDefinition of HeadrSite. Its schema requires the site and user IDs.
+func HeadrSiteCRD() *apiextensionsv1beta1.CustomResourceDefinition {
+	var (
+		name                          = headrSitePlural + "." + HeadrSiteGroup
+		group, version, scope         = HeadrSiteGroup, HeadrSiteVersion, "Namespaced"
+		plural, singular, kind, lkind = headrSitePlural, "headrsite", "HeadrSite", "HeadrSiteList"
+		object, integer, str, array   = "object", "integer", "string", "array"
+		one                           = float64(1)
+	)
+	return &apiextensionsv1beta1.CustomResourceDefinition{
+		Metadata: &metav1.ObjectMeta{
+			Name:   &name,
+			Labels: map[string]string{labelManagedBy: managerName},
+		},
+		Spec: &apiextensionsv1beta1.CustomResourceDefinitionSpec{
+			Group:   &group,
+			Version: &version,
+			Scope:   &scope,
+			Names: &apiextensionsv1beta1.CustomResourceDefinitionNames{
+				Plural:     &plural,
+				Singular:   &singular,
+				Kind:       &kind,
+				ListKind:   &lkind,
+				ShortNames: []string{"hs"},
+			},
+			Validation: &apiextensionsv1beta1.CustomResourceValidation{
+				OpenAPIV3Schema: &apiextensionsv1beta1.JSONSchemaProps{
+					Properties: map[string]*apiextensionsv1beta1.JSONSchemaProps{
+						"spec": {
+							Type:     &object,
+							Required: []string{"siteID", "userID"},
+							Properties: map[string]*apiextensionsv1beta1.JSONSchemaProps{
+								"siteID":  {Type: &integer, Minimum: &one},
+								"userID":  {Type: &integer, Minimum: &one},
+								"theme":   {Type: &str},
+								"plan":    {Type: &str},
+								"domains": {Type: &array},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+// HeadrSites reads and writes the HeadrSite resources of operator mode.
+type HeadrSites interface {
+	// Apply creates the HeadrSite declaring spec, or updates its spec when it exists, keeping its domains
+	// when spec has none
+	Apply(ctx context.Context, spec HeadrSiteSpec) error
+	// Delete deletes the HeadrSite of a site; the operator tears the site down before it's gone.
+	// A HeadrSite that doesn't exist is deleted already
+	Delete(ctx context.Context, siteID uint) error
+	// List lists the HeadrSites of a user, or every HeadrSite when userID is 0
+	List(ctx context.Context, userID uint) (*HeadrSiteList, error)
+	// Update writes a HeadrSite back, its finalizers and status included
+	Update(ctx context.Context, site *HeadrSite) error
+	// Watch calls each with the changes to HeadrSites after resourceVersion, until the watch ends or fails
+	Watch(ctx context.Context, resourceVersion string, each func(eventType string, site *HeadrSite)) error
+}
+
+// ErrMultipleClusters is returned by NewHeadrSites with several clusters, which operator mode doesn't support.
+var ErrMultipleClusters = errors.New("operator mode needs a single cluster")
+
+// NewHeadrSites returns the HeadrSites of the cluster NewClient connects to.
+func NewHeadrSites(logger log.Logger) (HeadrSites, error) {
+	if config.Clusters != "" {
+		return nil, ErrMultipleClusters
+	}
+	client, err := newK8sClient(config.Kubeconfig, config.KubeContext)
+	if err != nil {
+		return nil, err
+	}
+	return headrSites{k8sclient{client: api{client}, logger: logger}}, nil
+}
+
+// headrSites implements HeadrSites with a k8sclient, so its writes are traced and dry-run like the client's.
+type headrSites struct {
+	k8sclient
+}
+
+func (c headrSites) Apply(ctx context.Context, spec HeadrSiteSpec) error {
+	site := NewHeadrSite(spec)
+	err := c.create(ctx, site)
+	if !isAlreadyExists(err) {
+		return err
+	}
+	var existing HeadrSite
+	if err := c.client.Get(ctx, "default", site.Metadata.GetName(), &existing); err != nil {
+		return err
+	}
+	if len(spec.Domains) == 0 {
+		spec.Domains = existing.Spec.Domains
+	}
+	existing.Spec = spec
+	existing.Metadata.Labels = site.Metadata.Labels
+	return c.update(ctx, &existing)
+}
+
+func (c headrSites) Delete(ctx context.Context, siteID uint) error {
+	var site HeadrSite
+	if err := c.client.Get(ctx, "default", HeadrSiteName(siteID), &site); err != nil {
+		if isNotFound(err) {
+			return nil
+		}
+		return err
+	}
+	if err := c.delete(ctx, &site); err != nil && !isNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+func (c headrSites) List(ctx context.Context, userID uint) (*HeadrSiteList, error) {
+	selector := new(k8s.LabelSelector)
+	selector.Eq(labelManagedBy, managerName)
+	if userID != 0 {
+		selector.Eq(labelUserID, strconv.Itoa(int(userID)))
+	}
+	var sites HeadrSiteList
+	if err := c.client.List(ctx, "default", &sites, selector.Selector()); err != nil {
+		return nil, err
+	}
+	return &sites, nil
+}
+
+func (c headrSites) Update(ctx context.Context, site *HeadrSite) error {
+	return c.update(ctx, site)
+}
+
+func (c headrSites) Watch(ctx context.Context, resourceVersion string, each func(eventType string, site *HeadrSite)) error {
+	selector := new(k8s.LabelSelector)
+	selector.Eq(labelManagedBy, managerName)
+	w, err := c.client.Watch(ctx, "default", &HeadrSite{}, selector.Selector(), k8s.ResourceVersion(resourceVersion))
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+	for {
+		site := new(HeadrSite)
+		eventType, err := w.Next(site)
+		if err != nil {
+			return err
+		}
+		each(eventType, site)
+	}
+}
@@ -0,0 +1,78 @@
+package client
+
+import (
+	"github.com/ericchiang/k8s"
+	"github.com/seagullbird/headr-k8s-helper/metrics"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// instrument counts and times every request the client sends to the API server.
+func instrument(client *k8s.Client) {
+	next := client.Client.Transport
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	client.Client.Transport = instrumentedTransport{next}
+}
+
+type instrumentedTransport struct {
+	next http.RoundTripper
+}
+
+func (t instrumentedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	verb, resource := requestKind(req)
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req)
+	metrics.KubernetesRequestDuration.With("verb", verb, "resource", resource).Observe(time.Since(start).Seconds())
+	code := "error"
+	if err == nil {
+		code = strconv.Itoa(resp.StatusCode)
+	}
+	metrics.KubernetesRequests.With("verb", verb, "resource", resource, "code", code).Add(1)
+	return resp, err
+}
+
+// requestKind returns the API verb and resource of a request, from paths such as
+// /api/v1/namespaces/default/services/name or /apis/apps/v1/deployments.
+func requestKind(req *http.Request) (verb, resource string) {
+	parts := strings.Split(strings.Trim(req.URL.Path, "/"), "/")
+	switch {
+	case len(parts) > 2 && parts[0] == "api":
+		parts = parts[2:]
+	case len(parts) > 3 && parts[0] == "apis":
+		parts = parts[3:]
+	default:
+		return strings.ToLower(req.Method), "other"
+	}
+	if len(parts) > 2 && parts[0] == "namespaces" {
+		parts = parts[2:]
+	}
+	resource = parts[0]
+	named := len(parts) > 1
+
+	switch req.Method {
+	case http.MethodGet:
+		switch {
+		case req.URL.Query().Get("watch") == "true":
+			verb = "watch"
+		case named:
+			verb = "get"
+		default:
+			verb = "list"
+		}
+	case http.MethodPost:
+		verb = "create"
+	case http.MethodPut:
+		verb = "update"
+	case http.MethodPatch:
+		verb = "patch"
+	case http.MethodDelete:
+		verb = "delete"
+	default:
+		verb = strings.ToLower(req.Method)
+	}
+	return verb, resource
+}
@@ -0,0 +1,83 @@
+package client
+
+import (
+	"fmt"
+	"github.com/ericchiang/k8s"
+	"github.com/ghodss/yaml"
+	"github.com/seagullbird/headr-k8s-helper/config"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// newK8sClient connects with the given kubeconfig and context, or with the pod's service account when kubeconfig is empty.
+func newK8sClient(kubeconfig, context string) (*k8s.Client, error) {
+	var (
+		client *k8s.Client
+		err    error
+	)
+	if kubeconfig == "" {
+		client, err = k8s.NewInClusterClient()
+	} else {
+		var cfg *k8s.Config
+		if cfg, err = loadKubeconfig(kubeconfig); err != nil {
+			return nil, err
+		}
+		if context != "" {
+			cfg.CurrentContext = context
+		}
+		client, err = k8s.NewClient(cfg)
+	}
+	if err != nil {
+		return nil, err
+	}
+	// Bound how long a request waits for its response; a whole-request timeout would cut watches off
+	if t, ok := client.Client.Transport.(*http.Transport); ok {
+		t.ResponseHeaderTimeout = time.Duration(config.RequestTimeout) * time.Second
+	}
+	instrument(client)
+	return client, nil
+}
+
+// loadKubeconfig reads the first existing file of a KUBECONFIG style path list.
+// It may be YAML or JSON.
+func loadKubeconfig(paths string) (*k8s.Config, error) {
+	var path string
+	for _, p := range filepath.SplitList(paths) {
+		if _, err := os.Stat(p); err == nil {
+			path = p
+			break
+		}
+	}
+	if path == "" {
+		return nil, fmt.Errorf("kubeconfig %q not found", paths)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cfg k8s.Config
+	if err := yaml.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("decode kubeconfig %s: %v", path, err)
+	}
+
+	// Relative file references are relative to the kubeconfig itself, as kubectl resolves them
+	dir := filepath.Dir(path)
+	resolve := func(p *string) {
+		if *p != "" && !filepath.IsAbs(*p) {
+			*p = filepath.Join(dir, *p)
+		}
+	}
+	for i := range cfg.Clusters {
+		resolve(&cfg.Clusters[i].Cluster.CertificateAuthority)
+	}
+	for i := range cfg.AuthInfos {
+		resolve(&cfg.AuthInfos[i].AuthInfo.ClientCertificate)
+		resolve(&cfg.AuthInfos[i].AuthInfo.ClientKey)
+		resolve(&cfg.AuthInfos[i].AuthInfo.TokenFile)
+	}
+	return &cfg, nil
+}
@@ -0,0 +1,44 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// AppliedEvent identifies the last event applied to a site or user, as recorded in the event ledger.
+type AppliedEvent struct {
+	// ReceivedOn is when sitemgr received the event, in Unix seconds
+	ReceivedOn int64  `json:"received_on"`
+	EventID    string `json:"event_id"`
+}
+
+// SiteKey and UserKey name the ledger entries of a site and of a user.
+func SiteKey(siteID uint) string {
+	return "site-" + strconv.Itoa(int(siteID))
+}
+
+func UserKey(userID uint) string {
+	return "user-" + strconv.Itoa(int(userID))
+}
+
+func (c k8sclient) LastApplied(ctx context.Context, key string) (AppliedEvent, error) {
+	value, ok, err := c.storeGet(ctx, ledgerName, key)
+	if err != nil || !ok {
+		return AppliedEvent{}, err
+	}
+	// entries are "<received_on> <event_id>"
+	fields := strings.SplitN(value, " ", 2)
+	receivedOn, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil || len(fields) != 2 {
+		return AppliedEvent{}, fmt.Errorf("invalid ledger entry %s: %q", key, value)
+	}
+	return AppliedEvent{ReceivedOn: receivedOn, EventID: fields[1]}, nil
+}
+
+func (c k8sclient) RecordApplied(ctx context.Context, key string, event AppliedEvent) error {
+	return c.storeUpdate(ctx, ledgerName, key, func(string, bool) (string, error) {
+		return strconv.FormatInt(event.ReceivedOn, 10) + " " + event.EventID, nil
+	})
+}
@@ -0,0 +1,335 @@
+package client
+
+import (
+	appsv1 "github.com/ericchiang/k8s/apis/apps/v1"
+	corev1 "github.com/ericchiang/k8s/apis/core/v1"
+	extensionsv1beta1 "github.com/ericchiang/k8s/apis/extensions/v1beta1"
+	metav1 "github.com/ericchiang/k8s/apis/meta/v1"
+	"github.com/ericchiang/k8s/apis/resource"
+	"github.com/ericchiang/k8s/util/intstr"
+	"github.com/seagullbird/headr-k8s-helper/config"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Manifest holds the objects CreateCaddyService sends to the API server for a site.
+type Manifest struct {
+	// Namespace, ResourceQuota and LimitRange make up the user namespace; they are nil in shared tenancy mode
+	Namespace     *corev1.Namespace
+	ResourceQuota *corev1.ResourceQuota
+	LimitRange    *corev1.LimitRange
+
+	Deployment *appsv1.Deployment
+	Service    *corev1.Service
+	// ExternalName routes the ingress to a service outside the default namespace; it is nil in shared tenancy mode
+	ExternalName *corev1.Service
+	// IngressPath is appended to usersites-ingress; it is nil in dev mode
+	IngressPath *extensionsv1beta1.HTTPIngressPath
+	// Ingress routes the site's domains to its service; it is nil when the site has none
+	Ingress *extensionsv1beta1.Ingress
+}
+
+// BuildManifest builds the objects of a site according to the current config, without contacting the API server.
+func BuildManifest(site Site) Manifest {
+	var m Manifest
+	namespace := "default"
+	if config.Tenancy == config.TenancyNamespace {
+		namespace = userNamespace(site.UserID)
+		m.Namespace, m.ResourceQuota, m.LimitRange = userNamespaceObjects(site)
+	}
+
+	siteIDstr := strconv.Itoa(int(site.SiteID))
+	// deployment
+	var (
+		name                  = serviceName(site.SiteID)
+		labels                = siteLabels(site)
+		replicas        int32 = 1
+		volumeName            = "data"
+		mountPath             = "/www"
+		serverRootPath        = ""
+		image                 = "seagullbird/headr-caddy:2.0.0"
+		imagePullPolicy       = "Always"
+		hostPath              = "/home/docker/data/sites/" + siteIDstr + "/public"
+		nfsPvcName            = "nfs"
+	)
+
+	var volumeSource corev1.VolumeSource
+	switch config.Dev {
+	case "true":
+		volumeSource = corev1.VolumeSource{
+			HostPath: &corev1.HostPathVolumeSource{
+				Path: &hostPath,
+			},
+		}
+		serverRootPath = mountPath
+	case "false":
+		volumeSource = corev1.VolumeSource{
+			PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
+				ClaimName: &nfsPvcName,
+			},
+		}
+		// The nfs claim lives in the default namespace and can't be mounted from a user namespace
+		if namespace != "default" {
+			volumeSource = corev1.VolumeSource{
+				Nfs: &corev1.NFSVolumeSource{
+					Server: &config.NFSServer,
+					Path:   &config.NFSPath,
+				},
+			}
+		}
+		serverRootPath = filepath.Join(mountPath, "sites", siteIDstr, "public")
+	}
+
+	command := []string{"/bin/parent", "caddy", "--conf", "/etc/Caddyfile", "-root", serverRootPath, "--log", "stdout"}
+
+	env_name := "SITENAME"
+	env_val := "/" + siteIDstr
+	env := []*corev1.EnvVar{{Name: &env_name, Value: &env_val}}
+	if site.Theme != "" {
+		themeName := "THEME"
+		theme := site.Theme
+		env = append(env, &corev1.EnvVar{Name: &themeName, Value: &theme})
+	}
+
+	m.Deployment = &appsv1.Deployment{
+		Metadata: &metav1.ObjectMeta{
+			Name:      &name,
+			Namespace: &namespace,
+			Labels:    labels,
+		},
+		Spec: &appsv1.DeploymentSpec{
+			Replicas: &replicas,
+			Selector: &metav1.LabelSelector{
+				MatchLabels: labels,
+			},
+			Template: &corev1.PodTemplateSpec{
+				Metadata: &metav1.ObjectMeta{
+					Labels: labels,
+				},
+				Spec: &corev1.PodSpec{
+					Volumes: []*corev1.Volume{
+						{
+							Name:         &volumeName,
+							VolumeSource: &volumeSource,
+						},
+					},
+					Containers: []*corev1.Container{
+						{
+							Name:            &name,
+							Image:           &image,
+							Command:         command,
+							Env:             env,
+							ImagePullPolicy: &imagePullPolicy,
+							VolumeMounts: []*corev1.VolumeMount{
+								{
+									Name:      &volumeName,
+									MountPath: &mountPath,
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	annotations := map[string]string{}
+	if site.Plan != "" {
+		annotations[annotationPlan] = site.Plan
+	}
+	if site.Theme != "" {
+		annotations[annotationTheme] = site.Theme
+	}
+	if len(site.Domains) > 0 {
+		annotations[annotationDomains] = strings.Join(site.Domains, ",")
+	}
+	if len(annotations) > 0 {
+		m.Deployment.Metadata.Annotations = annotations
+	}
+
+	// service
+	var (
+		svcType          = "NodePort"
+		svcProto         = "TCP"
+		port       int32 = 2018
+		targetPort int32 = 2015
+	)
+	if namespace != "default" {
+		// Only the ExternalName service in the default namespace is reachable from the ingress
+		svcType = "ClusterIP"
+	}
+
+	m.Service = &corev1.Service{
+		Metadata: &metav1.ObjectMeta{
+			Name:      &name,
+			Namespace: &namespace,
+			Labels:    labels,
+		},
+		Spec: &corev1.ServiceSpec{
+			Selector: labels,
+			Type:     &svcType,
+			Ports: []*corev1.ServicePort{
+				{
+					Protocol: &svcProto,
+					Port:     &port,
+					TargetPort: &intstr.IntOrString{
+						IntVal: &targetPort,
+					},
+				},
+			},
+		},
+	}
+	if namespace != "default" {
+		m.ExternalName = externalNameService(site, namespace, port)
+	}
+	if len(site.Domains) > 0 {
+		m.Ingress = domainIngress(site, namespace, port)
+	}
+
+	if config.Dev == "true" {
+		return m
+	}
+
+	// usersites-ingress entry
+	backendPath := "/" + siteIDstr
+	m.IngressPath = &extensionsv1beta1.HTTPIngressPath{
+		Path: &backendPath,
+		Backend: &extensionsv1beta1.IngressBackend{
+			ServiceName: &name,
+			ServicePort: &intstr.IntOrString{
+				IntVal: &port,
+			},
+		},
+	}
+	return m
+}
+
+// userNamespaceObjects builds the user's namespace, sized by the user's plan.
+func userNamespaceObjects(site Site) (*corev1.Namespace, *corev1.ResourceQuota, *corev1.LimitRange) {
+	name := userNamespace(site.UserID)
+	labels := map[string]string{
+		labelManagedBy: managerName,
+		labelUserID:    strconv.Itoa(int(site.UserID)),
+	}
+	ns := &corev1.Namespace{
+		Metadata: &metav1.ObjectMeta{
+			Name:   &name,
+			Labels: labels,
+		},
+	}
+
+	plan := config.PlanFor(site.Plan)
+	var (
+		quotaName     = "site-quota"
+		limitName     = "site-limits"
+		containerType = "Container"
+	)
+	quota := &corev1.ResourceQuota{
+		Metadata: &metav1.ObjectMeta{
+			Name:      &quotaName,
+			Namespace: &name,
+			Labels:    labels,
+		},
+		Spec: &corev1.ResourceQuotaSpec{
+			Hard: map[string]*resource.Quantity{
+				"pods":            quantity(plan.Pods),
+				"services":        quantity(plan.Pods),
+				"requests.cpu":    quantity(plan.CPU),
+				"requests.memory": quantity(plan.Memory),
+				"limits.cpu":      quantity(plan.CPU),
+				"limits.memory":   quantity(plan.Memory),
+			},
+		},
+	}
+	limits := &corev1.LimitRange{
+		Metadata: &metav1.ObjectMeta{
+			Name:      &limitName,
+			Namespace: &name,
+			Labels:    labels,
+		},
+		Spec: &corev1.LimitRangeSpec{
+			Limits: []*corev1.LimitRangeItem{
+				{
+					Type: &containerType,
+					Default: map[string]*resource.Quantity{
+						"cpu":    quantity(plan.DefaultCPU),
+						"memory": quantity(plan.DefaultMemory),
+					},
+					DefaultRequest: map[string]*resource.Quantity{
+						"cpu":    quantity(plan.DefaultCPU),
+						"memory": quantity(plan.DefaultMemory),
+					},
+				},
+			},
+		},
+	}
+	return ns, quota, limits
+}
+
+// externalNameService builds the default namespace service that routes the ingress to a site in a user namespace.
+func externalNameService(site Site, namespace string, port int32) *corev1.Service {
+	var (
+		name         = serviceName(site.SiteID)
+		defaultNS    = "default"
+		svcType      = "ExternalName"
+		svcProto     = "TCP"
+		externalName = name + "." + namespace + ".svc.cluster.local"
+	)
+	return &corev1.Service{
+		Metadata: &metav1.ObjectMeta{
+			Name:      &name,
+			Namespace: &defaultNS,
+			Labels:    siteLabels(site),
+		},
+		Spec: &corev1.ServiceSpec{
+			Type:         &svcType,
+			ExternalName: &externalName,
+			Ports: []*corev1.ServicePort{
+				{
+					Protocol: &svcProto,
+					Port:     &port,
+				},
+			},
+		},
+	}
+}
+
+// domainIngress builds the ingress routing each of a site's domains to its service.
+func domainIngress(site Site, namespace string, port int32) *extensionsv1beta1.Ingress {
+	name := serviceName(site.SiteID)
+	ing := &extensionsv1beta1.Ingress{
+		Metadata: &metav1.ObjectMeta{
+			Name:      &name,
+			Namespace: &namespace,
+			Labels:    siteLabels(site),
+		},
+		Spec: &extensionsv1beta1.IngressSpec{},
+	}
+	for _, domain := range site.Domains {
+		domain := domain
+		ing.Spec.Rules = append(ing.Spec.Rules, &extensionsv1beta1.IngressRule{
+			Host: &domain,
+			IngressRuleValue: &extensionsv1beta1.IngressRuleValue{
+				Http: &extensionsv1beta1.HTTPIngressRuleValue{
+					Paths: []*extensionsv1beta1.HTTPIngressPath{{
+						Backend: &extensionsv1beta1.IngressBackend{
+							ServiceName: &name,
+							ServicePort: &intstr.IntOrString{IntVal: &port},
+						},
+					}},
+				},
+			},
+		})
+	}
+	return ing
+}
+
+// ingressPathString formats an ingress path as path -> service:port, for logs and diffs.
+func ingressPathString(p *extensionsv1beta1.HTTPIngressPath) string {
+	return p.GetPath() + " -> " + p.Backend.GetServiceName() + ":" + strconv.Itoa(int(p.Backend.ServicePort.GetIntVal()))
+}
+
+func quantity(s string) *resource.Quantity {
+	return &resource.Quantity{String_: &s}
+}
@@ -0,0 +1,405 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	corev1 "github.com/ericchiang/k8s/apis/core/v1"
+	metav1 "github.com/ericchiang/k8s/apis/meta/v1"
+	"github.com/go-kit/kit/log"
+	"github.com/seagullbird/headr-k8s-helper/config"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Placement policies, selected with config.Placement
+const (
+	// PlacementHash spreads sites over the clusters by a hash of the site ID
+	PlacementHash = "hash"
+	// PlacementLeastLoaded places a site in the cluster with the fewest sites
+	PlacementLeastLoaded = "least-loaded"
+	// PlacementPinned places a user's sites in the cluster pinned in config.PinnedUsers, and hashes the others
+	PlacementPinned = "pinned"
+)
+
+// registryName is the ConfigMap, in the default namespace of the first cluster, that records which cluster each site lives in.
+const registryName = "headr-site-placement"
+
+// ErrUnknownCluster is returned when a cluster name is not one of config.Clusters.
+var ErrUnknownCluster = errors.New("unknown cluster")
+
+// Rebalancer is implemented by a Client that spans several clusters.
+type Rebalancer interface {
+	// Rebalance moves a site to the named cluster.
+	Rebalance(ctx context.Context, siteID uint, to string) error
+}
+
+type multiClusterClient struct {
+	// names is sorted, names[0] holds the placement registry
+	names    []string
+	clusters map[string]k8sclient
+	logger   log.Logger
+}
+
+func (c multiClusterClient) CreateCaddyService(ctx context.Context, site Site) error {
+	cluster, err := c.place(ctx, site)
+	if err != nil {
+		c.logger.Log("error_desc", "failed to place site", "error", err)
+		return err
+	}
+	c.logger.Log("info", "Placing site", "site_id", site.SiteID, "cluster", cluster)
+	if err := c.setPlacement(ctx, site.SiteID, cluster); err != nil {
+		return err
+	}
+	return c.clusters[cluster].CreateCaddyService(ctx, site)
+}
+
+func (c multiClusterClient) DeleteCaddyService(ctx context.Context, siteID uint) error {
+	cluster, err := c.locate(ctx, siteID)
+	if err == ErrSiteNotFound {
+		// deleted by an earlier attempt
+		return c.setPlacement(ctx, siteID, "")
+	}
+	if err != nil {
+		return err
+	}
+	if err := c.clusters[cluster].DeleteCaddyService(ctx, siteID); err != nil {
+		return err
+	}
+	return c.setPlacement(ctx, siteID, "")
+}
+
+func (c multiClusterClient) UpdateCaddyService(ctx context.Context, site Site) error {
+	cluster, err := c.locate(ctx, site.SiteID)
+	if err != nil {
+		return err
+	}
+	return c.clusters[cluster].UpdateCaddyService(ctx, site)
+}
+
+func (c multiClusterClient) DeleteUserSites(ctx context.Context, userID uint) ([]SiteResult, error) {
+	var all []SiteResult
+	for _, name := range c.names {
+		results, err := c.clusters[name].DeleteUserSites(ctx, userID)
+		if err != nil {
+			return all, fmt.Errorf("cluster %s: %v", name, err)
+		}
+		for _, r := range results {
+			if r.Err == nil {
+				if err := c.setPlacement(ctx, r.SiteID, ""); err != nil {
+					r.Err = err
+				}
+			}
+			all = append(all, r)
+		}
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].SiteID < all[j].SiteID })
+	return all, nil
+}
+
+func (c multiClusterClient) CountUserSites(ctx context.Context, userID, except uint) (int, error) {
+	total := 0
+	for _, name := range c.names {
+		n, err := c.clusters[name].CountUserSites(ctx, userID, except)
+		if err != nil {
+			return 0, fmt.Errorf("cluster %s: %v", name, err)
+		}
+		total += n
+	}
+	return total, nil
+}
+
+func (c multiClusterClient) DescribeSite(ctx context.Context, siteID uint) (SiteStatus, error) {
+	cluster, err := c.locate(ctx, siteID)
+	if err != nil {
+		return SiteStatus{}, err
+	}
+	status, err := c.clusters[cluster].describeSite(ctx, siteID)
+	if err != nil {
+		return SiteStatus{}, err
+	}
+	status.Cluster = cluster
+	status.State, err = c.SiteState(ctx, siteID)
+	return status, err
+}
+
+func (c multiClusterClient) ListSites(ctx context.Context) ([]SiteStatus, error) {
+	var all []SiteStatus
+	for _, name := range c.names {
+		statuses, err := c.clusters[name].ListSites(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("cluster %s: %v", name, err)
+		}
+		for _, status := range statuses {
+			status.Cluster = name
+			all = append(all, status)
+		}
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].SiteID < all[j].SiteID })
+	return all, nil
+}
+
+func (c multiClusterClient) Reconcile(ctx context.Context) ([]Fix, error) {
+	var all []Fix
+	for _, name := range c.names {
+		fixes, err := c.clusters[name].Reconcile(ctx)
+		for _, fix := range fixes {
+			fix.Action += " in cluster " + name
+			all = append(all, fix)
+		}
+		if err != nil {
+			return all, fmt.Errorf("cluster %s: %v", name, err)
+		}
+	}
+	return all, nil
+}
+
+func (c multiClusterClient) Check(ctx context.Context) error {
+	for _, name := range c.names {
+		if err := c.clusters[name].Check(ctx); err != nil {
+			return fmt.Errorf("cluster %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+func (c multiClusterClient) Preflight(ctx context.Context) []Finding {
+	var findings []Finding
+	for _, name := range c.names {
+		for _, f := range c.clusters[name].Preflight(ctx) {
+			f.Check = "cluster " + name + ": " + f.Check
+			findings = append(findings, f)
+		}
+	}
+	return findings
+}
+
+// The event ledger and site states live in the first cluster, with the placement registry.
+func (c multiClusterClient) LastApplied(ctx context.Context, key string) (AppliedEvent, error) {
+	return c.clusters[c.names[0]].LastApplied(ctx, key)
+}
+
+func (c multiClusterClient) RecordApplied(ctx context.Context, key string, event AppliedEvent) error {
+	return c.clusters[c.names[0]].RecordApplied(ctx, key, event)
+}
+
+func (c multiClusterClient) SiteState(ctx context.Context, siteID uint) (SiteState, error) {
+	return c.clusters[c.names[0]].SiteState(ctx, siteID)
+}
+
+func (c multiClusterClient) SetSiteState(ctx context.Context, siteID uint, to SiteState) error {
+	return c.clusters[c.names[0]].SetSiteState(ctx, siteID, to)
+}
+
+// Rebalance recreates the site in the target cluster, then removes it from its current one.
+// The site's content must be reachable from the target cluster's volume.
+func (c multiClusterClient) Rebalance(ctx context.Context, siteID uint, to string) error {
+	target, ok := c.clusters[to]
+	if !ok {
+		return ErrUnknownCluster
+	}
+	from, err := c.locate(ctx, siteID)
+	if err != nil {
+		return err
+	}
+	if from == to {
+		return nil
+	}
+	dps, err := c.clusters[from].managedSites(ctx, siteID)
+	if err != nil {
+		return err
+	}
+	if len(dps) == 0 {
+		return fmt.Errorf("site %d has no deployment in cluster %s", siteID, from)
+	}
+	site, err := siteSpec(dps[0])
+	if err != nil {
+		return err
+	}
+
+	if err := target.CreateCaddyService(ctx, site); err != nil {
+		return fmt.Errorf("create in cluster %s: %v", to, err)
+	}
+	if err := c.setPlacement(ctx, siteID, to); err != nil {
+		return err
+	}
+	if err := c.clusters[from].DeleteCaddyService(ctx, siteID); err != nil {
+		return fmt.Errorf("delete from cluster %s: %v", from, err)
+	}
+	c.logger.Log("info", "Rebalanced site", "site_id", siteID, "from", from, "to", to)
+	return nil
+}
+
+// place picks the cluster for a new site according to config.Placement. A site already placed by an earlier attempt
+// to create it stays where it is.
+func (c multiClusterClient) place(ctx context.Context, site Site) (string, error) {
+	registry, err := c.registry(ctx)
+	if err != nil {
+		return "", err
+	}
+	if cluster, ok := registry.Data[placementKey(site.SiteID)]; ok {
+		if _, ok := c.clusters[cluster]; ok {
+			return cluster, nil
+		}
+	}
+	switch config.Placement {
+	case PlacementPinned:
+		if cluster, ok := pinnedCluster(site.UserID); ok {
+			if _, ok := c.clusters[cluster]; !ok {
+				return "", fmt.Errorf("user %d is pinned to cluster %q: %v", site.UserID, cluster, ErrUnknownCluster)
+			}
+			return cluster, nil
+		}
+	case PlacementLeastLoaded:
+		best, bestCount := "", -1
+		for _, name := range c.names {
+			dps, err := c.clusters[name].managedSites(ctx, 0)
+			if err != nil {
+				return "", fmt.Errorf("cluster %s: %v", name, err)
+			}
+			if bestCount < 0 || len(dps) < bestCount {
+				best, bestCount = name, len(dps)
+			}
+		}
+		return best, nil
+	}
+	h := fnv.New32a()
+	h.Write([]byte(strconv.Itoa(int(site.SiteID))))
+	return c.names[h.Sum32()%uint32(len(c.names))], nil
+}
+
+// locate returns the cluster a site lives in, from the registry or, for sites it doesn't know, by asking every cluster.
+// It returns ErrSiteNotFound when no cluster has the site.
+func (c multiClusterClient) locate(ctx context.Context, siteID uint) (string, error) {
+	registry, err := c.registry(ctx)
+	if err != nil {
+		return "", err
+	}
+	if cluster, ok := registry.Data[placementKey(siteID)]; ok {
+		if _, ok := c.clusters[cluster]; ok {
+			return cluster, nil
+		}
+	}
+	for _, name := range c.names {
+		dps, err := c.clusters[name].managedSites(ctx, siteID)
+		if err != nil {
+			return "", fmt.Errorf("cluster %s: %v", name, err)
+		}
+		if len(dps) > 0 {
+			return name, nil
+		}
+	}
+	return "", ErrSiteNotFound
+}
+
+// setPlacement records the site's cluster in the registry, or forgets the site when cluster is empty.
+func (c multiClusterClient) setPlacement(ctx context.Context, siteID uint, cluster string) error {
+	home := c.clusters[c.names[0]]
+	// The registry is updated optimistically; retry when another writer got there first
+	for attempt := 0; ; attempt++ {
+		registry, err := c.registry(ctx)
+		if err != nil {
+			return err
+		}
+		if registry.Data == nil {
+			registry.Data = make(map[string]string)
+		}
+		if cluster == "" {
+			delete(registry.Data, placementKey(siteID))
+		} else {
+			registry.Data[placementKey(siteID)] = cluster
+		}
+		if registry.Metadata.GetResourceVersion() == "" {
+			err = home.create(ctx, registry)
+		} else {
+			err = home.update(ctx, registry)
+		}
+		if isConflict(err) && attempt < 5 {
+			continue
+		}
+		if err != nil {
+			c.logger.Log("error_desc", "failed to update placement registry", "error", err)
+		}
+		return err
+	}
+}
+
+// registry fetches the placement registry, returning an empty unsaved one if it doesn't exist yet.
+func (c multiClusterClient) registry(ctx context.Context) (*corev1.ConfigMap, error) {
+	var cm corev1.ConfigMap
+	err := c.clusters[c.names[0]].client.Get(ctx, "default", registryName, &cm)
+	if err == nil {
+		return &cm, nil
+	}
+	if !isNotFound(err) {
+		return nil, err
+	}
+	name, namespace := registryName, "default"
+	return &corev1.ConfigMap{
+		Metadata: &metav1.ObjectMeta{
+			Name:      &name,
+			Namespace: &namespace,
+			Labels:    map[string]string{labelManagedBy: managerName},
+		},
+	}, nil
+}
+
+func placementKey(siteID uint) string {
+	return "site-" + strconv.Itoa(int(siteID))
+}
+
+// pinnedCluster looks the user up in config.PinnedUsers, a comma separated list of user_id=cluster pairs.
+func pinnedCluster(userID uint) (string, bool) {
+	for _, pair := range strings.Split(config.PinnedUsers, ",") {
+		kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+		if len(kv) == 2 && kv[0] == strconv.Itoa(int(userID)) {
+			return kv[1], true
+		}
+	}
+	return "", false
+}
+
+// newMultiClusterClient connects to every cluster in config.Clusters, a comma separated list of name=context pairs
+// with unique names.
+func newMultiClusterClient(logger log.Logger) (Client, error) {
+	c := multiClusterClient{
+		clusters: make(map[string]k8sclient),
+		logger:   logger,
+	}
+	contexts, err := parseClusters(config.Clusters)
+	if err != nil {
+		return nil, err
+	}
+	for name, kubeContext := range contexts {
+		client, err := newK8sClient(config.Kubeconfig, kubeContext)
+		if err != nil {
+			return nil, fmt.Errorf("cluster %s: %v", name, err)
+		}
+		c.names = append(c.names, name)
+		c.clusters[name] = k8sclient{
+			client: api{client},
+			logger: log.With(logger, "cluster", name),
+		}
+	}
+	sort.Strings(c.names)
+	return c, nil
+}
+
+// parseClusters maps the cluster names of a comma separated list of name=context pairs to their contexts.
+// A name given twice is an error: the placement registry couldn't tell the clusters apart.
+func parseClusters(clusters string) (map[string]string, error) {
+	contexts := make(map[string]string)
+	for _, pair := range strings.Split(clusters, ",") {
+		kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("invalid cluster %q, want name=context", pair)
+		}
+		if _, ok := contexts[kv[0]]; ok {
+			return nil, fmt.Errorf("cluster %s is given twice", kv[0])
+		}
+		contexts[kv[0]] = kv[1]
+	}
+	return contexts, nil
+}
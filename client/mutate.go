@@ -0,0 +1,81 @@
+package client
+
+import (
+	"context"
+	"github.com/ericchiang/k8s"
+	extensionsv1beta1 "github.com/ericchiang/k8s/apis/extensions/v1beta1"
+	"github.com/seagullbird/headr-k8s-helper/config"
+	"github.com/seagullbird/headr-k8s-helper/metrics"
+	"github.com/seagullbird/headr-k8s-helper/tracing"
+	"strings"
+)
+
+// create, update and delete send a mutation to the API server, or only log it in dry-run mode.
+// Each is traced as a child span of the one in ctx.
+
+func (c k8sclient) create(ctx context.Context, r k8s.Resource) (err error) {
+	span, ctx := startSpan(ctx, "create", r)
+	defer func() { span.SetError(err); span.Finish() }()
+	if config.DryRun {
+		c.logDryRun("create", r)
+		return nil
+	}
+	return c.client.Create(ctx, r)
+}
+
+func (c k8sclient) update(ctx context.Context, r k8s.Resource) (err error) {
+	span, ctx := startSpan(ctx, "update", r)
+	defer func() { span.SetError(err); span.Finish() }()
+	if config.DryRun {
+		c.logDryRun("update", r)
+		return nil
+	}
+	return c.client.Update(ctx, r)
+}
+
+func (c k8sclient) delete(ctx context.Context, r k8s.Resource) (err error) {
+	span, ctx := startSpan(ctx, "delete", r)
+	defer func() { span.SetError(err); span.Finish() }()
+	if config.DryRun {
+		c.logger.Log("dry_run", "delete", "kind", kindOf(r), "namespace", r.GetMetadata().GetNamespace(), "name", r.GetMetadata().GetName())
+		return nil
+	}
+	return c.client.Delete(ctx, r)
+}
+
+// updateIngress writes the ingress; in dry-run mode only the diff, one +added or -removed path per entry, is logged.
+func (c k8sclient) updateIngress(ctx context.Context, ing *extensionsv1beta1.Ingress, diff []string) (err error) {
+	span, ctx := startSpan(ctx, "update", ing)
+	span.SetTag("ingress.diff", strings.Join(diff, ", "))
+	defer func() { span.SetError(err); span.Finish() }()
+	if config.DryRun {
+		c.logger.Log("dry_run", "update", "kind", kindOf(ing), "namespace", ing.Metadata.GetNamespace(), "name", ing.Metadata.GetName(), "ingress_diff", strings.Join(diff, ", "))
+		return nil
+	}
+	err = c.client.Update(ctx, ing)
+	if isConflict(err) {
+		metrics.IngressConflicts.Add(1)
+	}
+	return err
+}
+
+func (c k8sclient) logDryRun(verb string, r k8s.Resource) {
+	object, err := renderJSON(r, false)
+	if err != nil {
+		c.logger.Log("error_desc", "failed to render object", "error", err)
+	}
+	c.logger.Log("dry_run", verb, "kind", kindOf(r), "namespace", r.GetMetadata().GetNamespace(), "name", r.GetMetadata().GetName(), "object", string(object))
+}
+
+// startSpan starts the span of a Kubernetes call, named like "kubernetes create Deployment".
+func startSpan(ctx context.Context, verb string, r k8s.Resource) (*tracing.Span, context.Context) {
+	kind := kindOf(r)
+	kind = kind[strings.LastIndex(kind, "/")+1:]
+	span, ctx := tracing.StartSpan(ctx, "kubernetes "+verb+" "+kind, tracing.KindClient)
+	span.SetTag("k8s.namespace", r.GetMetadata().GetNamespace())
+	span.SetTag("k8s.name", r.GetMetadata().GetName())
+	if config.DryRun {
+		span.SetTag("dry_run", "true")
+	}
+	return span, ctx
+}
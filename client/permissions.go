@@ -0,0 +1,108 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	authorizationv1 "github.com/ericchiang/k8s/apis/authorization/v1"
+	metav1 "github.com/ericchiang/k8s/apis/meta/v1"
+	"github.com/seagullbird/headr-k8s-helper/config"
+	"strings"
+)
+
+// Permission is access the helper needs to a kind of resource.
+type Permission struct {
+	// Group is the API group; it is empty for the core group
+	Group    string
+	Resource string
+	Verbs    []string
+	// Namespace limits the permission to one namespace; it is empty for every namespace
+	Namespace string
+}
+
+// scope describes where a permission applies.
+func (p Permission) scope() string {
+	if p.Namespace == "" {
+		return "in every namespace"
+	}
+	return "in namespace " + p.Namespace
+}
+
+// Permissions returns the access the helper needs with the current config.
+// In shared tenancy mode everything lives in the default namespace; in namespace tenancy mode sites are created
+// in namespaces of their own and listed across them, so their permissions are cluster wide.
+// Operator mode adds the HeadrSites and updating sites in place.
+func Permissions() []Permission {
+	sites := "default"
+	if config.Tenancy == config.TenancyNamespace {
+		sites = ""
+	}
+	perms := []Permission{
+		{Group: "apps", Resource: "deployments", Verbs: []string{"get", "list", "create", "delete"}, Namespace: sites},
+		{Group: "", Resource: "services", Verbs: []string{"get", "list", "create", "delete"}, Namespace: sites},
+		// the event ledger, the site states, and the placement registry with several clusters
+		{Group: "", Resource: "configmaps", Verbs: []string{"get", "create", "update"}, Namespace: "default"},
+		// the ingresses of sites' domains
+		{Group: "extensions", Resource: "ingresses", Verbs: []string{"get", "create", "update", "delete"}, Namespace: sites},
+	}
+	if config.Dev != "true" {
+		perms = append(perms, Permission{Group: "extensions", Resource: "ingresses", Verbs: []string{"get", "update"}, Namespace: "default"})
+		// the nfs claim, checked by preflight
+		if config.Tenancy == config.TenancyShared {
+			perms = append(perms, Permission{Group: "", Resource: "persistentvolumeclaims", Verbs: []string{"get"}, Namespace: "default"})
+		}
+	}
+	if config.Operator {
+		perms = append(perms,
+			Permission{Group: HeadrSiteGroup, Resource: headrSitePlural, Verbs: []string{"get", "list", "watch", "create", "update", "delete"}, Namespace: "default"},
+			Permission{Group: "apps", Resource: "deployments", Verbs: []string{"update"}, Namespace: sites},
+		)
+	}
+	if config.Tenancy == config.TenancyNamespace {
+		perms = append(perms,
+			Permission{Group: "", Resource: "namespaces", Verbs: []string{"get", "create", "delete"}},
+			Permission{Group: "", Resource: "resourcequotas", Verbs: []string{"create"}},
+			Permission{Group: "", Resource: "limitranges", Verbs: []string{"create"}},
+		)
+	}
+	return perms
+}
+
+// Check asks the API server, with self subject access reviews, whether the helper has every permission it needs.
+// It fails as well when the API server can't be reached.
+func (c k8sclient) Check(ctx context.Context) error {
+	var missing []string
+	for _, p := range Permissions() {
+		for _, verb := range p.Verbs {
+			allowed, err := c.allowed(ctx, p, verb)
+			if err != nil {
+				return err
+			}
+			if !allowed {
+				missing = append(missing, verb+" "+strings.TrimPrefix(p.Group+"/"+p.Resource, "/"))
+			}
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("missing permissions: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+func (c k8sclient) allowed(ctx context.Context, p Permission, verb string) (bool, error) {
+	review := &authorizationv1.SelfSubjectAccessReview{
+		Metadata: &metav1.ObjectMeta{},
+		Spec: &authorizationv1.SelfSubjectAccessReviewSpec{
+			ResourceAttributes: &authorizationv1.ResourceAttributes{
+				Namespace: &p.Namespace,
+				Group:     &p.Group,
+				Resource:  &p.Resource,
+				Verb:      &verb,
+			},
+		},
+	}
+	// reviews only ask, so they are sent in dry-run mode too
+	if err := c.client.Create(ctx, review); err != nil {
+		return false, err
+	}
+	return review.Status.GetAllowed(), nil
+}
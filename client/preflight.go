@@ -0,0 +1,105 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	corev1 "github.com/ericchiang/k8s/apis/core/v1"
+	extensionsv1beta1 "github.com/ericchiang/k8s/apis/extensions/v1beta1"
+	"github.com/seagullbird/headr-k8s-helper/config"
+	"strings"
+)
+
+// A Finding is the outcome of one preflight check.
+type Finding struct {
+	// Check names what was checked, such as "permission to create apps/deployments in namespace default"
+	Check string
+	// Err is why the check failed; it's nil when the check passed
+	Err error
+	// Fix tells how to fix a failed check
+	Fix string
+	// Fatal failures keep serve from starting; the others only warn
+	Fatal bool
+}
+
+// Fatal reports whether one of the findings is a fatal failure.
+func Fatal(findings []Finding) bool {
+	for _, f := range findings {
+		if f.Err != nil && f.Fatal {
+			return true
+		}
+	}
+	return false
+}
+
+// Preflight checks that the API server is reachable, that the helper has every permission it needs, checked with
+// self subject access reviews, and that the objects sites rely on exist: usersites-ingress, and the nfs claim in
+// shared tenancy mode, and the HeadrSite resource in operator mode.
+func (c k8sclient) Preflight(ctx context.Context) []Finding {
+	findings := []Finding{{Check: "Kubernetes API"}}
+	for _, p := range Permissions() {
+		for _, verb := range p.Verbs {
+			resource := strings.TrimPrefix(p.Group+"/"+p.Resource, "/")
+			allowed, err := c.allowed(ctx, p, verb)
+			if err != nil {
+				// nothing else can be checked without the API server
+				return []Finding{{
+					Check: "Kubernetes API",
+					Err:   err,
+					Fix:   "check the kubeconfig or the pod's service account, and that the API server is reachable",
+					Fatal: true,
+				}}
+			}
+			f := Finding{Check: "permission to " + verb + " " + resource + " " + p.scope()}
+			if !allowed {
+				f.Err = errors.New("denied")
+				f.Fix = fmt.Sprintf("grant %s on %s %s to the helper's service account, see `k8s-helper rbac`", verb, resource, p.scope())
+				f.Fatal = true
+			}
+			findings = append(findings, f)
+		}
+	}
+	if config.Operator {
+		crd := Finding{Check: "resource " + headrSitePlural + "." + HeadrSiteGroup}
+		if err := c.client.List(ctx, "default", new(HeadrSiteList)); err != nil {
+			crd.Err, crd.Fatal = err, true
+			if isNotFound(err) {
+				crd.Err = errors.New("not found")
+				crd.Fix = "create the HeadrSite CustomResourceDefinition with `k8s-helper crd | kubectl apply -f -`"
+			}
+		}
+		findings = append(findings, crd)
+	}
+	if config.Dev == "true" {
+		return findings
+	}
+
+	ingress := Finding{Check: "ingress default/usersites-ingress"}
+	if err := c.client.Get(ctx, "default", "usersites-ingress", new(extensionsv1beta1.Ingress)); err != nil {
+		ingress.Err, ingress.Fatal = err, true
+		if isNotFound(err) {
+			ingress.Err = errors.New("not found")
+			ingress.Fix = "create the usersites-ingress Ingress in the default namespace; site paths are added to its first rule"
+		}
+	}
+	findings = append(findings, ingress)
+
+	// The nfs claim is only mounted by sites in the default namespace
+	if config.Tenancy == config.TenancyShared {
+		claim := Finding{Check: "persistent volume claim default/nfs"}
+		var pvc corev1.PersistentVolumeClaim
+		err := c.client.Get(ctx, "default", "nfs", &pvc)
+		switch {
+		case isNotFound(err):
+			claim.Err, claim.Fatal = errors.New("not found"), true
+			claim.Fix = "create the nfs PersistentVolumeClaim in the default namespace, holding the sites' content"
+		case err != nil:
+			claim.Err, claim.Fatal = err, true
+		case pvc.Status.GetPhase() != "Bound":
+			claim.Err = fmt.Errorf("phase is %q, not Bound", pvc.Status.GetPhase())
+			claim.Fix = "site pods stay pending until the claim is bound to a volume"
+		}
+		findings = append(findings, claim)
+	}
+	return findings
+}
@@ -0,0 +1,69 @@
+package client
+
+import (
+	"github.com/ericchiang/k8s"
+	corev1 "github.com/ericchiang/k8s/apis/core/v1"
+	metav1 "github.com/ericchiang/k8s/apis/meta/v1"
+	rbacv1 "github.com/ericchiang/k8s/apis/rbac/v1"
+	"sort"
+)
+
+// RBAC returns the ServiceAccount named name in namespace, and the roles and bindings granting it exactly
+// Permissions(): a ClusterRole with the permissions in every namespace, and a Role in each namespace
+// the others are limited to.
+func RBAC(name, namespace string) []k8s.Resource {
+	rules := map[string][]*rbacv1.PolicyRule{
+		// self subject access reviews back the readiness and preflight checks; most clusters let every user create them
+		"": {{ApiGroups: []string{"authorization.k8s.io"}, Resources: []string{"selfsubjectaccessreviews"}, Verbs: []string{"create"}}},
+	}
+	for _, p := range Permissions() {
+		rules[p.Namespace] = append(rules[p.Namespace], &rbacv1.PolicyRule{
+			ApiGroups: []string{p.Group},
+			Resources: []string{p.Resource},
+			Verbs:     p.Verbs,
+		})
+	}
+
+	var (
+		labels            = map[string]string{labelManagedBy: managerName}
+		group             = "rbac.authorization.k8s.io"
+		serviceAccount    = "ServiceAccount"
+		clusterRole, role = "ClusterRole", "Role"
+		subjects          = []*rbacv1.Subject{{Kind: &serviceAccount, Name: &name, Namespace: &namespace}}
+	)
+	objects := []k8s.Resource{
+		&corev1.ServiceAccount{Metadata: &metav1.ObjectMeta{Name: &name, Namespace: &namespace, Labels: labels}},
+		&rbacv1.ClusterRole{
+			Metadata: &metav1.ObjectMeta{Name: &name, Labels: labels},
+			Rules:    rules[""],
+		},
+		&rbacv1.ClusterRoleBinding{
+			Metadata: &metav1.ObjectMeta{Name: &name, Labels: labels},
+			Subjects: subjects,
+			RoleRef:  &rbacv1.RoleRef{ApiGroup: &group, Kind: &clusterRole, Name: &name},
+		},
+	}
+
+	var namespaces []string
+	for ns := range rules {
+		if ns != "" {
+			namespaces = append(namespaces, ns)
+		}
+	}
+	sort.Strings(namespaces)
+	for _, ns := range namespaces {
+		ns := ns
+		objects = append(objects,
+			&rbacv1.Role{
+				Metadata: &metav1.ObjectMeta{Name: &name, Namespace: &ns, Labels: labels},
+				Rules:    rules[ns],
+			},
+			&rbacv1.RoleBinding{
+				Metadata: &metav1.ObjectMeta{Name: &name, Namespace: &ns, Labels: labels},
+				Subjects: subjects,
+				RoleRef:  &rbacv1.RoleRef{ApiGroup: &group, Kind: &role, Name: &name},
+			},
+		)
+	}
+	return objects
+}
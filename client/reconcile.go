@@ -0,0 +1,161 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/ericchiang/k8s"
+	corev1 "github.com/ericchiang/k8s/apis/core/v1"
+	extensionsv1beta1 "github.com/ericchiang/k8s/apis/extensions/v1beta1"
+	"github.com/seagullbird/headr-k8s-helper/config"
+	"regexp"
+	"strconv"
+)
+
+// Fix describes one repair made, or only logged in dry-run mode, by Reconcile.
+type Fix struct {
+	SiteID uint
+	Action string
+	Err    error
+}
+
+// MarshalJSON encodes the fix with its error as a string.
+func (f Fix) MarshalJSON() ([]byte, error) {
+	v := struct {
+		SiteID uint   `json:"site_id"`
+		Action string `json:"action"`
+		Error  string `json:"error,omitempty"`
+	}{SiteID: f.SiteID, Action: f.Action}
+	if f.Err != nil {
+		v.Error = f.Err.Error()
+	}
+	return json.Marshal(v)
+}
+
+// siteServiceName matches the service names made by serviceName.
+var siteServiceName = regexp.MustCompile(`^siteid-(\d+)-service$`)
+
+// Reconcile brings the services and ingress paths in line with the site deployments:
+// missing services and ingress paths of existing sites are created, and those left behind by deleted sites are removed.
+func (c k8sclient) Reconcile(ctx context.Context) ([]Fix, error) {
+	dps, err := c.managedSites(ctx, 0)
+	if err != nil {
+		c.logger.Log("error_desc", "failed to list deployment resources", "error", err)
+		return nil, err
+	}
+	sites := make(map[uint]Site, len(dps))
+	var manifests []Manifest
+	for _, dp := range dps {
+		site, err := siteSpec(dp)
+		if err != nil {
+			c.logger.Log("error_desc", "skipping unlabeled deployment", "name", dp.Metadata.GetName(), "error", err)
+			continue
+		}
+		sites[site.SiteID] = site
+		m := BuildManifest(site)
+		if m.Deployment.Metadata.GetNamespace() != dp.Metadata.GetNamespace() {
+			c.logger.Log("error_desc", "skipping site outside its tenancy namespace", "site_id", site.SiteID, "namespace", dp.Metadata.GetNamespace())
+			continue
+		}
+		manifests = append(manifests, m)
+	}
+
+	selector := new(k8s.LabelSelector)
+	selector.Eq(labelManagedBy, managerName)
+	var svcs corev1.ServiceList
+	if err := c.client.List(ctx, sitesNamespace(), &svcs, selector.Selector()); err != nil {
+		c.logger.Log("error_desc", "failed to list service resources", "error", err)
+		return nil, err
+	}
+	services := make(map[string]bool, len(svcs.Items))
+	for _, svc := range svcs.Items {
+		services[svc.Metadata.GetNamespace()+"/"+svc.Metadata.GetName()] = true
+	}
+
+	var fixes []Fix
+	ensure := func(siteID uint, svc *corev1.Service, action string) {
+		if svc == nil || services[svc.Metadata.GetNamespace()+"/"+svc.Metadata.GetName()] {
+			return
+		}
+		fixes = append(fixes, Fix{SiteID: siteID, Action: action, Err: c.create(ctx, svc)})
+	}
+	for _, m := range manifests {
+		siteID, _ := siteIDOf(m.Deployment.Metadata)
+		ensure(siteID, m.Service, "create service")
+		ensure(siteID, m.ExternalName, "create externalname service")
+	}
+	for _, svc := range svcs.Items {
+		siteID, ok := siteIDOf(svc.Metadata)
+		if !ok {
+			continue
+		}
+		if _, exists := sites[siteID]; !exists {
+			fixes = append(fixes, Fix{SiteID: siteID, Action: "delete orphaned service " + svc.Metadata.GetNamespace() + "/" + svc.Metadata.GetName(), Err: c.delete(ctx, svc)})
+		}
+	}
+
+	if config.Dev == "true" {
+		return fixes, nil
+	}
+	ingressFixes, err := c.reconcileIngress(ctx, sites, manifests)
+	if err != nil {
+		return fixes, err
+	}
+	return append(fixes, ingressFixes...), nil
+}
+
+// reconcileIngress adds the missing usersites-ingress paths of the manifests and removes those of sites that no longer exist.
+func (c k8sclient) reconcileIngress(ctx context.Context, sites map[uint]Site, manifests []Manifest) ([]Fix, error) {
+	ingressMtx.Lock()
+	defer ingressMtx.Unlock()
+	var ing extensionsv1beta1.Ingress
+	if err := c.client.Get(ctx, "default", "usersites-ingress", &ing); err != nil {
+		c.logger.Log("error_desc", "failed to get usersites-ingress resource", "error", err)
+		return nil, err
+	}
+	if ing.Spec.Rules[0].IngressRuleValue.Http == nil {
+		ing.Spec.Rules[0].IngressRuleValue.Http = &extensionsv1beta1.HTTPIngressRuleValue{}
+	}
+
+	var (
+		fixes  []Fix
+		diff   []string
+		kept   []*extensionsv1beta1.HTTPIngressPath
+		routed = make(map[string]bool)
+	)
+	for _, p := range ing.Spec.Rules[0].IngressRuleValue.Http.Paths {
+		if match := siteServiceName.FindStringSubmatch(p.Backend.GetServiceName()); match != nil {
+			id, _ := strconv.ParseUint(match[1], 10, 0)
+			if _, exists := sites[uint(id)]; !exists {
+				fixes = append(fixes, Fix{SiteID: uint(id), Action: "remove ingress path " + p.GetPath()})
+				diff = append(diff, "-"+ingressPathString(p))
+				continue
+			}
+		}
+		routed[p.Backend.GetServiceName()] = true
+		kept = append(kept, p)
+	}
+	for _, m := range manifests {
+		if m.IngressPath == nil || routed[m.IngressPath.Backend.GetServiceName()] {
+			continue
+		}
+		siteID, _ := siteIDOf(m.Deployment.Metadata)
+		fixes = append(fixes, Fix{SiteID: siteID, Action: "add ingress path " + m.IngressPath.GetPath()})
+		diff = append(diff, "+"+ingressPathString(m.IngressPath))
+		kept = append(kept, m.IngressPath)
+	}
+	if len(diff) == 0 {
+		return nil, nil
+	}
+
+	if len(kept) == 0 {
+		ing.Spec.Rules[0].IngressRuleValue.Http = nil
+	} else {
+		ing.Spec.Rules[0].IngressRuleValue.Http.Paths = kept
+	}
+	if err := c.updateIngress(ctx, &ing, diff); err != nil {
+		for i := range fixes {
+			fixes[i].Err = err
+		}
+	}
+	return fixes, nil
+}
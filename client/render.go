@@ -0,0 +1,380 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/ericchiang/k8s"
+	apiextensionsv1beta1 "github.com/ericchiang/k8s/apis/apiextensions/v1beta1"
+	appsv1 "github.com/ericchiang/k8s/apis/apps/v1"
+	corev1 "github.com/ericchiang/k8s/apis/core/v1"
+	extensionsv1beta1 "github.com/ericchiang/k8s/apis/extensions/v1beta1"
+	rbacv1 "github.com/ericchiang/k8s/apis/rbac/v1"
+	"regexp"
+	"strings"
+)
+
+// Render encodes a manifest as the YAML documents kubectl would accept, or as a JSON object when format is "json".
+// The usersites-ingress change is rendered as a JSON patch, as for `kubectl patch --type json`.
+func Render(m Manifest, format string) ([]byte, error) {
+	var objects []k8s.Resource
+	for _, r := range []k8s.Resource{m.Namespace, m.ResourceQuota, m.LimitRange, m.Deployment, m.Service, m.ExternalName, m.Ingress} {
+		// skip typed nil pointers of the objects the config leaves out
+		if r.GetMetadata() != nil {
+			objects = append(objects, r)
+		}
+	}
+
+	var items []interface{}
+	for _, r := range objects {
+		v, err := toTree(r)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, v)
+	}
+	var patch interface{}
+	if m.IngressPath != nil {
+		path, err := toTree(m.IngressPath)
+		if err != nil {
+			return nil, err
+		}
+		patch = []interface{}{
+			object{
+				{"op", "add"},
+				{"path", "/spec/rules/0/http/paths/-"},
+				{"value", path},
+			},
+		}
+	}
+
+	switch format {
+	case "json":
+		out := object{{"objects", items}}
+		if patch != nil {
+			out = append(out, field{"ingressPatch", object{
+				{"namespace", "default"},
+				{"name", "usersites-ingress"},
+				{"patch", patch},
+			}})
+		}
+		var b bytes.Buffer
+		writeJSON(&b, out, "")
+		b.WriteByte('\n')
+		return b.Bytes(), nil
+	case "yaml", "":
+		var b bytes.Buffer
+		for i, v := range items {
+			if i > 0 {
+				b.WriteString("---\n")
+			}
+			writeYAML(&b, v, 0)
+		}
+		if patch != nil {
+			b.WriteString("---\n# JSON patch for ingress default/usersites-ingress\n")
+			writeYAML(&b, patch, 0)
+		}
+		return b.Bytes(), nil
+	}
+	return nil, fmt.Errorf("unknown format %q, want yaml or json", format)
+}
+
+// RenderObjects encodes objects as YAML documents, or as a JSON v1 List when format is "json".
+func RenderObjects(objects []k8s.Resource, format string) ([]byte, error) {
+	items := []interface{}{}
+	for _, r := range objects {
+		v, err := toTree(r)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, v)
+	}
+	var b bytes.Buffer
+	switch format {
+	case "json":
+		writeJSON(&b, object{{"apiVersion", "v1"}, {"kind", "List"}, {"items", items}}, "")
+		b.WriteByte('\n')
+	case "yaml", "":
+		for i, v := range items {
+			if i > 0 {
+				b.WriteString("---\n")
+			}
+			writeYAML(&b, v, 0)
+		}
+	default:
+		return nil, fmt.Errorf("unknown format %q, want yaml or json", format)
+	}
+	return b.Bytes(), nil
+}
+
+// renderJSON encodes a single object as JSON, with its apiVersion and kind.
+func renderJSON(r k8s.Resource, indent bool) ([]byte, error) {
+	v, err := toTree(r)
+	if err != nil {
+		return nil, err
+	}
+	var b bytes.Buffer
+	if indent {
+		writeJSON(&b, v, "")
+	} else {
+		writeJSON(&b, v, "-")
+	}
+	return b.Bytes(), nil
+}
+
+// kindOf returns the apiVersion and kind of the objects the helper manages.
+func kindOf(r interface{}) string {
+	switch r.(type) {
+	case *appsv1.Deployment:
+		return "apps/v1/Deployment"
+	case *corev1.Service:
+		return "v1/Service"
+	case *corev1.Namespace:
+		return "v1/Namespace"
+	case *corev1.ResourceQuota:
+		return "v1/ResourceQuota"
+	case *corev1.LimitRange:
+		return "v1/LimitRange"
+	case *corev1.ConfigMap:
+		return "v1/ConfigMap"
+	case *extensionsv1beta1.Ingress:
+		return "extensions/v1beta1/Ingress"
+	case *corev1.ServiceAccount:
+		return "v1/ServiceAccount"
+	case *rbacv1.ClusterRole:
+		return "rbac.authorization.k8s.io/v1/ClusterRole"
+	case *rbacv1.ClusterRoleBinding:
+		return "rbac.authorization.k8s.io/v1/ClusterRoleBinding"
+	case *rbacv1.Role:
+		return "rbac.authorization.k8s.io/v1/Role"
+	case *rbacv1.RoleBinding:
+		return "rbac.authorization.k8s.io/v1/RoleBinding"
+	case *apiextensionsv1beta1.CustomResourceDefinition:
+		return "apiextensions.k8s.io/v1beta1/CustomResourceDefinition"
+	case *HeadrSite:
+		return HeadrSiteGroup + "/" + HeadrSiteVersion + "/HeadrSite"
+	}
+	return fmt.Sprintf("%T", r)
+}
+
+// object is a JSON object that keeps its keys in order, so rendered manifests read like hand written ones.
+type object []field
+
+type field struct {
+	key   string
+	value interface{}
+}
+
+// toTree converts a generated API type to an ordered JSON tree, undoing the protobuf shapes of
+// resource.Quantity and intstr.IntOrString that encoding/json produces.
+func toTree(v interface{}) (interface{}, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	tree, err := decodeTree(dec)
+	if err != nil {
+		return nil, err
+	}
+	// custom resources carry their own apiVersion and kind
+	if o, ok := tree.(object); ok && (len(o) == 0 || o[0].key != "kind") {
+		if kind := kindOf(v); strings.Count(kind, "/") > 0 {
+			i := strings.LastIndex(kind, "/")
+			tree = append(object{{"apiVersion", kind[:i]}, {"kind", kind[i+1:]}}, o...)
+		}
+	}
+	return tree, nil
+}
+
+func decodeTree(dec *json.Decoder) (interface{}, error) {
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	switch tok {
+	case json.Delim('{'):
+		var o object
+		for dec.More() {
+			key, err := dec.Token()
+			if err != nil {
+				return nil, err
+			}
+			v, err := decodeTree(dec)
+			if err != nil {
+				return nil, err
+			}
+			// embedded structs that the API inlines are named fields in the generated types
+			if inner, ok := v.(object); ok && inlined[key.(string)] {
+				o = append(o, inner...)
+				continue
+			}
+			o = append(o, field{key.(string), v})
+		}
+		if _, err := dec.Token(); err != nil {
+			return nil, err
+		}
+		return simplify(o), nil
+	case json.Delim('['):
+		a := []interface{}{}
+		for dec.More() {
+			v, err := decodeTree(dec)
+			if err != nil {
+				return nil, err
+			}
+			a = append(a, v)
+		}
+		if _, err := dec.Token(); err != nil {
+			return nil, err
+		}
+		return a, nil
+	}
+	return tok, nil
+}
+
+var inlined = map[string]bool{
+	"volumeSource":           true,
+	"persistentVolumeSource": true,
+	"ingressRuleValue":       true,
+	"handler":                true,
+}
+
+// simplify turns {"string": "1Gi"} quantities and {"intVal": 80} or {"type": 1, "strVal": "http"} int-or-strings into plain values.
+func simplify(o object) interface{} {
+	if len(o) == 1 && o[0].key == "string" {
+		return o[0].value
+	}
+	var intVal, strVal interface{}
+	for _, f := range o {
+		switch f.key {
+		case "intVal":
+			intVal = f.value
+		case "strVal":
+			strVal = f.value
+		case "type":
+		default:
+			return o
+		}
+	}
+	if strVal != nil {
+		return strVal
+	}
+	if intVal != nil {
+		return intVal
+	}
+	return o
+}
+
+// writeJSON writes the tree indented by two spaces per level, or compactly when indent is "-".
+func writeJSON(b *bytes.Buffer, v interface{}, indent string) {
+	compact := indent == "-"
+	newline := func(in string) {
+		if !compact {
+			b.WriteString("\n" + in)
+		}
+	}
+	switch v := v.(type) {
+	case object:
+		if len(v) == 0 {
+			b.WriteString("{}")
+			return
+		}
+		b.WriteByte('{')
+		for i, f := range v {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			newline(indent + "  ")
+			key, _ := json.Marshal(f.key)
+			b.Write(key)
+			b.WriteByte(':')
+			if !compact {
+				b.WriteByte(' ')
+			}
+			writeJSON(b, f.value, nextIndent(indent))
+		}
+		newline(indent)
+		b.WriteByte('}')
+	case []interface{}:
+		if len(v) == 0 {
+			b.WriteString("[]")
+			return
+		}
+		b.WriteByte('[')
+		for i, item := range v {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			newline(indent + "  ")
+			writeJSON(b, item, nextIndent(indent))
+		}
+		newline(indent)
+		b.WriteByte(']')
+	default:
+		data, _ := json.Marshal(v)
+		b.Write(data)
+	}
+}
+
+func nextIndent(indent string) string {
+	if indent == "-" {
+		return indent
+	}
+	return indent + "  "
+}
+
+var plainYAMLKey = regexp.MustCompile(`^[A-Za-z0-9_./-]+$`)
+
+// writeYAML writes the tree as block style YAML; strings are always double quoted, which YAML reads as JSON strings.
+func writeYAML(b *bytes.Buffer, v interface{}, indent int) {
+	pad := strings.Repeat(" ", indent)
+	switch v := v.(type) {
+	case object:
+		for _, f := range v {
+			key := f.key
+			if !plainYAMLKey.MatchString(key) {
+				quoted, _ := json.Marshal(key)
+				key = string(quoted)
+			}
+			b.WriteString(pad + key + ":")
+			switch value := f.value.(type) {
+			case object:
+				if len(value) == 0 {
+					b.WriteString(" {}\n")
+					continue
+				}
+				b.WriteByte('\n')
+				writeYAML(b, value, indent+2)
+			case []interface{}:
+				if len(value) == 0 {
+					b.WriteString(" []\n")
+					continue
+				}
+				b.WriteByte('\n')
+				writeYAML(b, value, indent)
+			default:
+				b.WriteByte(' ')
+				writeYAML(b, value, 0)
+			}
+		}
+	case []interface{}:
+		for _, item := range v {
+			switch item.(type) {
+			case object, []interface{}:
+				// render the item two deeper, then hang its first line off the dash
+				var nested bytes.Buffer
+				writeYAML(&nested, item, indent+2)
+				b.WriteString(pad + "- ")
+				b.Write(nested.Bytes()[indent+2:])
+			default:
+				b.WriteString(pad + "- ")
+				writeYAML(b, item, 0)
+			}
+		}
+	default:
+		data, _ := json.Marshal(v)
+		b.Write(data)
+		b.WriteByte('\n')
+	}
+}
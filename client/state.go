@@ -0,0 +1,80 @@
+package client
+
+import (
+	"context"
+	"fmt"
+)
+
+// SiteState is a stage of a site's lifecycle, recorded in the site state store.
+type SiteState string
+
+// The lifecycle of a site. A site without a recorded state is in StateNone.
+const (
+	StateNone SiteState = ""
+	// StatePending sites were accepted and are about to be provisioned
+	StatePending SiteState = "Pending"
+	// StateProvisioning sites have their objects created and wait for their deployment to become ready
+	StateProvisioning SiteState = "Provisioning"
+	StateReady        SiteState = "Ready"
+	// StateUpdating sites are being changed, such as moved to another cluster
+	StateUpdating SiteState = "Updating"
+	StateDeleting SiteState = "Deleting"
+	StateDeleted  SiteState = "Deleted"
+	// StateFailed sites failed to be provisioned, updated or deleted; the failed step may be retried
+	StateFailed SiteState = "Failed"
+)
+
+// transitions lists the states each state can move to. Moving to the same state is allowed too,
+// so a step interrupted by a restart can be repeated.
+var transitions = map[SiteState][]SiteState{
+	// sites created before states were recorded have none
+	StateNone:         {StatePending, StateUpdating, StateDeleting},
+	StatePending:      {StateProvisioning, StateFailed, StateDeleting},
+	StateProvisioning: {StatePending, StateReady, StateFailed, StateDeleting},
+	StateReady:        {StateUpdating, StateDeleting},
+	StateUpdating:     {StateReady, StateFailed},
+	StateDeleting:     {StateDeleted, StateFailed},
+	StateDeleted:      {StatePending},
+	StateFailed:       {StatePending, StateUpdating, StateDeleting},
+}
+
+// IllegalTransitionError is returned for a move the lifecycle doesn't allow, such as updating a site being deleted.
+type IllegalTransitionError struct {
+	SiteID   uint
+	From, To SiteState
+}
+
+func (e IllegalTransitionError) Error() string {
+	from := e.From
+	if from == StateNone {
+		from = "no state"
+	}
+	return fmt.Sprintf("site %d can't move from %s to %s", e.SiteID, from, e.To)
+}
+
+// CheckTransition returns an IllegalTransitionError unless a site in state from can move to state to.
+func CheckTransition(siteID uint, from, to SiteState) error {
+	if from == to {
+		return nil
+	}
+	for _, next := range transitions[from] {
+		if next == to {
+			return nil
+		}
+	}
+	return IllegalTransitionError{SiteID: siteID, From: from, To: to}
+}
+
+func (c k8sclient) SiteState(ctx context.Context, siteID uint) (SiteState, error) {
+	value, _, err := c.storeGet(ctx, statesName, SiteKey(siteID))
+	return SiteState(value), err
+}
+
+func (c k8sclient) SetSiteState(ctx context.Context, siteID uint, to SiteState) error {
+	return c.storeUpdate(ctx, statesName, SiteKey(siteID), func(value string, ok bool) (string, error) {
+		if err := CheckTransition(siteID, SiteState(value), to); err != nil {
+			return "", err
+		}
+		return string(to), nil
+	})
+}
@@ -0,0 +1,137 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"github.com/ericchiang/k8s"
+	corev1 "github.com/ericchiang/k8s/apis/core/v1"
+	extensionsv1beta1 "github.com/ericchiang/k8s/apis/extensions/v1beta1"
+	"github.com/seagullbird/headr-k8s-helper/config"
+	"sort"
+	"strconv"
+)
+
+// ErrSiteNotFound is returned when no deployment exists for a site.
+var ErrSiteNotFound = errors.New("site not found")
+
+// SiteStatus describes a site as it currently is in the cluster.
+type SiteStatus struct {
+	Site
+	// Cluster is the cluster the site lives in; it is empty with a single cluster
+	Cluster   string `json:"cluster,omitempty"`
+	Namespace string `json:"namespace"`
+
+	Replicas          int32 `json:"replicas"`
+	ReadyReplicas     int32 `json:"ready_replicas"`
+	AvailableReplicas int32 `json:"available_replicas"`
+
+	// ServicePort is the port the ingress reaches the site on, NodePort the node port of the service if it has one
+	ServicePort int32 `json:"service_port"`
+	NodePort    int32 `json:"node_port,omitempty"`
+	// IngressPaths are the usersites-ingress paths routed to the site
+	IngressPaths []string `json:"ingress_paths"`
+	// State is the lifecycle state of the site; only DescribeSite fills it in
+	State SiteState `json:"state,omitempty"`
+}
+
+func (c k8sclient) ListSites(ctx context.Context) ([]SiteStatus, error) {
+	return c.siteStatuses(ctx, 0)
+}
+
+func (c k8sclient) DescribeSite(ctx context.Context, siteID uint) (SiteStatus, error) {
+	status, err := c.describeSite(ctx, siteID)
+	if err != nil {
+		return SiteStatus{}, err
+	}
+	status.State, err = c.SiteState(ctx, siteID)
+	return status, err
+}
+
+// describeSite is DescribeSite without the site state, which is kept in the first of several clusters.
+func (c k8sclient) describeSite(ctx context.Context, siteID uint) (SiteStatus, error) {
+	statuses, err := c.siteStatuses(ctx, siteID)
+	if err != nil {
+		return SiteStatus{}, err
+	}
+	if len(statuses) == 0 {
+		return SiteStatus{}, ErrSiteNotFound
+	}
+	return statuses[0], nil
+}
+
+// siteStatuses gathers the status of one site, or of every site when siteID is 0.
+func (c k8sclient) siteStatuses(ctx context.Context, siteID uint) ([]SiteStatus, error) {
+	dps, err := c.managedSites(ctx, siteID)
+	if err != nil {
+		c.logger.Log("error_desc", "failed to list deployment resources", "error", err)
+		return nil, err
+	}
+	if len(dps) == 0 {
+		return nil, nil
+	}
+
+	selector := new(k8s.LabelSelector)
+	selector.Eq(labelManagedBy, managerName)
+	if siteID != 0 {
+		selector.Eq(labelSiteID, strconv.Itoa(int(siteID)))
+	}
+	var svcs corev1.ServiceList
+	if err := c.client.List(ctx, sitesNamespace(), &svcs, selector.Selector()); err != nil {
+		c.logger.Log("error_desc", "failed to list service resources", "error", err)
+		return nil, err
+	}
+	// namespace/name -> service
+	services := make(map[string]*corev1.Service, len(svcs.Items))
+	for _, svc := range svcs.Items {
+		services[svc.Metadata.GetNamespace()+"/"+svc.Metadata.GetName()] = svc
+	}
+
+	paths, err := c.ingressPaths(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := make([]SiteStatus, 0, len(dps))
+	for _, dp := range dps {
+		site, err := siteSpec(dp)
+		if err != nil {
+			c.logger.Log("error_desc", "skipping unlabeled deployment", "name", dp.Metadata.GetName(), "error", err)
+			continue
+		}
+		status := SiteStatus{
+			Site:              site,
+			Namespace:         dp.Metadata.GetNamespace(),
+			Replicas:          dp.Spec.GetReplicas(),
+			ReadyReplicas:     dp.Status.GetReadyReplicas(),
+			AvailableReplicas: dp.Status.GetAvailableReplicas(),
+		}
+		if svc, ok := services[status.Namespace+"/"+dp.Metadata.GetName()]; ok && len(svc.Spec.Ports) > 0 {
+			status.ServicePort = svc.Spec.Ports[0].GetPort()
+			status.NodePort = svc.Spec.Ports[0].GetNodePort()
+		}
+		for _, p := range paths {
+			if p.Backend.GetServiceName() == dp.Metadata.GetName() {
+				status.IngressPaths = append(status.IngressPaths, p.GetPath())
+			}
+		}
+		statuses = append(statuses, status)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].SiteID < statuses[j].SiteID })
+	return statuses, nil
+}
+
+// ingressPaths returns the paths of usersites-ingress, or none in dev mode where there is no ingress.
+func (c k8sclient) ingressPaths(ctx context.Context) ([]*extensionsv1beta1.HTTPIngressPath, error) {
+	if config.Dev == "true" {
+		return nil, nil
+	}
+	var ing extensionsv1beta1.Ingress
+	if err := c.client.Get(ctx, "default", "usersites-ingress", &ing); err != nil {
+		c.logger.Log("error_desc", "failed to get usersites-ingress resource", "error", err)
+		return nil, err
+	}
+	if len(ing.Spec.Rules) == 0 || ing.Spec.Rules[0].IngressRuleValue.Http == nil {
+		return nil, nil
+	}
+	return ing.Spec.Rules[0].IngressRuleValue.Http.Paths, nil
+}
@@ -0,0 +1,89 @@
+package client
+
+import (
+	"context"
+	corev1 "github.com/ericchiang/k8s/apis/core/v1"
+	metav1 "github.com/ericchiang/k8s/apis/meta/v1"
+	"hash/fnv"
+	"strconv"
+	"sync"
+)
+
+// The event ledger and the site states are kept as entries of ConfigMaps in the default namespace, each spread over
+// storeShards ConfigMaps named <prefix>-<n> to stay well below the size limit of one.
+const (
+	storeShards = 16
+	ledgerName  = "headr-event-ledger"
+	statesName  = "headr-site-state"
+)
+
+// storeMtx serializes the store updates of concurrent events, which would otherwise conflict.
+var storeMtx sync.Mutex
+
+// storeGet returns the entry of key in the store named prefix.
+func (c k8sclient) storeGet(ctx context.Context, prefix, key string) (string, bool, error) {
+	shard, err := c.storeShard(ctx, prefix, key)
+	if err != nil {
+		return "", false, err
+	}
+	value, ok := shard.Data[key]
+	return value, ok, nil
+}
+
+// storeUpdate sets the entry of key in the store named prefix to what update returns for its current value,
+// or leaves it when update fails.
+func (c k8sclient) storeUpdate(ctx context.Context, prefix, key string, update func(value string, ok bool) (string, error)) error {
+	storeMtx.Lock()
+	defer storeMtx.Unlock()
+	// The store is updated optimistically; retry when another writer got there first
+	for attempt := 0; ; attempt++ {
+		shard, err := c.storeShard(ctx, prefix, key)
+		if err != nil {
+			return err
+		}
+		value, ok := shard.Data[key]
+		value, err = update(value, ok)
+		if err != nil {
+			return err
+		}
+		if shard.Data == nil {
+			shard.Data = make(map[string]string)
+		}
+		shard.Data[key] = value
+		if shard.Metadata.GetResourceVersion() == "" {
+			err = c.create(ctx, shard)
+		} else {
+			err = c.update(ctx, shard)
+		}
+		if isConflict(err) && attempt < 5 {
+			continue
+		}
+		if err != nil {
+			c.logger.Log("error_desc", "failed to update "+prefix, "key", key, "error", err)
+		}
+		return err
+	}
+}
+
+// storeShard fetches the ConfigMap holding key, returning an empty unsaved one if it doesn't exist yet.
+func (c k8sclient) storeShard(ctx context.Context, prefix, key string) (*corev1.ConfigMap, error) {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	name, namespace := prefix+"-"+strconv.Itoa(int(h.Sum32()%storeShards)), "default"
+
+	var cm corev1.ConfigMap
+	err := c.client.Get(ctx, namespace, name, &cm)
+	if err == nil {
+		return &cm, nil
+	}
+	if !isNotFound(err) {
+		return nil, err
+	}
+	return &corev1.ConfigMap{
+		Metadata: &metav1.ObjectMeta{
+			Name:      &name,
+			Namespace: &namespace,
+			Labels:    map[string]string{labelManagedBy: managerName},
+		},
+	}, nil
+}
@@ -0,0 +1,97 @@
+package client
+
+import (
+	"context"
+	"github.com/ericchiang/k8s"
+	appsv1 "github.com/ericchiang/k8s/apis/apps/v1"
+	corev1 "github.com/ericchiang/k8s/apis/core/v1"
+	"github.com/seagullbird/headr-k8s-helper/config"
+	"strconv"
+)
+
+// userNamespace returns the namespace holding a user's sites in namespace tenancy mode.
+func userNamespace(userID uint) string {
+	return "headr-user-" + strconv.Itoa(int(userID))
+}
+
+// sitesNamespace returns the namespace sites are listed in: default in shared tenancy mode, which holds every site,
+// and all namespaces in namespace tenancy mode.
+func sitesNamespace() string {
+	if config.Tenancy == config.TenancyNamespace {
+		return k8s.AllNamespaces
+	}
+	return "default"
+}
+
+// siteNamespace returns the namespace the site's deployment and service live in.
+// In namespace tenancy mode it is looked up from the user label of the site's ExternalName service in the default namespace,
+// or from the site's deployment when that service is gone.
+func (c k8sclient) siteNamespace(ctx context.Context, siteID uint) (string, error) {
+	if config.Tenancy != config.TenancyNamespace {
+		return "default", nil
+	}
+	var svc corev1.Service
+	if err := c.client.Get(ctx, "default", serviceName(siteID), &svc); err != nil {
+		if !isNotFound(err) {
+			return "", err
+		}
+		dps, err := c.managedSites(ctx, siteID)
+		if err != nil || len(dps) == 0 {
+			return "default", err
+		}
+		return dps[0].Metadata.GetNamespace(), nil
+	}
+	if svc.Spec.GetType() != "ExternalName" {
+		// Created before namespace tenancy was turned on
+		return "default", nil
+	}
+	userID, err := strconv.ParseUint(svc.Metadata.GetLabels()[labelUserID], 10, 0)
+	if err != nil {
+		return "", err
+	}
+	return userNamespace(uint(userID)), nil
+}
+
+// ensureUserNamespace creates the user namespace of a manifest unless it already exists.
+// Each object is created independently, so a namespace left half prepared by a failed attempt is completed.
+func (c k8sclient) ensureUserNamespace(ctx context.Context, m Manifest) error {
+	if err := c.create(ctx, m.Namespace); err != nil && !isAlreadyExists(err) {
+		return err
+	}
+	if err := c.create(ctx, m.ResourceQuota); err != nil && !isAlreadyExists(err) {
+		return err
+	}
+	if err := c.create(ctx, m.LimitRange); err != nil && !isAlreadyExists(err) {
+		return err
+	}
+	return nil
+}
+
+// releaseUserNamespace deletes a user namespace once the last site in it is gone.
+func (c k8sclient) releaseUserNamespace(ctx context.Context, namespace string) error {
+	if namespace == "default" {
+		return nil
+	}
+	var dps appsv1.DeploymentList
+	if err := c.client.List(ctx, namespace, &dps); err != nil {
+		return err
+	}
+	if len(dps.Items) > 0 {
+		return nil
+	}
+	var ns corev1.Namespace
+	if err := c.client.Get(ctx, "", namespace, &ns); err != nil {
+		if isNotFound(err) {
+			return nil
+		}
+		return err
+	}
+	if ns.Metadata.GetLabels()[labelManagedBy] != managerName {
+		return nil
+	}
+	if err := c.delete(ctx, &ns); err != nil && !isNotFound(err) {
+		return err
+	}
+	c.logger.Log("info", "Deleted user namespace", "namespace", namespace)
+	return nil
+}
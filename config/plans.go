@@ -0,0 +1,63 @@
+package config
+
+// Plan describes the cluster resources a user's namespace may consume.
+type Plan struct {
+	// MaxSites caps the number of sites of the user; zero means MaxSitesPerUser
+	MaxSites int
+	// Pods caps the number of pods and services in the namespace
+	Pods string
+	// CPU and Memory cap the summed requests and limits in the namespace
+	CPU    string
+	Memory string
+	// DefaultCPU and DefaultMemory apply to containers that don't set their own requests and limits
+	DefaultCPU    string
+	DefaultMemory string
+}
+
+// DefaultPlan sizes the namespaces of users whose plan is unset or unknown; their site limit is MaxSitesPerUser, see SiteLimit
+const DefaultPlan = "free"
+
+// Plans maps plan names to their resource allowances
+var Plans = map[string]Plan{
+	"free": {
+		MaxSites:      2,
+		Pods:          "4",
+		CPU:           "400m",
+		Memory:        "256Mi",
+		DefaultCPU:    "100m",
+		DefaultMemory: "64Mi",
+	},
+	"pro": {
+		MaxSites:      20,
+		Pods:          "40",
+		CPU:           "4",
+		Memory:        "2560Mi",
+		DefaultCPU:    "100m",
+		DefaultMemory: "64Mi",
+	},
+}
+
+// PlanFor returns the named plan, or the default plan if there is no such plan.
+func PlanFor(name string) Plan {
+	if plan, ok := Plans[name]; ok {
+		return plan
+	}
+	return Plans[DefaultPlan]
+}
+
+// SiteLimit returns the number of sites a user on this plan may have.
+func (p Plan) SiteLimit() int {
+	if p.MaxSites > 0 {
+		return p.MaxSites
+	}
+	return MaxSitesPerUser
+}
+
+// SiteLimit returns the number of sites a user on the named plan may have. Users without a known plan, such as those
+// of events predating plans, get MaxSitesPerUser rather than the default plan's limit.
+func SiteLimit(name string) int {
+	if plan, ok := Plans[name]; ok {
+		return plan.SiteLimit()
+	}
+	return MaxSitesPerUser
+}
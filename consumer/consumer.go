@@ -0,0 +1,377 @@
+package consumer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/go-kit/kit/log"
+	mqclient "github.com/seagullbird/headr-common/mq/client"
+	"github.com/seagullbird/headr-k8s-helper/config"
+	"github.com/seagullbird/headr-k8s-helper/metrics"
+	"github.com/streadway/amqp"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// A Handler handles one delivery. It returns nil when the delivery was handled, an error to have it retried,
+// or an error made with Permanent to have it dead-lettered without retrying.
+type Handler func(ctx context.Context, delivery amqp.Delivery) error
+
+// Headers of retried and dead-lettered messages.
+const (
+	// HeaderRetries counts the times a message went through its retry queue
+	HeaderRetries = "x-retries"
+	// HeaderError is the error of the last failed attempt
+	HeaderError = "x-error"
+	// HeaderPermanent is true on dead-lettered messages whose error was permanent, and false on those out of retries
+	HeaderPermanent = "x-error-permanent"
+	// HeaderQueue is the queue a dead-lettered message was consumed from
+	HeaderQueue = "x-original-queue"
+	// HeaderFailedAt is when a message was dead-lettered
+	HeaderFailedAt = "x-failed-at"
+)
+
+type permanentError struct {
+	err error
+}
+
+func (e permanentError) Error() string {
+	return e.err.Error()
+}
+
+// Permanent marks an error retrying won't fix, such as a malformed event.
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return permanentError{err}
+}
+
+// IsPermanent reports whether err was made with Permanent.
+func IsPermanent(err error) bool {
+	_, ok := err.(permanentError)
+	return ok
+}
+
+// RetryQueue names the queue failed messages of queue wait in before they're delivered again.
+func RetryQueue(queue string) string {
+	return queue + ".retry"
+}
+
+// DeadLetterQueue names the queue messages of queue go to when they can't be handled.
+func DeadLetterQueue(queue string) string {
+	return queue + ".dead"
+}
+
+// Declare declares queue with its retry and dead-letter queues. Only queue is declared as config.DurableQueues says,
+// since publishers declare it too; the others are always durable.
+// Messages expire from the retry queue after config.RetryDelay and are dead-lettered back to queue by the broker.
+func Declare(ch *amqp.Channel, queue string) error {
+	if _, err := ch.QueueDeclare(queue, config.DurableQueues, false, false, false, nil); err != nil {
+		return err
+	}
+	retryArgs := amqp.Table{
+		"x-message-ttl":             int32(config.RetryDelay * 1000),
+		"x-dead-letter-exchange":    "",
+		"x-dead-letter-routing-key": queue,
+	}
+	if _, err := ch.QueueDeclare(RetryQueue(queue), true, false, false, false, retryArgs); err != nil {
+		return err
+	}
+	_, err := ch.QueueDeclare(DeadLetterQueue(queue), true, false, false, false, nil)
+	return err
+}
+
+// Consumer is the RabbitMQ Source: it consumes queues with manual acknowledgements. A delivery is acked once its handler succeeds;
+// a failed one is republished to the retry or dead-letter queue before it's acked, and requeued when that fails,
+// so an event is only lost when it's handled.
+// Up to config.Concurrency handlers run at a time, across all queues; deliveries with the same key are handled one
+// at a time in the order they arrive. The consumer consumes again after reconnecting.
+// Each handler gets config.EventTimeout to finish; Shutdown cancels them all.
+type Consumer struct {
+	client   mqclient.Client
+	key      Key
+	logger   log.Logger
+	handlers map[string]Handler
+	// the runner's wg counts the serve loops too
+	*runner
+
+	mtx     sync.Mutex
+	ch      *amqp.Channel
+	closing bool
+}
+
+// New returns a Consumer connecting with client and ordering deliveries by key.
+func New(client mqclient.Client, key Key, logger log.Logger) *Consumer {
+	return &Consumer{
+		client:   client,
+		key:      key,
+		logger:   logger,
+		handlers: make(map[string]Handler),
+		runner:   newRunner(),
+	}
+}
+
+// Register sets the handler of queue; it must be called before Start.
+func (c *Consumer) Register(queue string, h Handler) {
+	c.handlers[queue] = h
+}
+
+// Start connects, declares the queues and starts consuming them.
+func (c *Consumer) Start() error {
+	if err := c.client.Connect(); err != nil {
+		return err
+	}
+	if err := c.consume(); err != nil {
+		c.client.Close()
+		return err
+	}
+	go c.reconnect()
+	return nil
+}
+
+// Shutdown stops consuming and gives the deliveries being handled timeout to finish, then cancels their contexts
+// and closes the connection. Deliveries left unhandled aren't acked, so the broker delivers them again;
+// Shutdown returns an error counting them.
+func (c *Consumer) Shutdown(timeout time.Duration) error {
+	c.mtx.Lock()
+	c.closing = true
+	ch := c.ch
+	c.mtx.Unlock()
+	if ch != nil {
+		for _, queue := range c.queues() {
+			if err := ch.Cancel(queue, false); err != nil {
+				c.logger.Log("error_desc", "Failed to stop consuming", "queue", queue, "error", err)
+			}
+		}
+	}
+
+	err := c.drain(timeout, c.logger)
+	c.client.Close()
+	return err
+}
+
+// Check fails when the connection is down, one of the queues has no consumer or the consumer is shutting down.
+func (c *Consumer) Check() error {
+	c.mtx.Lock()
+	closing := c.closing
+	c.mtx.Unlock()
+	if closing {
+		return errors.New("shutting down")
+	}
+	conn := c.client.Connection()
+	if conn == nil {
+		return errors.New("not connected")
+	}
+	ch, err := conn.Channel()
+	if err != nil {
+		return err
+	}
+	defer ch.Close()
+	for _, queue := range c.queues() {
+		q, err := ch.QueueInspect(queue)
+		if err != nil {
+			return err
+		}
+		if q.Consumers == 0 {
+			return fmt.Errorf("no consumers on queue %s", queue)
+		}
+	}
+	return nil
+}
+
+func (c *Consumer) queues() []string {
+	queues := make([]string, 0, len(c.handlers))
+	for queue := range c.handlers {
+		queues = append(queues, queue)
+	}
+	sort.Strings(queues)
+	return queues
+}
+
+func (c *Consumer) consume() error {
+	ch, err := c.client.Connection().Channel()
+	if err != nil {
+		return err
+	}
+	// Enough unacked deliveries per queue to keep the pool busy, and no more
+	if err := ch.Qos(c.pool.size, 0, false); err != nil {
+		return err
+	}
+	for _, queue := range c.queues() {
+		if err := Declare(ch, queue); err != nil {
+			return err
+		}
+		// The queue names the consumer, so Shutdown can cancel it
+		deliveries, err := ch.Consume(queue, queue, false, false, false, false, nil)
+		if err != nil {
+			return err
+		}
+		c.wg.Add(1)
+		go c.serve(ch, queue, c.handlers[queue], deliveries)
+	}
+	c.mtx.Lock()
+	c.ch = ch
+	c.mtx.Unlock()
+	return nil
+}
+
+// reconnect consumes again each time the connection drops.
+// Deliveries left unacked by the old connection are redelivered by the broker.
+func (c *Consumer) reconnect() {
+	for {
+		closed := c.notifyClose()
+		if closed == nil {
+			return
+		}
+		err := <-closed
+		if c.shuttingDown() {
+			return
+		}
+		c.logger.Log("error_desc", "RabbitMQ connection closed, reconnecting", "error", err)
+		for retry := 1; ; retry++ {
+			if c.shuttingDown() {
+				return
+			}
+			if err := c.client.Reconnect(retry); err != nil {
+				c.logger.Log("error_desc", "Failed to reconnect to RabbitMQ", "retry", retry, "error", err)
+				continue
+			}
+			if err := c.consume(); err != nil {
+				c.logger.Log("error_desc", "Failed to consume after reconnecting", "retry", retry, "error", err)
+				continue
+			}
+			break
+		}
+		c.logger.Log("info", "Reconnected to RabbitMQ")
+	}
+}
+
+// notifyClose returns a channel receiving the error the connection closes with, closed already when there's no
+// connection, or nil once shutdown has started. It's taken under the lock Shutdown marks the shutdown with, so the
+// connection isn't closed from under it.
+func (c *Consumer) notifyClose() chan *amqp.Error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.closing {
+		return nil
+	}
+	conn := c.client.Connection()
+	if conn == nil {
+		closed := make(chan *amqp.Error)
+		close(closed)
+		return closed
+	}
+	return conn.NotifyClose(make(chan *amqp.Error, 1))
+}
+
+func (c *Consumer) shuttingDown() bool {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.closing
+}
+
+func (c *Consumer) serve(ch *amqp.Channel, queue string, h Handler, deliveries <-chan amqp.Delivery) {
+	defer c.wg.Done()
+	for delivery := range deliveries {
+		delivery := delivery
+		c.run(c.key(delivery), h, delivery, func(err error) {
+			c.settle(ch, queue, delivery, err)
+		}, func() {
+			c.logger.Log("error_desc", "Event abandoned on shutdown, requeueing it", "queue", queue, "message_id", delivery.MessageId)
+			if err := delivery.Nack(false, true); err != nil {
+				c.logger.Log("error_desc", "Failed to requeue event", "queue", queue, "error", err)
+			}
+		})
+	}
+}
+
+// A publisher publishes messages, like *amqp.Channel.
+type publisher interface {
+	Publish(exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error
+}
+
+// settle acks a delivery its handler is done with. A failed delivery is first published to the retry queue,
+// or to the dead-letter queue when its error is permanent or it's out of retries; it's requeued if that publish fails.
+func (c *Consumer) settle(ch publisher, queue string, delivery amqp.Delivery, err error) {
+	if err != nil {
+		target, msg := failed(queue, delivery, err)
+		if perr := ch.Publish("", target, false, false, msg); perr != nil {
+			c.logger.Log("error_desc", "Failed to publish failed event, requeueing it", "queue", target, "error", perr)
+			if err := delivery.Nack(false, true); err != nil {
+				c.logger.Log("error_desc", "Failed to requeue event", "queue", queue, "error", err)
+			}
+			return
+		}
+		if target == DeadLetterQueue(queue) {
+			metrics.EventsDeadLettered.With("queue", queue).Add(1)
+			c.logger.Log("error_desc", "Event dead-lettered", "queue", queue, "message_id", delivery.MessageId, "error", err)
+		} else {
+			metrics.EventsRetried.With("queue", queue).Add(1)
+		}
+	}
+	if err := delivery.Ack(false); err != nil {
+		c.logger.Log("error_desc", "Failed to ack event", "queue", queue, "error", err)
+	}
+}
+
+// failed returns the queue a delivery that failed with err goes to, and the message to publish there.
+func failed(queue string, delivery amqp.Delivery, err error) (string, amqp.Publishing) {
+	headers := make(amqp.Table, len(delivery.Headers)+5)
+	for k, v := range delivery.Headers {
+		headers[k] = v
+	}
+	headers[HeaderError] = err.Error()
+
+	retries := Retries(delivery.Headers)
+	target := RetryQueue(queue)
+	if IsPermanent(err) || retries >= config.MaxRetries {
+		target = DeadLetterQueue(queue)
+		headers[HeaderPermanent] = IsPermanent(err)
+		headers[HeaderQueue] = queue
+		headers[HeaderFailedAt] = time.Now().UTC()
+	} else {
+		retries++
+	}
+	headers[HeaderRetries] = int32(retries)
+
+	return target, publishing(delivery, headers)
+}
+
+// publishing copies a delivery to a persistent message with the given headers.
+func publishing(delivery amqp.Delivery, headers amqp.Table) amqp.Publishing {
+	return amqp.Publishing{
+		Headers:         headers,
+		ContentType:     delivery.ContentType,
+		ContentEncoding: delivery.ContentEncoding,
+		DeliveryMode:    amqp.Persistent,
+		Priority:        delivery.Priority,
+		CorrelationId:   delivery.CorrelationId,
+		ReplyTo:         delivery.ReplyTo,
+		MessageId:       delivery.MessageId,
+		Timestamp:       delivery.Timestamp,
+		Type:            delivery.Type,
+		AppId:           delivery.AppId,
+		Body:            delivery.Body,
+	}
+}
+
+// Retries returns the x-retries header of a message, or 0 without one. Sources other than RabbitMQ carry it as a string.
+func Retries(headers amqp.Table) int {
+	switch v := headers[HeaderRetries].(type) {
+	case int8:
+		return int(v)
+	case int16:
+		return int(v)
+	case int32:
+		return int(v)
+	case int64:
+		return int(v)
+	case string:
+		n, _ := strconv.Atoi(v)
+		return n
+	}
+	return 0
+}
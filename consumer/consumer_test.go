@@ -0,0 +1,226 @@
+package consumer
+
+import (
+	"context"
+	"errors"
+	"github.com/go-kit/kit/log"
+	"github.com/seagullbird/headr-k8s-helper/config"
+	"github.com/streadway/amqp"
+	"testing"
+	"time"
+)
+
+// recorder records acks and nacks, and the messages published through it.
+type recorder struct {
+	acked, requeued bool
+	queue           string
+	msg             amqp.Publishing
+	err             error
+}
+
+func (r *recorder) Ack(tag uint64, multiple bool) error {
+	r.acked = true
+	return nil
+}
+
+func (r *recorder) Nack(tag uint64, multiple, requeue bool) error {
+	r.requeued = requeue
+	return nil
+}
+
+func (r *recorder) Reject(tag uint64, requeue bool) error {
+	r.requeued = requeue
+	return nil
+}
+
+func (r *recorder) Publish(exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	if r.err != nil {
+		return r.err
+	}
+	r.queue, r.msg = key, msg
+	return nil
+}
+
+func TestSettle(t *testing.T) {
+	defer func(n int) { config.MaxRetries = n }(config.MaxRetries)
+	config.MaxRetries = 2
+	errBoom := errors.New("boom")
+	tests := []struct {
+		name         string
+		retries      interface{}
+		err          error
+		publishErr   error
+		wantQueue    string
+		wantRetries  int
+		wantAcked    bool
+		wantRequeued bool
+	}{
+		{
+			name:      "success is acked",
+			wantAcked: true,
+		},
+		{
+			name:        "failure is retried",
+			err:         errBoom,
+			wantQueue:   "new_site_server.retry",
+			wantRetries: 1,
+			wantAcked:   true,
+		},
+		{
+			name:        "retried failure counts its retries",
+			retries:     int32(1),
+			err:         errBoom,
+			wantQueue:   "new_site_server.retry",
+			wantRetries: 2,
+			wantAcked:   true,
+		},
+		{
+			name:        "failure out of retries is dead-lettered",
+			retries:     int64(2),
+			err:         errBoom,
+			wantQueue:   "new_site_server.dead",
+			wantRetries: 2,
+			wantAcked:   true,
+		},
+		{
+			name:      "permanent failure is dead-lettered at once",
+			err:       Permanent(errBoom),
+			wantQueue: "new_site_server.dead",
+			wantAcked: true,
+		},
+		{
+			name:         "failure is requeued when it can't be published",
+			err:          errBoom,
+			publishErr:   errors.New("channel closed"),
+			wantRequeued: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &recorder{err: tt.publishErr}
+			delivery := amqp.Delivery{
+				Acknowledger: r,
+				Headers:      amqp.Table{"traceparent": "00-1-2-01"},
+				MessageId:    "m1",
+				Body:         []byte(`{"site_id": 7}`),
+			}
+			if tt.retries != nil {
+				delivery.Headers[HeaderRetries] = tt.retries
+			}
+			c := New(nil, nil, log.NewNopLogger())
+			c.settle(r, "new_site_server", delivery, tt.err)
+
+			if r.acked != tt.wantAcked || r.requeued != tt.wantRequeued {
+				t.Fatalf("acked, requeued = %v, %v, want %v, %v", r.acked, r.requeued, tt.wantAcked, tt.wantRequeued)
+			}
+			if r.queue != tt.wantQueue {
+				t.Fatalf("published to %q, want %q", r.queue, tt.wantQueue)
+			}
+			if tt.wantQueue == "" {
+				return
+			}
+			h := r.msg.Headers
+			if got := Retries(h); got != tt.wantRetries {
+				t.Errorf("%s = %d, want %d", HeaderRetries, got, tt.wantRetries)
+			}
+			if h[HeaderError] != "boom" || h["traceparent"] != "00-1-2-01" {
+				t.Errorf("headers = %v, want the error and the original headers", h)
+			}
+			if string(r.msg.Body) != `{"site_id": 7}` || r.msg.MessageId != "m1" || r.msg.DeliveryMode != amqp.Persistent {
+				t.Errorf("message = %+v, want a persistent copy of the delivery", r.msg)
+			}
+			if tt.wantQueue == DeadLetterQueue("new_site_server") {
+				if h[HeaderQueue] != "new_site_server" || h[HeaderPermanent] != IsPermanent(tt.err) || h[HeaderFailedAt] == nil {
+					t.Errorf("dead-letter headers = %v", h)
+				}
+			}
+		})
+	}
+}
+
+func TestReplayed(t *testing.T) {
+	delivery := amqp.Delivery{
+		Headers: amqp.Table{
+			"traceparent":   "00-1-2-01",
+			HeaderRetries:   int32(5),
+			HeaderError:     "boom",
+			HeaderPermanent: false,
+			HeaderQueue:     "new_site_server",
+		},
+		MessageId: "m1",
+		Body:      []byte(`{"site_id": 7}`),
+	}
+	msg := replayed(delivery)
+	if len(msg.Headers) != 1 || msg.Headers["traceparent"] != "00-1-2-01" {
+		t.Errorf("headers = %v, want only traceparent", msg.Headers)
+	}
+	if msg.MessageId != "m1" || string(msg.Body) != `{"site_id": 7}` {
+		t.Errorf("message = %+v, want a copy of the delivery", msg)
+	}
+}
+
+// closer is a client that only records being closed.
+type closer struct {
+	closed bool
+}
+
+func (c *closer) Connect() error                { return nil }
+func (c *closer) Reconnect(retryTime int) error { return nil }
+func (c *closer) Close()                        { c.closed = true }
+func (c *closer) Connection() *amqp.Connection  { return nil }
+
+// serving has c serve deliveries with h, as if they were consumed from a queue.
+func serving(c *Consumer, h Handler, deliveries ...amqp.Delivery) {
+	ch := make(chan amqp.Delivery, len(deliveries))
+	for _, d := range deliveries {
+		ch <- d
+	}
+	close(ch)
+	c.wg.Add(1)
+	go c.serve(nil, "new_site_server", h, ch)
+}
+
+func TestShutdownDrains(t *testing.T) {
+	client, r := &closer{}, &recorder{}
+	c := New(client, func(amqp.Delivery) string { return "site:7" }, log.NewNopLogger())
+	serving(c, func(ctx context.Context, d amqp.Delivery) error {
+		time.Sleep(20 * time.Millisecond)
+		return nil
+	}, amqp.Delivery{Acknowledger: r})
+
+	if err := c.Shutdown(time.Second); err != nil {
+		t.Fatalf("Shutdown() = %v, want nil", err)
+	}
+	if !r.acked || !client.closed {
+		t.Errorf("acked, closed = %v, %v, want the event finished and the connection closed", r.acked, client.closed)
+	}
+	if c.Check() == nil {
+		t.Error("Check() = nil after shutdown")
+	}
+}
+
+func TestShutdownCancels(t *testing.T) {
+	client, running, waiting := &closer{}, &recorder{}, &recorder{}
+	c := New(client, func(amqp.Delivery) string { return "site:7" }, log.NewNopLogger())
+	started := make(chan struct{})
+	serving(c, func(ctx context.Context, d amqp.Delivery) error {
+		close(started)
+		<-ctx.Done()
+		return ctx.Err()
+	}, amqp.Delivery{Acknowledger: running}, amqp.Delivery{Acknowledger: waiting})
+	<-started
+
+	err := c.Shutdown(10 * time.Millisecond)
+	if err == nil || err.Error() != "abandoned 2 events" {
+		t.Fatalf("Shutdown() = %v, want 2 events abandoned", err)
+	}
+	for _, r := range []*recorder{running, waiting} {
+		if r.acked || !r.requeued || r.queue != "" {
+			t.Errorf("acked, requeued, published = %v, %v, %q, want the event requeued", r.acked, r.requeued, r.queue)
+		}
+	}
+	if !client.closed {
+		t.Error("connection not closed")
+	}
+}
@@ -0,0 +1,82 @@
+package consumer
+
+import (
+	"github.com/streadway/amqp"
+)
+
+// An Action settles a dead-lettered message.
+type Action int
+
+const (
+	// Keep leaves the message in the dead-letter queue
+	Keep Action = iota
+	// Replay publishes the message, with its body as the visit left it, back to its queue and removes it from the dead-letter queue
+	Replay
+	// Drop removes the message from the dead-letter queue
+	Drop
+)
+
+// Walk visits the messages of the dead-letter queue of queue in order and settles each as its visit says,
+// then calls settled, if not nil, with each message replayed or dropped.
+// Only the messages there when Walk starts are visited, so replayed messages that fail again aren't visited twice.
+// Walk stops at the first visit or broker error; the messages not yet settled stay in the dead-letter queue.
+func Walk(ch *amqp.Channel, queue string, visit func(delivery *amqp.Delivery) (Action, error), settled func(delivery amqp.Delivery, action Action)) error {
+	dead := DeadLetterQueue(queue)
+	q, err := ch.QueueInspect(dead)
+	if err != nil {
+		return err
+	}
+
+	// Kept messages are held unacked until the end, so Get moves on to the next one
+	var kept []amqp.Delivery
+	defer func() {
+		for _, d := range kept {
+			d.Nack(false, true)
+		}
+	}()
+	for i := 0; i < q.Messages; i++ {
+		d, ok, err := ch.Get(dead, false)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return nil
+		}
+		action, err := visit(&d)
+		if err != nil {
+			kept = append(kept, d)
+			return err
+		}
+		switch action {
+		case Replay:
+			if err := ch.Publish("", queue, false, false, replayed(d)); err != nil {
+				kept = append(kept, d)
+				return err
+			}
+		case Drop:
+		default:
+			kept = append(kept, d)
+			continue
+		}
+		if err := d.Ack(false); err != nil {
+			return err
+		}
+		if settled != nil {
+			settled(d, action)
+		}
+	}
+	return nil
+}
+
+// replayed copies a dead-lettered message without the headers of its failure, so it gets all its retries again.
+func replayed(d amqp.Delivery) amqp.Publishing {
+	headers := make(amqp.Table, len(d.Headers))
+	for k, v := range d.Headers {
+		switch k {
+		case HeaderRetries, HeaderError, HeaderPermanent, HeaderQueue, HeaderFailedAt:
+		default:
+			headers[k] = v
+		}
+	}
+	return publishing(d, headers)
+}
@@ -0,0 +1,3 @@
+// Package consumer consumes the site queues with manual acknowledgements, retrying failed events with a delay
+// and dead-lettering those that can't be handled
+package consumer
@@ -0,0 +1,130 @@
+package consumer
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/go-kit/kit/log"
+	"github.com/streadway/amqp"
+	"io"
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+)
+
+// natsServer accepts one connection on a local port and speaks just enough of the NATS protocol to the helper.
+type natsServer struct {
+	ln   net.Listener
+	conn net.Conn
+	r    *textproto.Reader
+}
+
+func newNATSServer(t *testing.T) *natsServer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &natsServer{ln: ln}
+}
+
+// accept greets the helper and returns the operations it sent until its PING, which it answers.
+func (s *natsServer) accept(t *testing.T) []string {
+	t.Helper()
+	conn, err := s.ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.conn, s.r = conn, textproto.NewReader(bufio.NewReader(conn))
+	io.WriteString(conn, `INFO {"headers":true}`+"\r\n")
+	var ops []string
+	for {
+		line, err := s.r.ReadLine()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line == "PING" {
+			io.WriteString(conn, "PONG\r\n")
+			return ops
+		}
+		ops = append(ops, line)
+	}
+}
+
+func TestNATS(t *testing.T) {
+	s := newNATSServer(t)
+	defer s.ln.Close()
+	n, err := NewNATS("nats://helper:pass@"+s.ln.Addr().String(), func(amqp.Delivery) string { return "site:7" }, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(chan amqp.Delivery, 1)
+	n.Register("new_site_server", func(ctx context.Context, d amqp.Delivery) error {
+		got <- d
+		return Permanent(errors.New("malformed"))
+	})
+
+	started := make(chan error)
+	go func() { started <- n.Start() }()
+	ops := s.accept(t)
+	if err := <-started; err != nil {
+		t.Fatalf("Start() = %v", err)
+	}
+	if len(ops) != 2 || !strings.Contains(ops[0], `"user":"helper"`) || ops[1] != "SUB new_site_server k8s-helper 1" {
+		t.Fatalf("ops = %q, want CONNECT with the credentials and a SUB in the queue group", ops)
+	}
+	if err := n.Check(); err != nil {
+		t.Fatalf("Check() = %v, want nil", err)
+	}
+
+	header := "NATS/1.0\r\nNats-Msg-Id: m1\r\nX-Signature: k1:abc\r\n\r\n"
+	body := `{"site_id":7}`
+	fmt.Fprintf(s.conn, "PING\r\nHMSG new_site_server 1 %d %d\r\n%s%s\r\n", len(header), len(header)+len(body), header, body)
+	if line, _ := s.r.ReadLine(); line != "PONG" {
+		t.Errorf("answer to PING = %q, want PONG", line)
+	}
+
+	select {
+	case d := <-got:
+		if d.MessageId != "m1" || d.Headers["x-signature"] != "k1:abc" || string(d.Body) != body {
+			t.Errorf("delivery = %+v, want the message id, headers and body of the message", d)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("message not handled")
+	}
+
+	// The permanent error dead-letters the message
+	line, err := s.r.ReadLine()
+	if err != nil || !strings.HasPrefix(line, "HPUB new_site_server.dead ") {
+		t.Fatalf("published %q, %v, want HPUB to the dead-letter subject", line, err)
+	}
+	var hsize, size int
+	fmt.Sscanf(line, "HPUB new_site_server.dead %d %d", &hsize, &size)
+	payload := make([]byte, size+2)
+	io.ReadFull(s.r.R, payload)
+	headers := parseHeaders(payload[:hsize])
+	if headers[HeaderError] != "malformed" || headers[HeaderPermanent] != "true" || headers["nats-msg-id"] != "m1" || string(payload[hsize:size]) != body {
+		t.Errorf("dead letter headers %v, body %q, want the error and the message", headers, payload[hsize:size])
+	}
+	if ids := strings.Count(strings.ToLower(string(payload[:hsize])), "nats-msg-id:"); ids != 1 {
+		t.Errorf("dead letter has %d Nats-Msg-Id headers, want 1: %q", ids, payload[:hsize])
+	}
+
+	if err := n.Shutdown(time.Second); err != nil {
+		t.Errorf("Shutdown() = %v, want nil", err)
+	}
+	if line, _ := s.r.ReadLine(); line != "UNSUB 1" {
+		t.Errorf("op on shutdown = %q, want UNSUB 1", line)
+	}
+	if n.Check() == nil {
+		t.Error("Check() = nil after shutdown")
+	}
+}
+
+func TestRetriesOfStringHeaders(t *testing.T) {
+	if got := Retries(amqp.Table{HeaderRetries: "3"}); got != 3 {
+		t.Errorf("Retries() = %d, want 3", got)
+	}
+}
@@ -0,0 +1,74 @@
+package consumer
+
+import (
+	"github.com/streadway/amqp"
+	"sync"
+)
+
+// A Key names what a delivery is about, such as its site; deliveries with the same key are handled in order.
+type Key func(delivery amqp.Delivery) string
+
+// pool runs work on at most size goroutines. Work submitted with the same key runs in submission order,
+// one at a time; work with different keys runs in parallel.
+type pool struct {
+	size int
+	mtx  sync.Mutex
+	// running counts the goroutines
+	running int
+	// pending holds the work not yet started of each key; a key is present while its work runs or waits in ready
+	pending map[string][]func()
+	// ready holds the keys waiting for a goroutine, in the order they came
+	ready []string
+}
+
+func newPool(size int) *pool {
+	if size < 1 {
+		size = 1
+	}
+	return &pool{
+		size:    size,
+		pending: make(map[string][]func()),
+	}
+}
+
+// submit queues work behind the work of key, and never blocks.
+func (p *pool) submit(key string, work func()) {
+	p.mtx.Lock()
+	if queued, busy := p.pending[key]; busy {
+		p.pending[key] = append(queued, work)
+		p.mtx.Unlock()
+		return
+	}
+	p.pending[key] = []func(){work}
+	if p.running == p.size {
+		p.ready = append(p.ready, key)
+		p.mtx.Unlock()
+		return
+	}
+	p.running++
+	p.mtx.Unlock()
+	go p.run(key)
+}
+
+// run runs the work of key until none is left, then that of the ready keys until none is left.
+func (p *pool) run(key string) {
+	for {
+		p.mtx.Lock()
+		queued := p.pending[key]
+		if len(queued) == 0 {
+			delete(p.pending, key)
+			if len(p.ready) == 0 {
+				p.running--
+				p.mtx.Unlock()
+				return
+			}
+			key, p.ready = p.ready[0], p.ready[1:]
+			p.mtx.Unlock()
+			continue
+		}
+		work := queued[0]
+		p.pending[key] = queued[1:]
+		p.mtx.Unlock()
+		work()
+	}
+}
@@ -0,0 +1,95 @@
+package consumer
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPoolOrdersWorkOfAKey(t *testing.T) {
+	p := newPool(4)
+	var (
+		mtx  sync.Mutex
+		got  []int
+		done sync.WaitGroup
+	)
+	for i := 0; i < 50; i++ {
+		i := i
+		done.Add(1)
+		p.submit("site:7", func() {
+			defer done.Done()
+			mtx.Lock()
+			got = append(got, i)
+			mtx.Unlock()
+		})
+	}
+	done.Wait()
+	for i, v := range got {
+		if v != i {
+			t.Fatalf("work ran in order %v, want submission order", got)
+		}
+	}
+}
+
+func TestPoolRunsKeysInParallel(t *testing.T) {
+	p := newPool(2)
+	slow, fast := make(chan struct{}), make(chan struct{})
+	p.submit("site:1", func() { <-slow })
+	p.submit("site:2", func() { close(fast) })
+	select {
+	case <-fast:
+	case <-time.After(time.Second):
+		t.Fatal("site:2 waited for site:1")
+	}
+	close(slow)
+}
+
+func TestPoolBoundsConcurrency(t *testing.T) {
+	p := newPool(2)
+	var (
+		mtx           sync.Mutex
+		running, most int
+		done          sync.WaitGroup
+	)
+	for i := 0; i < 10; i++ {
+		done.Add(1)
+		p.submit(string(rune('a'+i)), func() {
+			defer done.Done()
+			mtx.Lock()
+			running++
+			if running > most {
+				most = running
+			}
+			mtx.Unlock()
+			time.Sleep(5 * time.Millisecond)
+			mtx.Lock()
+			running--
+			mtx.Unlock()
+		})
+	}
+	done.Wait()
+	if most > 2 {
+		t.Errorf("%d ran at once, want at most 2", most)
+	}
+}
+
+func TestPoolBoundsGoroutines(t *testing.T) {
+	p := newPool(2)
+	block := make(chan struct{})
+	var done sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		done.Add(1)
+		p.submit(string(rune('a'+i)), func() {
+			defer done.Done()
+			<-block
+		})
+	}
+	p.mtx.Lock()
+	running, ready := p.running, len(p.ready)
+	p.mtx.Unlock()
+	if running != 2 || ready != 98 {
+		t.Errorf("%d goroutines with %d keys ready, want 2 with 98", running, ready)
+	}
+	close(block)
+	done.Wait()
+}
@@ -0,0 +1,90 @@
+package consumer
+
+import (
+	"context"
+	"fmt"
+	"github.com/go-kit/kit/log"
+	"github.com/seagullbird/headr-k8s-helper/config"
+	"github.com/streadway/amqp"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// cancelGrace is how long handlers get to return once drain cancelled them.
+const cancelGrace = 5 * time.Second
+
+// runner runs the handlers of a source: up to config.Concurrency at a time, deliveries with the same key one at
+// a time in the order they arrive, each within config.EventTimeout. drain waits for them on shutdown.
+type runner struct {
+	pool *pool
+	// ctx is the parent of the handlers' contexts, cancelled when drain gives up waiting for them
+	ctx    context.Context
+	cancel context.CancelFunc
+	// wg counts the deliveries being handled, and whatever else of the source drain waits for;
+	// inflight counts just the deliveries
+	wg        sync.WaitGroup
+	inflight  int32
+	abandoned int32
+}
+
+func newRunner() *runner {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &runner{
+		pool:   newPool(config.Concurrency),
+		ctx:    ctx,
+		cancel: cancel,
+	}
+}
+
+// run queues h on a delivery behind the deliveries of key, and passes the handler's error to settle.
+// A delivery whose handler was cancelled by drain, or that was still waiting then, goes to abandon instead.
+func (r *runner) run(key string, h Handler, delivery amqp.Delivery, settle func(error), abandon func()) {
+	r.wg.Add(1)
+	atomic.AddInt32(&r.inflight, 1)
+	r.pool.submit(key, func() {
+		defer r.wg.Done()
+		defer atomic.AddInt32(&r.inflight, -1)
+		if r.ctx.Err() == nil {
+			ctx, cancel := context.WithTimeout(r.ctx, time.Duration(config.EventTimeout)*time.Second)
+			err := h(ctx, delivery)
+			cancel()
+			if err == nil || r.ctx.Err() == nil {
+				settle(err)
+				return
+			}
+		}
+		atomic.AddInt32(&r.abandoned, 1)
+		abandon()
+	})
+}
+
+// drain gives the deliveries being handled timeout to finish, then cancels their contexts.
+// It returns an error counting the deliveries abandoned.
+func (r *runner) drain(timeout time.Duration, logger log.Logger) error {
+	if !wait(&r.wg, timeout) {
+		logger.Log("error_desc", "Events still being handled, cancelling them", "events", atomic.LoadInt32(&r.inflight))
+		r.cancel()
+		wait(&r.wg, cancelGrace)
+	}
+	r.cancel()
+	if abandoned := atomic.LoadInt32(&r.abandoned) + atomic.LoadInt32(&r.inflight); abandoned > 0 {
+		return fmt.Errorf("abandoned %d events", abandoned)
+	}
+	return nil
+}
+
+// wait waits for wg up to timeout, and reports whether it's done.
+func wait(wg *sync.WaitGroup, timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
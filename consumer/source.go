@@ -0,0 +1,23 @@
+package consumer
+
+import (
+	"time"
+)
+
+// A Source delivers site events to the handlers registered for their queues. Consumer is the RabbitMQ source;
+// NATS and Webhook receive the same events without a broker of the helper's own.
+//
+// Every source hands events over as amqp.Deliveries, so handlers don't depend on the source. Sources other than
+// RabbitMQ set only MessageId, ContentType, Headers and Body, and their deliveries can't be acked:
+// the source settles them with the handler's error.
+type Source interface {
+	// Register sets the handler of queue; it must be called before Start.
+	Register(queue string, h Handler)
+	// Start starts receiving events.
+	Start() error
+	// Check fails when the source can't receive events.
+	Check() error
+	// Shutdown stops receiving events and gives the events being handled timeout to finish.
+	// It returns an error counting the events abandoned.
+	Shutdown(timeout time.Duration) error
+}
@@ -0,0 +1,210 @@
+package consumer
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/go-kit/kit/log"
+	"github.com/seagullbird/headr-k8s-helper/config"
+	"github.com/streadway/amqp"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxEventSize bounds the bodies of events posted to a Webhook.
+const maxEventSize = 1 << 20
+
+// errAbandoned is the result of an event abandoned on shutdown.
+var errAbandoned = errors.New("abandoned on shutdown")
+
+// Webhook receives site events posted over HTTP to /events/<queue>. It answers once the event is handled:
+// 204 when it was, 422 when its error is permanent, and 503 with a Retry-After of config.RetryDelay when
+// the sender should post it again. The request headers, but for Authorization, are passed on lowercased
+// as the delivery's headers, and X-Message-Id as its MessageId.
+type Webhook struct {
+	addr   string
+	token  string
+	key    Key
+	logger log.Logger
+
+	handlers map[string]Handler
+	*runner
+	srv *http.Server
+
+	mtx     sync.Mutex
+	ln      net.Listener
+	closing bool
+}
+
+// NewWebhook returns a Webhook listening on addr and ordering events by key.
+// Events must carry token as a bearer token, unless it's empty.
+func NewWebhook(addr, token string, key Key, logger log.Logger) *Webhook {
+	w := &Webhook{
+		addr:     addr,
+		token:    token,
+		key:      key,
+		logger:   logger,
+		handlers: make(map[string]Handler),
+		runner:   newRunner(),
+	}
+	w.srv = &http.Server{Handler: w}
+	return w
+}
+
+// Register sets the handler of queue; it must be called before Start.
+func (w *Webhook) Register(queue string, h Handler) {
+	w.handlers[queue] = h
+}
+
+// Start listens on the Webhook's address and starts serving.
+func (w *Webhook) Start() error {
+	ln, err := net.Listen("tcp", w.addr)
+	if err != nil {
+		return err
+	}
+	w.mtx.Lock()
+	w.ln = ln
+	w.mtx.Unlock()
+	w.logger.Log("info", "Receiving site events", "addr", ln.Addr())
+	go func() {
+		if err := w.srv.Serve(ln); err != http.ErrServerClosed {
+			w.logger.Log("error_desc", "webhook server stopped", "error", err)
+		}
+	}()
+	return nil
+}
+
+// Check fails before Start and while shutting down.
+func (w *Webhook) Check() error {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	switch {
+	case w.closing:
+		return errors.New("shutting down")
+	case w.ln == nil:
+		return errors.New("not listening")
+	}
+	return nil
+}
+
+// Shutdown answers new events with 503, gives the events being handled timeout to finish, then cancels them
+// and stops the server. Their senders get a 503 too.
+func (w *Webhook) Shutdown(timeout time.Duration) error {
+	w.mtx.Lock()
+	w.closing = true
+	w.mtx.Unlock()
+
+	err := w.drain(timeout, w.logger)
+	ctx, cancel := context.WithTimeout(context.Background(), cancelGrace)
+	defer cancel()
+	if serr := w.srv.Shutdown(ctx); serr != nil {
+		w.logger.Log("error_desc", "Failed to stop the webhook server", "error", serr)
+	}
+	return err
+}
+
+func (w *Webhook) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.URL.Path, "/events/") {
+		http.NotFound(rw, r)
+		return
+	}
+	queue := strings.TrimPrefix(r.URL.Path, "/events/")
+	h, ok := w.handlers[queue]
+	if !ok {
+		http.NotFound(rw, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		rw.Header().Set("Allow", http.MethodPost)
+		http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if w.token != "" && subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+w.token)) != 1 {
+		http.Error(rw, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(rw, r.Body, maxEventSize))
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	delivery := amqp.Delivery{
+		Headers:     make(amqp.Table, len(r.Header)),
+		ContentType: r.Header.Get("Content-Type"),
+		MessageId:   r.Header.Get("X-Message-Id"),
+		Body:        body,
+	}
+	for k := range r.Header {
+		if k != "Authorization" {
+			delivery.Headers[strings.ToLower(k)] = r.Header.Get(k)
+		}
+	}
+
+	result := make(chan error, 1)
+	w.mtx.Lock()
+	if w.closing {
+		w.mtx.Unlock()
+		w.unavailable(rw, errAbandoned)
+		return
+	}
+	w.run(w.key(delivery), h, delivery, func(err error) {
+		result <- err
+	}, func() {
+		w.logger.Log("error_desc", "Event abandoned on shutdown", "queue", queue, "message_id", delivery.MessageId)
+		result <- errAbandoned
+	})
+	w.mtx.Unlock()
+
+	switch err := <-result; {
+	case err == nil:
+		rw.WriteHeader(http.StatusNoContent)
+	case IsPermanent(err):
+		w.logger.Log("error_desc", "Event refused", "queue", queue, "message_id", delivery.MessageId, "error", err)
+		http.Error(rw, err.Error(), http.StatusUnprocessableEntity)
+	default:
+		w.unavailable(rw, err)
+	}
+}
+
+// unavailable asks the sender to post an event again after config.RetryDelay.
+func (w *Webhook) unavailable(rw http.ResponseWriter, err error) {
+	rw.Header().Set("Retry-After", strconv.Itoa(config.RetryDelay))
+	http.Error(rw, err.Error(), http.StatusServiceUnavailable)
+}
+
+// Callback dispatches messages, such as refusals, by posting them as JSON to <URL>/<queue>,
+// for deployments receiving site events through a Webhook.
+type Callback struct {
+	URL    string
+	Client *http.Client
+}
+
+// DispatchMessage posts message to the callback of queue.
+func (c Callback) DispatchMessage(queue string, message interface{}) error {
+	body, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	client := c.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Post(strings.TrimSuffix(c.URL, "/")+"/"+queue, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("callback %s: %s", queue, resp.Status)
+	}
+	return nil
+}
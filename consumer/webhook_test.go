@@ -0,0 +1,100 @@
+package consumer
+
+import (
+	"context"
+	"errors"
+	"github.com/go-kit/kit/log"
+	"github.com/streadway/amqp"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWebhook(t *testing.T) {
+	var got amqp.Delivery
+	w := NewWebhook(":0", "secret", func(amqp.Delivery) string { return "site:7" }, log.NewNopLogger())
+	w.Register("new_site_server", func(ctx context.Context, d amqp.Delivery) error {
+		got = d
+		switch string(d.Body) {
+		case "bad":
+			return Permanent(errors.New("malformed"))
+		case "flaky":
+			return errors.New("timeout")
+		}
+		return nil
+	})
+
+	tests := []struct {
+		name, method, path, token, body string
+		want                            int
+	}{
+		{"handled", "POST", "/events/new_site_server", "secret", "ok", http.StatusNoContent},
+		{"permanent", "POST", "/events/new_site_server", "secret", "bad", http.StatusUnprocessableEntity},
+		{"failed", "POST", "/events/new_site_server", "secret", "flaky", http.StatusServiceUnavailable},
+		{"unknown queue", "POST", "/events/del_site_server", "secret", "ok", http.StatusNotFound},
+		{"no token", "POST", "/events/new_site_server", "", "ok", http.StatusUnauthorized},
+		{"get", "GET", "/events/new_site_server", "secret", "", http.StatusMethodNotAllowed},
+		{"too large", "POST", "/events/new_site_server", "secret", strings.Repeat("x", maxEventSize+1), http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+			if tt.token != "" {
+				r.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			r.Header.Set("X-Message-Id", "m1")
+			r.Header.Set("X-Signature", "k1:abc")
+			rw := httptest.NewRecorder()
+			w.ServeHTTP(rw, r)
+			if rw.Code != tt.want {
+				t.Errorf("status = %d, want %d", rw.Code, tt.want)
+			}
+		})
+	}
+
+	if got.MessageId != "m1" || got.Headers["x-signature"] != "k1:abc" || got.Headers["authorization"] != nil {
+		t.Errorf("delivery = %+v, want the message id and headers but for Authorization", got)
+	}
+}
+
+func TestWebhookShutdown(t *testing.T) {
+	w := NewWebhook(":0", "", func(amqp.Delivery) string { return "site:7" }, log.NewNopLogger())
+	started := make(chan struct{})
+	w.Register("new_site_server", func(ctx context.Context, d amqp.Delivery) error {
+		close(started)
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	if err := w.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Check(); err != nil {
+		t.Fatalf("Check() = %v, want nil", err)
+	}
+
+	codes := make(chan int)
+	go func() {
+		rw := httptest.NewRecorder()
+		w.ServeHTTP(rw, httptest.NewRequest("POST", "/events/new_site_server", strings.NewReader("{}")))
+		codes <- rw.Code
+	}()
+	<-started
+
+	err := w.Shutdown(10 * time.Millisecond)
+	if err == nil || err.Error() != "abandoned 1 events" {
+		t.Errorf("Shutdown() = %v, want 1 event abandoned", err)
+	}
+	if code := <-codes; code != http.StatusServiceUnavailable {
+		t.Errorf("abandoned event status = %d, want %d", code, http.StatusServiceUnavailable)
+	}
+	if w.Check() == nil {
+		t.Error("Check() = nil after shutdown")
+	}
+	rw := httptest.NewRecorder()
+	w.ServeHTTP(rw, httptest.NewRequest("POST", "/events/new_site_server", strings.NewReader("{}")))
+	if rw.Code != http.StatusServiceUnavailable || rw.Header().Get("Retry-After") == "" {
+		t.Errorf("status after shutdown = %d, Retry-After %q, want 503 with Retry-After", rw.Code, rw.Header().Get("Retry-After"))
+	}
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"flag"
+	"github.com/ericchiang/k8s"
+	"github.com/go-kit/kit/log"
+	"github.com/seagullbird/headr-k8s-helper/client"
+	"os"
+)
+
+// runCRD implements `k8s-helper crd`, printing the HeadrSite CustomResourceDefinition operator mode needs.
+func runCRD(args []string, logger log.Logger) int {
+	fs := flag.NewFlagSet("crd", flag.ContinueOnError)
+	format := fs.String("o", "yaml", "output format: yaml or json")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	out, err := client.RenderObjects([]k8s.Resource{client.HeadrSiteCRD()}, *format)
+	if err != nil {
+		logger.Log("error_desc", "failed to render the CustomResourceDefinition", "error", err)
+		return 1
+	}
+	os.Stdout.Write(out)
+	return 0
+}
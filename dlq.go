@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/go-kit/kit/log"
+	"github.com/seagullbird/headr-k8s-helper/config"
+	"github.com/seagullbird/headr-k8s-helper/consumer"
+	"github.com/seagullbird/headr-k8s-helper/schema"
+	"github.com/streadway/amqp"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"text/tabwriter"
+	"time"
+)
+
+// siteQueues are the queues serve consumes.
+var siteQueues = []string{"new_site_server", "del_site_server", "del_user_sites"}
+
+// deadLetter is a dead-lettered site event, as `dlq list` shows it.
+type deadLetter struct {
+	Queue     string `json:"queue"`
+	MessageID string `json:"message_id,omitempty"`
+	Error     string `json:"error"`
+	Permanent bool   `json:"permanent"`
+	Retries   int    `json:"retries"`
+	FailedAt  string `json:"failed_at,omitempty"`
+	// Event is nil when the body doesn't decode
+	Event *schema.Site `json:"event"`
+	Body  string       `json:"body"`
+}
+
+func newDeadLetter(queue string, d amqp.Delivery) deadLetter {
+	letter := deadLetter{
+		Queue:     queue,
+		MessageID: d.MessageId,
+		Retries:   consumer.Retries(d.Headers),
+		Body:      string(d.Body),
+	}
+	letter.Error, _ = d.Headers[consumer.HeaderError].(string)
+	letter.Permanent, _ = d.Headers[consumer.HeaderPermanent].(bool)
+	if t, ok := d.Headers[consumer.HeaderFailedAt].(time.Time); ok {
+		letter.FailedAt = t.UTC().Format(time.RFC3339)
+	}
+	if event, _ := schema.Decode(d, 0); event.SchemaVersion != 0 {
+		letter.Event = &event
+	}
+	return letter
+}
+
+// runDLQ implements `k8s-helper dlq list|replay|purge`, working the dead-lettered site events.
+// Every replayed or purged event is audit logged.
+func runDLQ(args []string, logger log.Logger) int {
+	if len(args) < 1 {
+		fmt.Fprintln(os.Stderr, "usage: k8s-helper dlq list|replay|purge [flags]")
+		return 2
+	}
+	fs := flag.NewFlagSet("dlq "+args[0], flag.ContinueOnError)
+	var (
+		queue     = fs.String("queue", "", "site queue whose dead letters to work on; all of them when empty")
+		format    = fs.String("o", "table", "output format: table or json (list)")
+		all       = fs.Bool("all", false, "select every dead letter (replay, purge)")
+		siteID    = fs.Uint("site", 0, "select the dead letters of a site (replay, purge)")
+		messageID = fs.String("message-id", "", "select a dead letter by message ID (replay, purge)")
+		edit      = fs.Bool("edit", false, "edit each selected event in $EDITOR before replaying it, not with HEADR_SIGNING_KEYS as it breaks the signature (replay)")
+		reason    = fs.String("reason", "", "why, recorded in the audit log (replay, purge)")
+	)
+	if err := fs.Parse(args[1:]); err != nil {
+		return 2
+	}
+	if *edit && config.SigningKeys != "" {
+		fmt.Fprintln(os.Stderr, "dlq replay -edit can't be used with HEADR_SIGNING_KEYS: edited events would fail their signature check")
+		return 2
+	}
+	queues := siteQueues
+	if *queue != "" {
+		queues = []string{*queue}
+	}
+
+	var (
+		letters = []deadLetter{}
+		action  = consumer.Keep
+	)
+	switch args[0] {
+	case "list":
+	case "replay", "purge":
+		if !*all && *siteID == 0 && *messageID == "" {
+			fmt.Fprintf(os.Stderr, "dlq %s needs -all, -site or -message-id\n", args[0])
+			return 2
+		}
+		action = consumer.Drop
+		if args[0] == "replay" {
+			action = consumer.Replay
+		}
+	default:
+		fmt.Fprintf(os.Stderr, "unknown dlq command %q\n", args[0])
+		return 2
+	}
+
+	mqc := newMQClient()
+	if err := mqc.Connect(); err != nil {
+		logger.Log("error_desc", "failed to connect to RabbitMQ", "error", err)
+		return 1
+	}
+	defer mqc.Close()
+
+	audit := log.With(logger, "audit", "dlq "+args[0], "operator", os.Getenv("USER"), "reason", *reason)
+	settled := 0
+	for _, q := range queues {
+		q := q
+		visit := func(d *amqp.Delivery) (consumer.Action, error) {
+			letter := newDeadLetter(q, *d)
+			if action == consumer.Keep {
+				letters = append(letters, letter)
+				return consumer.Keep, nil
+			}
+			if !*all && !matches(letter, *siteID, *messageID) {
+				return consumer.Keep, nil
+			}
+			if *edit && action == consumer.Replay {
+				body, err := editBody(*d)
+				if err != nil {
+					return consumer.Keep, err
+				}
+				d.Body = body
+			}
+			return action, nil
+		}
+		done := func(d amqp.Delivery, action consumer.Action) {
+			settled++
+			letter := newDeadLetter(q, d)
+			keyvals := []interface{}{"queue", q, "message_id", d.MessageId, "error", letter.Error, "body", letter.Body}
+			if letter.Event != nil {
+				keyvals = append(keyvals, "user_id", letter.Event.UserID, "site_id", letter.Event.SiteID)
+			}
+			audit.Log(keyvals...)
+		}
+
+		// Walk gets a channel of its own, as the broker closes a channel on a missing queue
+		ch, err := mqc.Connection().Channel()
+		if err != nil {
+			logger.Log("error_desc", "failed to open channel", "error", err)
+			return 1
+		}
+		err = consumer.Walk(ch, q, visit, done)
+		ch.Close()
+		if e, ok := err.(*amqp.Error); ok && e.Code == amqp.NotFound {
+			// Nothing has been dead-lettered on q yet
+			logger.Log("info", "no dead-letter queue, skipping it", "queue", q)
+			continue
+		}
+		if err != nil {
+			logger.Log("error_desc", "dlq "+args[0]+" failed", "queue", q, "error", err)
+			return 1
+		}
+	}
+
+	switch args[0] {
+	case "list":
+		if err := printDeadLetters(letters, *format); err != nil {
+			logger.Log("error_desc", "failed to print dead letters", "error", err)
+			return 1
+		}
+	case "replay":
+		fmt.Printf("replayed %d dead letters\n", settled)
+	case "purge":
+		fmt.Printf("purged %d dead letters\n", settled)
+	}
+	return 0
+}
+
+// matches reports whether a dead letter is of the site or has the message ID, when they're set.
+func matches(letter deadLetter, siteID uint, messageID string) bool {
+	if messageID != "" && letter.MessageID != messageID {
+		return false
+	}
+	if siteID != 0 && (letter.Event == nil || letter.Event.SiteID != siteID) {
+		return false
+	}
+	return true
+}
+
+// editBody opens the body of a delivery in $EDITOR, vi by default, and returns it once it's saved as a valid event.
+func editBody(d amqp.Delivery) ([]byte, error) {
+	body := d.Body
+	f, err := ioutil.TempFile("", "dead-letter-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(f.Name())
+	var indented bytes.Buffer
+	if json.Indent(&indented, body, "", "  ") == nil {
+		body = indented.Bytes()
+	}
+	if _, err := f.Write(body); err != nil {
+		f.Close()
+		return nil, err
+	}
+	f.Close()
+
+	editor := os.Getenv("EDITOR")
+	if editor == "" {
+		editor = "vi"
+	}
+	cmd := exec.Command(editor, f.Name())
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if err := cmd.Run(); err != nil {
+		return nil, err
+	}
+	edited, err := ioutil.ReadFile(f.Name())
+	if err != nil {
+		return nil, err
+	}
+	if _, err := schema.Decode(amqp.Delivery{ContentType: d.ContentType, Body: edited}, 0); err != nil {
+		return nil, fmt.Errorf("edited event: %v", err)
+	}
+	var compact bytes.Buffer
+	if err := json.Compact(&compact, edited); err != nil {
+		return nil, err
+	}
+	return compact.Bytes(), nil
+}
+
+// printDeadLetters prints dead letters as JSON or as a table.
+func printDeadLetters(letters []deadLetter, format string) error {
+	switch format {
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(letters)
+	case "table":
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "QUEUE\tMESSAGE ID\tUSER\tSITE\tRETRIES\tPERMANENT\tFAILED AT\tERROR")
+		for _, l := range letters {
+			user, site := "-", "-"
+			if l.Event != nil {
+				user, site = fmt.Sprint(l.Event.UserID), fmt.Sprint(l.Event.SiteID)
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%v\t%s\t%s\n",
+				l.Queue, l.MessageID, user, site, l.Retries, l.Permanent, l.FailedAt, l.Error)
+		}
+		return w.Flush()
+	}
+	return fmt.Errorf("unknown format %q, want table or json", format)
+}
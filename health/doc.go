@@ -0,0 +1,2 @@
+// Package health serves the liveness and readiness endpoints probed by Kubernetes
+package health
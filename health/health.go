@@ -0,0 +1,45 @@
+package health
+
+import (
+	"net/http"
+	"sort"
+)
+
+// A Check reports why a dependency is unusable, or nil when it is fine.
+type Check func() error
+
+// NewHandler serves /healthz from the live checks and /readyz from the ready checks.
+// Either answers 200 when all of its checks pass and 503 otherwise, with one line per check.
+func NewHandler(live, ready map[string]Check) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/healthz", handler(live))
+	mux.Handle("/readyz", handler(ready))
+	return mux
+}
+
+func handler(checks map[string]Check) http.HandlerFunc {
+	names := make([]string, 0, len(checks))
+	for name := range checks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		code := http.StatusOK
+		body := ""
+		for _, name := range names {
+			if err := checks[name](); err != nil {
+				code = http.StatusServiceUnavailable
+				body += name + ": " + err.Error() + "\n"
+			} else {
+				body += name + ": ok\n"
+			}
+		}
+		if body == "" {
+			body = "ok\n"
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(code)
+		w.Write([]byte(body))
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"github.com/go-kit/kit/log"
+	kitmetrics "github.com/go-kit/kit/metrics"
+	"github.com/seagullbird/headr-k8s-helper/client"
+	"github.com/seagullbird/headr-k8s-helper/consumer"
+	"github.com/seagullbird/headr-k8s-helper/metrics"
+	"github.com/seagullbird/headr-k8s-helper/tracing"
+	"github.com/streadway/amqp"
+	"sync"
+	"time"
+)
+
+// instrument turns a handler into a consumer handler that counts, times and traces the queue's events.
+// The span continues the trace the publisher put in the delivery headers, if any.
+func instrument(queue string, h handler) consumer.Handler {
+	return func(ctx context.Context, delivery amqp.Delivery) error {
+		metrics.EventsReceived.With("queue", queue).Add(1)
+		defer kitmetrics.NewTimer(metrics.EventDuration.With("queue", queue)).ObserveDuration()
+
+		ctx = tracing.ContextWithRemote(ctx, tracing.Extract(delivery.Headers))
+		span, ctx := tracing.StartSpan(ctx, "consume "+queue, tracing.KindConsumer)
+		span.SetTag("amqp.queue", queue)
+		if delivery.MessageId != "" {
+			span.SetTag("amqp.message_id", delivery.MessageId)
+		}
+		defer span.Finish()
+
+		err := h(ctx, delivery)
+		if err != nil {
+			metrics.EventsFailed.With("queue", queue).Add(1)
+			span.SetError(err)
+		}
+		return err
+	}
+}
+
+// background runs the work that outlives the events starting it, such as watching a new site become ready,
+// until serve shuts down.
+type background struct {
+	ctx context.Context
+	wg  sync.WaitGroup
+}
+
+// newBackground returns a background whose work stops when ctx is done.
+func newBackground(ctx context.Context) *background {
+	return &background{ctx: ctx}
+}
+
+// Go runs f in a goroutine with the background's context.
+func (b *background) Go(f func(ctx context.Context)) {
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+		f(b.ctx)
+	}()
+}
+
+// Wait waits for the work started with Go to return, which it does soon after the background's context is done.
+func (b *background) Wait() {
+	b.wg.Wait()
+}
+
+// observeProvisioning waits for a new site's deployment to become ready, then moves the site to Ready and records
+// the time since sitemgr received the site, given in Unix seconds. The site is Failed if it doesn't become ready,
+// and left as it is when ctx is done first.
+func observeProvisioning(ctx context.Context, c client.Client, siteID uint, receivedOn int64, logger log.Logger) {
+	const (
+		interval = 2 * time.Second
+		timeout  = 10 * time.Minute
+	)
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		status, err := c.DescribeSite(ctx, siteID)
+		switch {
+		case err == nil && status.ReadyReplicas > 0:
+			moveSite(ctx, c, siteID, client.StateReady, logger)
+			if receivedOn > 0 {
+				metrics.ProvisioningDuration.Observe(time.Since(time.Unix(receivedOn, 0)).Seconds())
+			}
+			return
+		case err != nil && err != client.ErrSiteNotFound && ctx.Err() == nil:
+			logger.Log("error_desc", "Failed to describe site", "site_id", siteID, "error", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-deadline.C:
+			logger.Log("error_desc", "Site did not become ready", "site_id", siteID, "timeout", timeout)
+			moveSite(ctx, c, siteID, client.StateFailed, logger)
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// resumeProvisioning watches the sites an earlier run left Provisioning, as it stopped before they became ready,
+// so they still move to Ready or Failed.
+func resumeProvisioning(c client.Client, bg *background, logger log.Logger) {
+	bg.Go(func(ctx context.Context) {
+		statuses, err := c.ListSites(ctx)
+		if err != nil {
+			logger.Log("error_desc", "Failed to list sites to resume provisioning", "error", err)
+			return
+		}
+		for _, status := range statuses {
+			siteID := status.SiteID
+			state, err := c.SiteState(ctx, siteID)
+			if err != nil {
+				logger.Log("error_desc", "Failed to get site state", "site_id", siteID, "error", err)
+				continue
+			}
+			if state != client.StateProvisioning {
+				continue
+			}
+			logger.Log("info", "Resuming provisioning", "site_id", siteID)
+			bg.Go(func(ctx context.Context) {
+				observeProvisioning(ctx, c, siteID, 0, logger)
+			})
+		}
+	})
+}
+
+// countSites refreshes the managed site gauge every interval until ctx is done.
+func countSites(ctx context.Context, c client.Client, interval time.Duration, logger log.Logger) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		statuses, err := c.ListSites(ctx)
+		if err != nil && ctx.Err() == nil {
+			logger.Log("error_desc", "Failed to count managed sites", "error", err)
+		} else if err == nil {
+			metrics.ManagedSites.Set(float64(len(statuses)))
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -1,46 +1,333 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
 	"github.com/go-kit/kit/log"
-	"github.com/seagullbird/headr-common/mq"
-	"github.com/seagullbird/headr-common/mq/receive"
+	"github.com/seagullbird/headr-common/mq/dispatch"
 	"github.com/seagullbird/headr-k8s-helper/client"
+	"github.com/seagullbird/headr-k8s-helper/config"
+	"github.com/seagullbird/headr-k8s-helper/consumer"
+	"github.com/seagullbird/headr-k8s-helper/metrics"
+	"github.com/seagullbird/headr-k8s-helper/schema"
+	"github.com/seagullbird/headr-k8s-helper/signing"
 	"github.com/streadway/amqp"
+	"strconv"
+	"sync"
 )
 
-func makeNewSiteServerListener(c client.Client, logger log.Logger) receive.Listener {
-	return func(delivery amqp.Delivery) {
-		var event mq.SiteUpdatedEvent
-		err := json.Unmarshal(delivery.Body, &event)
+// A handler consumes one delivery and returns an error when it couldn't be handled, see consumer.Handler.
+// ctx carries the span of the delivery.
+type handler func(ctx context.Context, delivery amqp.Delivery) error
+
+// siteRefusedEvent is published to the site_refused queue when a new site is not provisioned.
+type siteRefusedEvent struct {
+	UserID     uint   `json:"user_id"`
+	SiteID     uint   `json:"site_id"`
+	Reason     string `json:"reason"`
+	Limit      int    `json:"limit"`
+	Count      int    `json:"count"`
+	ReceivedOn int64  `json:"received_on"`
+}
+
+// siteKey keys a delivery by its site, so the events of a site are handled in order, or by its user for del_user_sites.
+// Deliveries that don't decode share a key.
+func siteKey(delivery amqp.Delivery) string {
+	// invalid events still have a key, only those that don't decode have no version
+	event, _ := schema.Decode(delivery, 0)
+	if event.SchemaVersion == 0 {
+		return ""
+	}
+	if event.SiteID == 0 {
+		return "user:" + strconv.Itoa(int(event.UserID))
+	}
+	return "site:" + strconv.Itoa(int(event.SiteID))
+}
+
+// userLocks serialize the quota check and creation of a new site with the other work on its user's sites
+// that spans sites, which runs in parallel under siteKey. Users share a lock when their IDs collide.
+var userLocks [64]sync.Mutex
+
+func lockUser(userID uint) func() {
+	l := &userLocks[userID%uint(len(userLocks))]
+	l.Lock()
+	return l.Unlock
+}
+
+func makeNewSiteServerListener(c client.Client, dispatcher dispatch.Dispatcher, bg *background, logger log.Logger) handler {
+	return func(ctx context.Context, delivery amqp.Delivery) error {
+		event, err := decode(delivery, schema.NeedSite|schema.NeedUser, logger)
 		if err != nil {
-			logger.Log("error_desc", "Failed to unmarshal event", "error", err, "raw-message:", delivery.Body)
-			return
+			return err
 		}
 		logger.Log("info", "Received newsite event", "event", event)
+		defer lockUser(event.UserID)()
 
-		// Create caddy service
-		err = c.CreateCaddyService(event.SiteID)
-		if err != nil {
-			logger.Log("error_desc", "Failed to create caddy service", "error", err)
+		// Skip the event if it was applied already, or the site or user was deleted since
+		applied := client.AppliedEvent{ReceivedOn: event.ReceivedOn, EventID: eventID("new_site_server", delivery, event)}
+		if skip, err := superseded(ctx, c, applied, logger, client.SiteKey(event.SiteID), client.UserKey(event.UserID)); skip || err != nil {
+			return err
 		}
+
+		_, err = createSite(ctx, c, dispatcher, bg, event, nil, applied, logger)
+		return permanentIfIllegal(err)
 	}
 }
 
-func makeDelSiteServerListener(c client.Client, logger log.Logger) receive.Listener {
-	return func(delivery amqp.Delivery) {
-		var event mq.SiteUpdatedEvent
-		err := json.Unmarshal(delivery.Body, &event)
+func makeDelSiteServerListener(c client.Client, logger log.Logger) handler {
+	return func(ctx context.Context, delivery amqp.Delivery) error {
+		event, err := decode(delivery, schema.NeedSite, logger)
 		if err != nil {
-			logger.Log("error_desc", "Failed to unmarshal event", "error", err, "raw-message:", delivery.Body)
-			return
+			return err
 		}
 		logger.Log("info", "Received delsite event", "event", event)
 
-		// Delete caddy service
-		err = c.DeleteCaddyService(event.SiteID)
+		// Skip the event if it was applied already, or the site was created again since
+		applied := client.AppliedEvent{ReceivedOn: event.ReceivedOn, EventID: eventID("del_site_server", delivery, event)}
+		if skip, err := superseded(ctx, c, applied, logger, client.SiteKey(event.SiteID)); skip || err != nil {
+			return err
+		}
+
+		return permanentIfIllegal(deleteSite(ctx, c, event.SiteID, applied, logger))
+	}
+}
+
+func makeDelUserSitesListener(c client.Client, logger log.Logger) handler {
+	return func(ctx context.Context, delivery amqp.Delivery) error {
+		event, err := decode(delivery, schema.NeedUser, logger)
+		if err != nil {
+			return err
+		}
+		logger.Log("info", "Received deluser event", "event", event)
+		defer lockUser(event.UserID)()
+
+		// Skip the event if it was applied already
+		applied := client.AppliedEvent{ReceivedOn: event.ReceivedOn, EventID: eventID("del_user_sites", delivery, event)}
+		if skip, err := superseded(ctx, c, applied, logger, client.UserKey(event.UserID)); skip || err != nil {
+			return err
+		}
+
+		// Delete every caddy service of the user
+		results, err := c.DeleteUserSites(ctx, event.UserID)
+		if err != nil {
+			logger.Log("error_desc", "Failed to delete user sites", "user_id", event.UserID, "error", err)
+			return err
+		}
+		// The sites are only known once deleted, so they go through Deleting afterwards
+		failed := 0
+		for _, r := range results {
+			moveSite(ctx, c, r.SiteID, client.StateDeleting, logger)
+			if r.Err != nil {
+				failed++
+				logger.Log("error_desc", "Failed to delete caddy service", "user_id", event.UserID, "site_id", r.SiteID, "error", r.Err)
+				moveSite(ctx, c, r.SiteID, client.StateFailed, logger)
+				continue
+			}
+			logger.Log("info", "Deleted caddy service", "user_id", event.UserID, "site_id", r.SiteID)
+			moveSite(ctx, c, r.SiteID, client.StateDeleted, logger)
+		}
+		logger.Log("info", "Finished deleting user sites", "user_id", event.UserID, "sites", len(results), "failed", failed)
+		if failed > 0 {
+			return fmt.Errorf("failed to delete %d of %d sites", failed, len(results))
+		}
+		recordApplied(ctx, c, client.UserKey(event.UserID), applied, logger)
+		return nil
+	}
+}
+
+// createSite provisions a new site, served on domains too, within its user's site quota, moves it through its
+// lifecycle, records applied in the ledger and watches the site become ready in bg; it's what new_site_server and
+// the admin API do. It reports
+// whether the site was refused, once the refusal is published to dispatcher. The caller holds the user's lock.
+func createSite(ctx context.Context, c client.Client, dispatcher dispatch.Dispatcher, bg *background, event schema.Site, domains []string, applied client.AppliedEvent, logger log.Logger) (bool, error) {
+	// Enforce the user's site quota; the site itself doesn't count when an earlier attempt created it
+	count, err := c.CountUserSites(ctx, event.UserID, event.SiteID)
+	if err != nil {
+		logger.Log("error_desc", "Failed to count user sites", "error", err)
+		return false, err
+	}
+	if refused, err := overQuota(event, count, dispatcher, logger); refused || err != nil {
+		return refused, err
+	}
+
+	if err := setState(ctx, c, event.SiteID, client.StatePending, logger); err != nil {
+		return false, err
+	}
+	if err := setState(ctx, c, event.SiteID, client.StateProvisioning, logger); err != nil {
+		return false, err
+	}
+
+	// Create caddy service
+	err = c.CreateCaddyService(ctx, client.Site{
+		UserID:  event.UserID,
+		SiteID:  event.SiteID,
+		Plan:    event.Plan,
+		Theme:   event.Theme,
+		Domains: domains,
+	})
+	if err != nil {
+		logger.Log("error_desc", "Failed to create caddy service", "error", err)
+		setState(ctx, c, event.SiteID, client.StateFailed, logger)
+		return false, err
+	}
+	recordApplied(ctx, c, client.SiteKey(event.SiteID), applied, logger)
+	if !config.DryRun {
+		bg.Go(func(ctx context.Context) {
+			observeProvisioning(ctx, c, event.SiteID, event.ReceivedOn, logger)
+		})
+	}
+	return false, nil
+}
+
+// deleteSite deletes a site, moves it through its lifecycle and records applied in the ledger;
+// it's what del_site_server and the admin API do.
+func deleteSite(ctx context.Context, c client.Client, siteID uint, applied client.AppliedEvent, logger log.Logger) error {
+	if err := setState(ctx, c, siteID, client.StateDeleting, logger); err != nil {
+		return err
+	}
+
+	// Delete caddy service
+	if err := c.DeleteCaddyService(ctx, siteID); err != nil {
+		logger.Log("error_desc", "Failed to delete caddy service", "error", err)
+		setState(ctx, c, siteID, client.StateFailed, logger)
+		return err
+	}
+	setState(ctx, c, siteID, client.StateDeleted, logger)
+	recordApplied(ctx, c, client.SiteKey(siteID), applied, logger)
+	return nil
+}
+
+// overQuota reports whether a new site is over its user's site quota, given the user's count of sites,
+// and publishes the refusal to the site_refused queue when it is, unless dispatcher is nil because the caller
+// reports the refusal itself.
+func overQuota(event schema.Site, count int, dispatcher dispatch.Dispatcher, logger log.Logger) (bool, error) {
+	limit := config.SiteLimit(event.Plan)
+	if count < limit {
+		return false, nil
+	}
+	logger.Log("error_desc", "Site quota exceeded, refusing new site", "user_id", event.UserID, "site_id", event.SiteID, "count", count, "limit", limit)
+	refusal := siteRefusedEvent{
+		UserID:     event.UserID,
+		SiteID:     event.SiteID,
+		Reason:     "site_quota_exceeded",
+		Limit:      limit,
+		Count:      count,
+		ReceivedOn: event.ReceivedOn,
+	}
+	if dispatcher == nil {
+		return true, nil
+	}
+	if err := dispatcher.DispatchMessage("site_refused", refusal); err != nil {
+		logger.Log("error_desc", "Failed to publish site refusal", "error", err)
+		return true, err
+	}
+	return true, nil
+}
+
+// moveSite moves a site to a lifecycle state. A move the lifecycle doesn't allow, such as creating a site that is
+// being deleted, is a permanent error; moves made once the work is done only log their errors.
+func moveSite(ctx context.Context, c client.Client, siteID uint, to client.SiteState, logger log.Logger) error {
+	return permanentIfIllegal(setState(ctx, c, siteID, to, logger))
+}
+
+// setState is moveSite for callers other than the listeners: a move the lifecycle doesn't allow is returned as the
+// client.IllegalTransitionError.
+func setState(ctx context.Context, c client.Client, siteID uint, to client.SiteState, logger log.Logger) error {
+	err := c.SetSiteState(ctx, siteID, to)
+	if _, illegal := err.(client.IllegalTransitionError); illegal {
+		logger.Log("error_desc", "Rejected site state change", "site_id", siteID, "error", err)
+	} else if err != nil {
+		logger.Log("error_desc", "Failed to set site state", "site_id", siteID, "state", to, "error", err)
+	}
+	return err
+}
+
+// permanentIfIllegal marks a move the lifecycle doesn't allow as a permanent error, so the event asking for it
+// is dead-lettered.
+func permanentIfIllegal(err error) error {
+	if _, illegal := err.(client.IllegalTransitionError); illegal {
+		return consumer.Permanent(err)
+	}
+	return err
+}
+
+// decode decodes and validates the site event of a delivery. An invalid event is a permanent error,
+// so it's dead-lettered with the reason.
+func decode(delivery amqp.Delivery, need schema.Need, logger log.Logger) (schema.Site, error) {
+	event, err := schema.Decode(delivery, need)
+	if err != nil {
+		reason := "malformed"
+		if invalid, ok := err.(schema.InvalidError); ok {
+			reason = invalid.Reason
+		}
+		metrics.EventsRejected.With("reason", reason).Add(1)
+		logger.Log("error_desc", "Rejected invalid event", "reason", reason, "error", err, "raw-message:", delivery.Body)
+		return event, consumer.Permanent(err)
+	}
+	return event, nil
+}
+
+// verified rejects deliveries to queue without a valid signature of keys, before h sees them.
+// Rejected deliveries are dead-lettered.
+func verified(keys *signing.Keyring, queue string, h handler, logger log.Logger) handler {
+	return func(ctx context.Context, delivery amqp.Delivery) error {
+		if err := keys.Verify(queue, delivery.Headers, delivery.Body); err != nil {
+			reason := "bad_signature"
+			if verr, ok := err.(signing.VerifyError); ok {
+				reason = verr.Reason
+			}
+			metrics.EventsRejected.With("reason", reason).Add(1)
+			logger.Log("error_desc", "Rejected event without a valid signature", "queue", queue, "message_id", delivery.MessageId, "error", err)
+			return consumer.Permanent(err)
+		}
+		return h(ctx, delivery)
+	}
+}
+
+// eventID identifies an event of a queue for duplicate detection: by the ID it carries, the message ID,
+// or a hash of the queue and body without either, since a site's create and delete events can have the same body.
+func eventID(queue string, delivery amqp.Delivery, event schema.Site) string {
+	if event.EventID != "" {
+		return event.EventID
+	}
+	if delivery.MessageId != "" {
+		return delivery.MessageId
+	}
+	sum := sha256.Sum256(append([]byte(queue+"\n"), delivery.Body...))
+	return hex.EncodeToString(sum[:16])
+}
+
+// superseded reports whether an event must be skipped because it is the last event applied to one of the ledger keys,
+// or because a later event was. Events without received_on are only checked for duplicates.
+func superseded(ctx context.Context, c client.Client, applied client.AppliedEvent, logger log.Logger, keys ...string) (bool, error) {
+	for _, key := range keys {
+		last, err := c.LastApplied(ctx, key)
 		if err != nil {
-			logger.Log("error_desc", "Failed to delete caddy service", "error", err)
+			logger.Log("error_desc", "Failed to read event ledger", "key", key, "error", err)
+			return false, err
 		}
+		reason := ""
+		switch {
+		case last.EventID == applied.EventID:
+			reason = "duplicate"
+		case applied.ReceivedOn != 0 && applied.ReceivedOn < last.ReceivedOn:
+			reason = "stale"
+		default:
+			continue
+		}
+		metrics.EventsSkipped.With("reason", reason).Add(1)
+		logger.Log("info", "Skipping "+reason+" event", "key", key, "event_id", applied.EventID, "received_on", applied.ReceivedOn, "last_event_id", last.EventID, "last_received_on", last.ReceivedOn)
+		return true, nil
+	}
+	return false, nil
+}
+
+// recordApplied records an applied event in the ledger. A failure is only logged:
+// the event's work is done, and the ledger only guards against replays.
+func recordApplied(ctx context.Context, c client.Client, key string, applied client.AppliedEvent, logger log.Logger) {
+	if err := c.RecordApplied(ctx, key, applied); err != nil {
+		logger.Log("error_desc", "Failed to record applied event", "key", key, "event_id", applied.EventID, "error", err)
 	}
 }
@@ -0,0 +1,676 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/go-kit/kit/log"
+	"github.com/seagullbird/headr-k8s-helper/admin"
+	"github.com/seagullbird/headr-k8s-helper/client"
+	"github.com/seagullbird/headr-k8s-helper/client/fake"
+	"github.com/seagullbird/headr-k8s-helper/config"
+	"github.com/seagullbird/headr-k8s-helper/consumer"
+	"github.com/seagullbird/headr-k8s-helper/schema"
+	"github.com/seagullbird/headr-k8s-helper/signing"
+	"github.com/streadway/amqp"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingDispatcher keeps the messages dispatched to it.
+type recordingDispatcher struct {
+	queues   []string
+	messages []interface{}
+	err      error
+}
+
+func (d *recordingDispatcher) DispatchMessage(queueName string, message interface{}) error {
+	if d.err != nil {
+		return d.err
+	}
+	d.queues = append(d.queues, queueName)
+	d.messages = append(d.messages, message)
+	return nil
+}
+
+// siteState is the objects of a site, as reported by fake.Client.State.
+type siteState struct {
+	deployment, service, ingress bool
+}
+
+var (
+	complete = siteState{true, true, true}
+	absent   = siteState{}
+	errBoom  = errors.New("boom")
+)
+
+func TestNewSiteServerListener(t *testing.T) {
+	tests := []struct {
+		name    string
+		setup   func(c *fake.Client, d *recordingDispatcher)
+		body    string
+		wantErr bool
+		// wantPermanent is set when the error must dead-letter the event rather than retry it
+		wantPermanent bool
+		wantState     siteState
+		wantRefuse    bool
+	}{
+		{
+			name:      "creates the site",
+			body:      `{"user_id": 1, "site_id": 7, "received_on": 1}`,
+			wantState: complete,
+		},
+		{
+			name:          "malformed json",
+			body:          `{"user_id": 1, "site_id": 7`,
+			wantErr:       true,
+			wantPermanent: true,
+			wantState:     absent,
+		},
+		{
+			name:          "wrong field types",
+			body:          `{"user_id": "one", "site_id": 7}`,
+			wantErr:       true,
+			wantPermanent: true,
+			wantState:     absent,
+		},
+		{
+			name:          "site 0",
+			body:          `{"user_id": 1, "site_id": 0}`,
+			wantErr:       true,
+			wantPermanent: true,
+			wantState:     absent,
+		},
+		{
+			name: "duplicate event",
+			setup: func(c *fake.Client, d *recordingDispatcher) {
+				c.AddSite(client.Site{UserID: 1, SiteID: 7})
+			},
+			body:      `{"user_id": 1, "site_id": 7}`,
+			wantState: complete,
+		},
+		{
+			name: "quota exceeded",
+			setup: func(c *fake.Client, d *recordingDispatcher) {
+				c.AddSite(client.Site{UserID: 1, SiteID: 1})
+				c.AddSite(client.Site{UserID: 1, SiteID: 2})
+			},
+			body:       `{"user_id": 1, "site_id": 7, "plan": "free"}`,
+			wantState:  absent,
+			wantRefuse: true,
+		},
+		{
+			name: "a retry doesn't count its own site",
+			setup: func(c *fake.Client, d *recordingDispatcher) {
+				c.AddSite(client.Site{UserID: 1, SiteID: 1})
+				c.AddSite(client.Site{UserID: 1, SiteID: 7})
+			},
+			body:      `{"user_id": 1, "site_id": 7, "plan": "free"}`,
+			wantState: complete,
+		},
+		{
+			name: "events without a plan get the default limit",
+			setup: func(c *fake.Client, d *recordingDispatcher) {
+				c.AddSite(client.Site{UserID: 1, SiteID: 1})
+				c.AddSite(client.Site{UserID: 1, SiteID: 2})
+			},
+			body:      `{"user_id": 1, "site_id": 7}`,
+			wantState: complete,
+		},
+		{
+			name: "larger plan lifts the quota",
+			setup: func(c *fake.Client, d *recordingDispatcher) {
+				c.AddSite(client.Site{UserID: 1, SiteID: 1})
+				c.AddSite(client.Site{UserID: 1, SiteID: 2})
+			},
+			body:      `{"user_id": 1, "site_id": 7, "plan": "pro"}`,
+			wantState: complete,
+		},
+		{
+			name: "refusal can't be published",
+			setup: func(c *fake.Client, d *recordingDispatcher) {
+				c.AddSite(client.Site{UserID: 1, SiteID: 1})
+				c.AddSite(client.Site{UserID: 1, SiteID: 2})
+				d.err = errBoom
+			},
+			body:      `{"user_id": 1, "site_id": 7, "plan": "free"}`,
+			wantErr:   true,
+			wantState: absent,
+		},
+		{
+			name: "counting sites fails",
+			setup: func(c *fake.Client, d *recordingDispatcher) {
+				c.Fail(fake.OpListDeployments, 0, errBoom)
+			},
+			body:      `{"user_id": 1, "site_id": 7}`,
+			wantErr:   true,
+			wantState: absent,
+		},
+		{
+			name: "deployment create fails",
+			setup: func(c *fake.Client, d *recordingDispatcher) {
+				c.Fail(fake.OpCreateDeployment, 7, errBoom)
+			},
+			body:      `{"user_id": 1, "site_id": 7}`,
+			wantErr:   true,
+			wantState: absent,
+		},
+		{
+			name: "service create fails after the deployment",
+			setup: func(c *fake.Client, d *recordingDispatcher) {
+				c.Fail(fake.OpCreateService, 7, errBoom)
+			},
+			body:      `{"user_id": 1, "site_id": 7}`,
+			wantErr:   true,
+			wantState: siteState{deployment: true},
+		},
+		{
+			name: "ingress update fails after the service",
+			setup: func(c *fake.Client, d *recordingDispatcher) {
+				c.Fail(fake.OpUpdateIngress, 0, errBoom)
+			},
+			body:      `{"user_id": 1, "site_id": 7}`,
+			wantErr:   true,
+			wantState: siteState{deployment: true, service: true},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, d := fake.New(), &recordingDispatcher{}
+			if tt.setup != nil {
+				tt.setup(c, d)
+			}
+			listener := makeNewSiteServerListener(c, d, stopped(), log.NewNopLogger())
+
+			err := listener(context.Background(), amqp.Delivery{Body: []byte(tt.body)})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("listener error = %v, want error: %v", err, tt.wantErr)
+			}
+			if consumer.IsPermanent(err) != tt.wantPermanent {
+				t.Errorf("listener error %v permanent = %v, want %v", err, consumer.IsPermanent(err), tt.wantPermanent)
+			}
+			if got := state(c, 7); got != tt.wantState {
+				t.Errorf("site state = %+v, want %+v", got, tt.wantState)
+			}
+			if refused := len(d.messages) > 0; refused != tt.wantRefuse {
+				t.Fatalf("refusal published = %v, want %v", refused, tt.wantRefuse)
+			}
+			if tt.wantRefuse {
+				refusal, ok := d.messages[0].(siteRefusedEvent)
+				if !ok || d.queues[0] != "site_refused" {
+					t.Fatalf("dispatched %T to %s, want siteRefusedEvent to site_refused", d.messages[0], d.queues[0])
+				}
+				if refusal.SiteID != 7 || refusal.Count != 2 || refusal.Limit != 2 {
+					t.Errorf("refusal = %+v, want site 7 with count 2 and limit 2", refusal)
+				}
+			}
+		})
+	}
+}
+
+func TestNewSiteServerListenerRedelivery(t *testing.T) {
+	c := fake.New()
+	listener := makeNewSiteServerListener(c, &recordingDispatcher{}, stopped(), log.NewNopLogger())
+	delivery := amqp.Delivery{Body: []byte(`{"user_id": 1, "site_id": 7}`)}
+
+	if err := listener(context.Background(), delivery); err != nil {
+		t.Fatalf("first delivery: %v", err)
+	}
+	// The redelivery is dropped as a duplicate rather than failing on the existing site
+	if err := listener(context.Background(), delivery); err != nil {
+		t.Fatalf("second delivery error = %v, want it skipped", err)
+	}
+	if got := state(c, 7); got != complete {
+		t.Errorf("site state = %+v, want %+v", got, complete)
+	}
+}
+
+func TestListenerRetries(t *testing.T) {
+	c := fake.New()
+	newSite := makeNewSiteServerListener(c, &recordingDispatcher{}, stopped(), log.NewNopLogger())
+	delSite := makeDelSiteServerListener(c, log.NewNopLogger())
+	created := amqp.Delivery{Body: []byte(`{"user_id": 1, "site_id": 7, "received_on": 1}`)}
+	deleted := amqp.Delivery{Body: []byte(`{"user_id": 1, "site_id": 7, "received_on": 2}`)}
+
+	// A retry completes the site the first attempt left half created
+	c.Fail(fake.OpCreateService, 7, errBoom)
+	if err := newSite(context.Background(), created); err == nil {
+		t.Fatal("create succeeded, want the service error")
+	}
+	c.Fail(fake.OpCreateService, 7, nil)
+	if err := newSite(context.Background(), created); err != nil {
+		t.Fatalf("create retry: %v", err)
+	}
+	if got := state(c, 7); got != complete {
+		t.Fatalf("site state after the create retry = %+v, want %+v", got, complete)
+	}
+
+	// and deletes the site the first attempt left half deleted
+	c.Fail(fake.OpDeleteService, 7, errBoom)
+	if err := delSite(context.Background(), deleted); err == nil {
+		t.Fatal("delete succeeded, want the service error")
+	}
+	c.Fail(fake.OpDeleteService, 7, nil)
+	if err := delSite(context.Background(), deleted); err != nil {
+		t.Fatalf("delete retry: %v", err)
+	}
+	if got := state(c, 7); got != absent {
+		t.Errorf("site state after the delete retry = %+v, want %+v", got, absent)
+	}
+}
+
+func TestSameBodyCreateAndDelete(t *testing.T) {
+	c := fake.New()
+	newSite := makeNewSiteServerListener(c, &recordingDispatcher{}, stopped(), log.NewNopLogger())
+	delSite := makeDelSiteServerListener(c, log.NewNopLogger())
+	// A version 1 event carries no ID or received_on, and its delete has the body of its create
+	delivery := amqp.Delivery{Body: []byte(`{"user_id": 1, "site_id": 7}`)}
+
+	if err := newSite(context.Background(), delivery); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if err := delSite(context.Background(), delivery); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if got := state(c, 7); got != absent {
+		t.Errorf("site state = %+v, want the delete applied rather than skipped as a duplicate", got)
+	}
+}
+
+func TestStaleEvents(t *testing.T) {
+	c, d := fake.New(), &recordingDispatcher{}
+	newSite := makeNewSiteServerListener(c, d, stopped(), log.NewNopLogger())
+	delSite := makeDelSiteServerListener(c, log.NewNopLogger())
+	delUser := makeDelUserSitesListener(c, log.NewNopLogger())
+	deliver := func(h handler, body string) {
+		t.Helper()
+		if err := h(context.Background(), amqp.Delivery{Body: []byte(body)}); err != nil {
+			t.Fatalf("%s: %v", body, err)
+		}
+	}
+
+	deliver(newSite, `{"user_id": 1, "site_id": 7, "received_on": 10}`)
+	deliver(delSite, `{"user_id": 1, "site_id": 7, "received_on": 20}`)
+	// The create arrives again after the delete, as a redelivery or out of order
+	deliver(newSite, `{"user_id": 1, "site_id": 7, "received_on": 15}`)
+	if got := state(c, 7); got != absent {
+		t.Fatalf("site 7 = %+v after a stale create, want it to stay deleted", got)
+	}
+	// A later create does recreate the site
+	deliver(newSite, `{"user_id": 1, "site_id": 7, "received_on": 30}`)
+	if got := state(c, 7); got != complete {
+		t.Fatalf("site 7 = %+v after a new create, want it created", got)
+	}
+
+	deliver(delUser, `{"user_id": 1, "received_on": 40}`)
+	deliver(newSite, `{"user_id": 1, "site_id": 8, "received_on": 35}`)
+	if got := state(c, 8); got != absent {
+		t.Errorf("site 8 = %+v after a create older than the user's deletion, want it skipped", got)
+	}
+}
+
+func TestAdminSites(t *testing.T) {
+	c := fake.New()
+	sites := adminSites{c: c, bg: stopped(), logger: log.NewNopLogger()}
+	newSite := makeNewSiteServerListener(c, &recordingDispatcher{}, stopped(), log.NewNopLogger())
+	ctx := context.Background()
+
+	if err := sites.CreateSite(ctx, client.Site{UserID: 1, SiteID: 7, Plan: "free", Domains: []string{"blog.example.com"}}); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if got, _ := c.SiteState(ctx, 7); got != client.StateProvisioning {
+		t.Errorf("state after create = %q, want %q", got, client.StateProvisioning)
+	}
+	if status, _ := c.DescribeSite(ctx, 7); !reflect.DeepEqual(status.Domains, []string{"blog.example.com"}) {
+		t.Errorf("domains = %v, want the requested ones", status.Domains)
+	}
+	if err := sites.DeleteSite(ctx, 7); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if got, _ := c.SiteState(ctx, 7); got != client.StateDeleted {
+		t.Errorf("state after delete = %q, want %q", got, client.StateDeleted)
+	}
+	// The deletion is in the ledger, so an older create event doesn't bring the site back
+	if err := newSite(ctx, amqp.Delivery{Body: []byte(`{"user_id": 1, "site_id": 7, "received_on": 1}`)}); err != nil {
+		t.Fatalf("stale create: %v", err)
+	}
+	if got := state(c, 7); got != absent {
+		t.Errorf("site 7 = %+v after a stale create, want it to stay deleted", got)
+	}
+
+	c.AddSite(client.Site{UserID: 2, SiteID: 8})
+	c.AddSite(client.Site{UserID: 2, SiteID: 9})
+	if err := sites.CreateSite(ctx, client.Site{UserID: 2, SiteID: 10, Plan: "free"}); err != admin.ErrQuotaExceeded {
+		t.Errorf("create over quota = %v, want %v", err, admin.ErrQuotaExceeded)
+	}
+	themes := config.Themes
+	defer func() { config.Themes = themes }()
+	config.Themes = "hyde"
+	if err := sites.CreateSite(ctx, client.Site{UserID: 3, SiteID: 12, Theme: "nope"}); err == nil {
+		t.Error("create with an unknown theme succeeded")
+	} else if _, invalid := err.(schema.InvalidError); !invalid {
+		t.Errorf("create with an unknown theme = %v, want a schema.InvalidError", err)
+	}
+	c.SetSiteState(ctx, 11, client.StateDeleting)
+	if err := sites.CreateSite(ctx, client.Site{UserID: 3, SiteID: 11}); err == nil {
+		t.Error("create of a site being deleted succeeded")
+	} else if _, illegal := err.(client.IllegalTransitionError); !illegal {
+		t.Errorf("create of a site being deleted = %v, want an IllegalTransitionError", err)
+	}
+}
+
+func TestSiteLifecycle(t *testing.T) {
+	c := fake.New()
+	newSite := makeNewSiteServerListener(c, &recordingDispatcher{}, stopped(), log.NewNopLogger())
+	delSite := makeDelSiteServerListener(c, log.NewNopLogger())
+	ctx := context.Background()
+
+	if err := newSite(ctx, amqp.Delivery{Body: []byte(`{"user_id": 1, "site_id": 7, "received_on": 10}`)}); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if state, _ := c.SiteState(ctx, 7); state != client.StateProvisioning && state != client.StateReady {
+		t.Errorf("state after create = %q, want Provisioning or Ready", state)
+	}
+
+	// A create while the site is being deleted is rejected for good
+	c.SetSiteState(ctx, 7, client.StateDeleting)
+	err := newSite(ctx, amqp.Delivery{Body: []byte(`{"user_id": 1, "site_id": 7, "received_on": 20}`)})
+	if !consumer.IsPermanent(err) || !strings.Contains(err.Error(), "can't move from Deleting to Pending") {
+		t.Fatalf("create during delete error = %v, want a permanent illegal transition", err)
+	}
+
+	if err := delSite(ctx, amqp.Delivery{Body: []byte(`{"user_id": 1, "site_id": 7, "received_on": 30}`)}); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if state, _ := c.SiteState(ctx, 7); state != client.StateDeleted {
+		t.Errorf("state after delete = %q, want %s", state, client.StateDeleted)
+	}
+
+	// A failed delete leaves the site Failed, from which it can be retried
+	c.AddSite(client.Site{UserID: 1, SiteID: 8})
+	c.Fail(fake.OpDeleteDeployment, 8, errBoom)
+	if err := delSite(ctx, amqp.Delivery{Body: []byte(`{"user_id": 1, "site_id": 8}`)}); err != errBoom {
+		t.Fatalf("delete error = %v, want %v", err, errBoom)
+	}
+	if state, _ := c.SiteState(ctx, 8); state != client.StateFailed {
+		t.Errorf("state after failed delete = %q, want %s", state, client.StateFailed)
+	}
+}
+
+func TestNewSiteServerListenerLedgerFailure(t *testing.T) {
+	c := fake.New()
+	c.Fail(fake.OpRecordApplied, 0, errBoom)
+	listener := makeNewSiteServerListener(c, &recordingDispatcher{}, stopped(), log.NewNopLogger())
+
+	// The site was created, so the event isn't retried when it can't be recorded
+	if err := listener(context.Background(), amqp.Delivery{Body: []byte(`{"user_id": 1, "site_id": 7}`)}); err != nil {
+		t.Fatalf("listener error = %v, want nil", err)
+	}
+	if got := state(c, 7); got != complete {
+		t.Errorf("site state = %+v, want %+v", got, complete)
+	}
+}
+
+func TestNewSiteServerListenerConcurrentQuota(t *testing.T) {
+	c, d := fake.New(), &recordingDispatcher{}
+	c.AddSite(client.Site{UserID: 1, SiteID: 1})
+	listener := makeNewSiteServerListener(c, d, stopped(), log.NewNopLogger())
+
+	// Different sites of one user are handled in parallel; only one of them fits the free plan
+	var wg sync.WaitGroup
+	for _, body := range []string{`{"user_id": 1, "site_id": 7, "plan": "free"}`, `{"user_id": 1, "site_id": 8, "plan": "free"}`} {
+		wg.Add(1)
+		go func(body string) {
+			defer wg.Done()
+			if err := listener(context.Background(), amqp.Delivery{Body: []byte(body)}); err != nil {
+				t.Errorf("listener error = %v", err)
+			}
+		}(body)
+	}
+	wg.Wait()
+	if created := (state(c, 7) == complete) != (state(c, 8) == complete); !created || len(d.messages) != 1 {
+		t.Errorf("sites 7 and 8 = %+v, %+v with %d refusals, want one created and one refused", state(c, 7), state(c, 8), len(d.messages))
+	}
+}
+
+func TestSiteKey(t *testing.T) {
+	tests := []struct {
+		body string
+		want string
+	}{
+		{`{"user_id": 1, "site_id": 7}`, "site:7"},
+		{`{"user_id": 1}`, "user:1"},
+		{`not json`, ""},
+	}
+	for _, tt := range tests {
+		if got := siteKey(amqp.Delivery{Body: []byte(tt.body)}); got != tt.want {
+			t.Errorf("siteKey(%s) = %q, want %q", tt.body, got, tt.want)
+		}
+	}
+}
+
+func TestDelSiteServerListener(t *testing.T) {
+	tests := []struct {
+		name    string
+		setup   func(c *fake.Client)
+		body    string
+		wantErr bool
+		// wantPermanent is set when the error must dead-letter the event rather than retry it
+		wantPermanent bool
+		wantState     siteState
+	}{
+		{
+			name: "deletes the site",
+			setup: func(c *fake.Client) {
+				c.AddSite(client.Site{UserID: 1, SiteID: 7})
+			},
+			body:      `{"user_id": 1, "site_id": 7}`,
+			wantState: absent,
+		},
+		{
+			name: "malformed json",
+			setup: func(c *fake.Client) {
+				c.AddSite(client.Site{UserID: 1, SiteID: 7})
+			},
+			body:          `not json`,
+			wantErr:       true,
+			wantPermanent: true,
+			wantState:     complete,
+		},
+		{
+			name:      "duplicate event for a deleted site",
+			body:      `{"user_id": 1, "site_id": 7}`,
+			wantState: absent,
+		},
+		{
+			name: "deployment delete fails",
+			setup: func(c *fake.Client) {
+				c.AddSite(client.Site{UserID: 1, SiteID: 7})
+				c.Fail(fake.OpDeleteDeployment, 7, errBoom)
+			},
+			body:      `{"user_id": 1, "site_id": 7}`,
+			wantErr:   true,
+			wantState: complete,
+		},
+		{
+			name: "service delete fails after the deployment",
+			setup: func(c *fake.Client) {
+				c.AddSite(client.Site{UserID: 1, SiteID: 7})
+				c.Fail(fake.OpDeleteService, 7, errBoom)
+			},
+			body:      `{"user_id": 1, "site_id": 7}`,
+			wantErr:   true,
+			wantState: siteState{service: true, ingress: true},
+		},
+		{
+			name: "ingress update fails after the service",
+			setup: func(c *fake.Client) {
+				c.AddSite(client.Site{UserID: 1, SiteID: 7})
+				c.Fail(fake.OpUpdateIngress, 7, errBoom)
+			},
+			body:      `{"user_id": 1, "site_id": 7}`,
+			wantErr:   true,
+			wantState: siteState{ingress: true},
+		},
+		{
+			name: "other sites are left alone",
+			setup: func(c *fake.Client) {
+				c.AddSite(client.Site{UserID: 1, SiteID: 7})
+				c.AddSite(client.Site{UserID: 1, SiteID: 8})
+			},
+			body:      `{"user_id": 1, "site_id": 8}`,
+			wantState: complete,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := fake.New()
+			if tt.setup != nil {
+				tt.setup(c)
+			}
+			listener := makeDelSiteServerListener(c, log.NewNopLogger())
+
+			err := listener(context.Background(), amqp.Delivery{Body: []byte(tt.body)})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("listener error = %v, want error: %v", err, tt.wantErr)
+			}
+			if consumer.IsPermanent(err) != tt.wantPermanent {
+				t.Errorf("listener error %v permanent = %v, want %v", err, consumer.IsPermanent(err), tt.wantPermanent)
+			}
+			if got := state(c, 7); got != tt.wantState {
+				t.Errorf("site state = %+v, want %+v", got, tt.wantState)
+			}
+		})
+	}
+}
+
+func TestDelUserSitesListenerPartialFailure(t *testing.T) {
+	c := fake.New()
+	c.AddSite(client.Site{UserID: 1, SiteID: 7})
+	c.AddSite(client.Site{UserID: 1, SiteID: 8})
+	c.AddSite(client.Site{UserID: 2, SiteID: 9})
+	c.Fail(fake.OpDeleteDeployment, 8, errBoom)
+	listener := makeDelUserSitesListener(c, log.NewNopLogger())
+
+	if err := listener(context.Background(), amqp.Delivery{Body: []byte(`{"user_id": 1}`)}); err == nil {
+		t.Fatal("listener succeeded, want an error for site 8")
+	}
+	if got := state(c, 7); got != absent {
+		t.Errorf("site 7 state = %+v, want %+v", got, absent)
+	}
+	if got := state(c, 8); got != (siteState{deployment: true}) {
+		t.Errorf("site 8 state = %+v, want only the deployment left", got)
+	}
+	if got := state(c, 9); got != complete {
+		t.Errorf("site 9 of another user state = %+v, want %+v", got, complete)
+	}
+
+	// a redelivery finishes the job once the failure clears
+	c.Fail(fake.OpDeleteDeployment, 8, nil)
+	if err := listener(context.Background(), amqp.Delivery{Body: []byte(`{"user_id": 1}`)}); err != nil {
+		t.Fatalf("redelivery: %v", err)
+	}
+	if got := state(c, 8); got != absent {
+		t.Errorf("site 8 state after redelivery = %+v, want %+v", got, absent)
+	}
+}
+
+func state(c *fake.Client, siteID uint) siteState {
+	var s siteState
+	s.deployment, s.service, s.ingress = c.State(siteID)
+	return s
+}
+
+// stopped returns a background that is shut down already, so the work the listeners leave running returns at once.
+func stopped() *background {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	return newBackground(ctx)
+}
+
+func TestObserveProvisioningStops(t *testing.T) {
+	// site 7 doesn't exist, so it never becomes ready
+	c := fake.New()
+	ctx, cancel := context.WithCancel(context.Background())
+	bg := newBackground(ctx)
+	bg.Go(func(ctx context.Context) {
+		observeProvisioning(ctx, c, 7, 0, log.NewNopLogger())
+	})
+	cancel()
+
+	done := make(chan struct{})
+	go func() {
+		bg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("observeProvisioning still running after shutdown")
+	}
+	if state, _ := c.SiteState(context.Background(), 7); state != client.StateNone {
+		t.Errorf("state after shutdown = %q, want it left alone", state)
+	}
+}
+
+func TestResumeProvisioning(t *testing.T) {
+	c := fake.New()
+	ctx := context.Background()
+	// site 7 was left Provisioning by a restart, site 8 is still Pending
+	c.AddSite(client.Site{UserID: 1, SiteID: 7})
+	c.AddSite(client.Site{UserID: 1, SiteID: 8})
+	c.SetSiteState(ctx, 7, client.StatePending)
+	c.SetSiteState(ctx, 7, client.StateProvisioning)
+	c.SetSiteState(ctx, 8, client.StatePending)
+
+	bg := newBackground(ctx)
+	resumeProvisioning(c, bg, log.NewNopLogger())
+	bg.Wait()
+	if state, _ := c.SiteState(ctx, 7); state != client.StateReady {
+		t.Errorf("site 7 = %q, want %q", state, client.StateReady)
+	}
+	if state, _ := c.SiteState(ctx, 8); state != client.StatePending {
+		t.Errorf("site 8 = %q, want it left %q", state, client.StatePending)
+	}
+}
+
+func TestVerified(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "k1"), []byte("secret"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := signing.NewKeyring(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := fake.New()
+	listener := verified(keys, "del_site_server", makeDelSiteServerListener(c, log.NewNopLogger()), log.NewNopLogger())
+
+	c.AddSite(client.Site{UserID: 1, SiteID: 7})
+	body := []byte(`{"user_id": 1, "site_id": 7}`)
+	forged := amqp.Delivery{Body: body, Headers: amqp.Table{signing.Header: signing.Sign("k1", []byte("guess"), "del_site_server", body)}}
+	if err := listener(context.Background(), forged); !consumer.IsPermanent(err) {
+		t.Fatalf("forged event: listener error = %v, want a permanent error", err)
+	}
+	if got := state(c, 7); got != complete {
+		t.Fatalf("forged event: site state = %+v, want the site left alone", got)
+	}
+	signed := amqp.Delivery{Body: body, Headers: amqp.Table{signing.Header: signing.Sign("k1", []byte("secret"), "del_site_server", body)}}
+	if err := listener(context.Background(), signed); err != nil {
+		t.Fatalf("signed event: listener error = %v", err)
+	}
+	if got := state(c, 7); got != absent {
+		t.Errorf("signed event: site state = %+v, want the site deleted", got)
+	}
+}
@@ -1,14 +1,47 @@
 package main
 
 import (
+	"flag"
+	"fmt"
 	"github.com/go-kit/kit/log"
-	mqclient "github.com/seagullbird/headr-common/mq/client"
-	"github.com/seagullbird/headr-common/mq/receive"
-	"github.com/seagullbird/headr-k8s-helper/client"
+	"github.com/seagullbird/headr-k8s-helper/config"
 	"os"
 )
 
+const usage = `Usage: k8s-helper [flags] <command> [args]
+
+Commands:
+  serve                              handle site events from HEADR_SOURCE (the default)
+  site create <id> -user <id> [-plan <plan>]
+                                     create a site
+  site delete <id>                   delete a site
+  site describe <id> [-o text|json]  show a site's deployment, service and ingress paths
+  sites list [-o table|json]         list all sites
+  reconcile                          repair missing or orphaned services and ingress paths
+  render -site <id>                  print the objects of a site without creating them
+  rebalance -site <id> -to <cluster> move a site to another cluster
+  preflight                          check the permissions, objects and RabbitMQ login serve needs
+  rbac [-namespace <ns>] [-o yaml|json]
+                                     print the service account, roles and bindings serve needs
+  crd [-o yaml|json]                 print the HeadrSite CustomResourceDefinition of operator mode
+  dlq list [-queue <q>] [-o table|json]
+                                     list dead-lettered site events
+  dlq replay|purge [-queue <q>] -all|-site <id>|-message-id <id> [-edit] [-reason <text>]
+                                     republish or discard dead-lettered site events
+
+Flags:
+`
+
 func main() {
+	flag.StringVar(&config.Kubeconfig, "kubeconfig", config.Kubeconfig, "path to a YAML or JSON kubeconfig; in-cluster config is used when empty")
+	flag.StringVar(&config.KubeContext, "context", config.KubeContext, "kubeconfig context to use instead of the current one")
+	flag.BoolVar(&config.DryRun, "dry-run", config.DryRun, "log the objects and ingress changes instead of applying them")
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
 	// logging domain
 	var logger log.Logger
 	{
@@ -17,27 +50,33 @@ func main() {
 		logger = log.With(logger, "caller", log.DefaultCaller)
 	}
 
-	// mq receiver
-	var (
-		servername = os.Getenv("RABBITMQ_SERVER")
-		username   = os.Getenv("RABBITMQ_USER")
-		passwd     = os.Getenv("RABBITMQ_PASS")
-	)
-	receiver, err := receive.NewReceiver(mqclient.New(servername, username, passwd), logger)
-	if err != nil {
-		logger.Log("error_desc", "receive.NewReceiver failed", "error", err)
-		return
+	var args []string
+	if flag.NArg() > 1 {
+		args = flag.Args()[1:]
 	}
-	//	new k8s client
-	c, err := client.NewClient(logger)
-	if err != nil {
-		logger.Log("error_desc", "failed to create k8s client", "error", err)
+	switch flag.Arg(0) {
+	case "", "serve":
+		os.Exit(runServe(logger))
+	case "site":
+		os.Exit(runSite(args, logger))
+	case "sites":
+		os.Exit(runSites(args, logger))
+	case "reconcile":
+		os.Exit(runReconcile(args, logger))
+	case "render":
+		os.Exit(runRender(args, logger))
+	case "rebalance":
+		os.Exit(runRebalance(args, logger))
+	case "preflight":
+		os.Exit(runPreflight(args, logger))
+	case "rbac":
+		os.Exit(runRBAC(args, logger))
+	case "crd":
+		os.Exit(runCRD(args, logger))
+	case "dlq":
+		os.Exit(runDLQ(args, logger))
+	default:
+		flag.Usage()
+		os.Exit(2)
 	}
-
-	// Register listeners
-	receiver.RegisterListener("new_site_server", makeNewSiteServerListener(c, logger))
-	receiver.RegisterListener("del_site_server", makeDelSiteServerListener(c, logger))
-	// Run forever
-	forever := make(chan bool)
-	<-forever
 }
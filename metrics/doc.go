@@ -0,0 +1,2 @@
+// Package metrics implements go-kit's metric interfaces in memory and exposes them in the Prometheus text format
+package metrics
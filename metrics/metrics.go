@@ -0,0 +1,32 @@
+package metrics
+
+// The helper's metrics.
+var (
+	EventsReceived = NewCounter("headr_k8s_helper_events_received_total",
+		"Events received, by queue.", "queue")
+	EventsFailed = NewCounter("headr_k8s_helper_events_failed_total",
+		"Events whose handling failed, by queue.", "queue")
+	EventsRetried = NewCounter("headr_k8s_helper_events_retried_total",
+		"Failed events sent to their retry queue, by queue.", "queue")
+	EventsDeadLettered = NewCounter("headr_k8s_helper_events_dead_lettered_total",
+		"Failed events sent to their dead-letter queue, by queue.", "queue")
+	EventsSkipped = NewCounter("headr_k8s_helper_events_skipped_total",
+		"Site events skipped as duplicates of, or older than, the last applied event, by reason.", "reason")
+	EventsRejected = NewCounter("headr_k8s_helper_events_rejected_total",
+		"Site events dead-lettered as invalid, by reason.", "reason")
+	EventDuration = NewHistogram("headr_k8s_helper_event_duration_seconds",
+		"Time spent handling an event, by queue.", DefBuckets, "queue")
+
+	KubernetesRequests = NewCounter("headr_k8s_helper_kubernetes_requests_total",
+		"Kubernetes API requests, by verb, resource and status code.", "verb", "resource", "code")
+	KubernetesRequestDuration = NewHistogram("headr_k8s_helper_kubernetes_request_duration_seconds",
+		"Kubernetes API request latency, by verb and resource.", DefBuckets, "verb", "resource")
+	IngressConflicts = NewCounter("headr_k8s_helper_ingress_update_conflicts_total",
+		"usersites-ingress updates rejected because the ingress changed since it was read.")
+
+	ManagedSites = NewGauge("headr_k8s_helper_managed_sites",
+		"Sites with a deployment managed by the helper.")
+	ProvisioningDuration = NewHistogram("headr_k8s_helper_provisioning_duration_seconds",
+		"Time from the site event's received_on to the site's deployment being ready.",
+		[]float64{1, 2.5, 5, 10, 20, 30, 60, 120, 300, 600})
+)
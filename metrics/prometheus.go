@@ -0,0 +1,237 @@
+package metrics
+
+import (
+	"bytes"
+	kitmetrics "github.com/go-kit/kit/metrics"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefBuckets are the default histogram buckets, in seconds.
+var DefBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+var (
+	registryMtx sync.Mutex
+	registry    []*family
+)
+
+// family holds every labeled series of one metric.
+type family struct {
+	name    string
+	help    string
+	typ     string
+	labels  []string
+	buckets []float64
+
+	mtx    sync.Mutex
+	series map[string]*series
+}
+
+type series struct {
+	labelValues []string
+	value       float64
+	counts      []uint64
+	sum         float64
+	count       uint64
+}
+
+func newFamily(name, help, typ string, labels []string, buckets []float64) *family {
+	f := &family{
+		name:    name,
+		help:    help,
+		typ:     typ,
+		labels:  labels,
+		buckets: buckets,
+		series:  make(map[string]*series),
+	}
+	registryMtx.Lock()
+	registry = append(registry, f)
+	registryMtx.Unlock()
+	return f
+}
+
+// get returns the series for go-kit style alternating label names and values; undeclared labels are ignored.
+func (f *family) get(lvs []string) *series {
+	values := make([]string, len(f.labels))
+	for i := 0; i+1 < len(lvs); i += 2 {
+		for j, name := range f.labels {
+			if name == lvs[i] {
+				values[j] = lvs[i+1]
+			}
+		}
+	}
+	key := strings.Join(values, "\xff")
+	s, ok := f.series[key]
+	if !ok {
+		s = &series{labelValues: values, counts: make([]uint64, len(f.buckets))}
+		f.series[key] = s
+	}
+	return s
+}
+
+func (f *family) add(lvs []string, delta float64) {
+	f.mtx.Lock()
+	f.get(lvs).value += delta
+	f.mtx.Unlock()
+}
+
+func (f *family) set(lvs []string, value float64) {
+	f.mtx.Lock()
+	f.get(lvs).value = value
+	f.mtx.Unlock()
+}
+
+func (f *family) observe(lvs []string, value float64) {
+	f.mtx.Lock()
+	s := f.get(lvs)
+	for i, upper := range f.buckets {
+		if value <= upper {
+			s.counts[i]++
+		}
+	}
+	s.sum += value
+	s.count++
+	f.mtx.Unlock()
+}
+
+func (f *family) write(b *bytes.Buffer) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	b.WriteString("# HELP " + f.name + " " + f.help + "\n")
+	b.WriteString("# TYPE " + f.name + " " + f.typ + "\n")
+	keys := make([]string, 0, len(f.series))
+	for key := range f.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s := f.series[key]
+		if f.typ != "histogram" {
+			b.WriteString(f.name + f.labelString(s.labelValues, "") + " " + formatFloat(s.value) + "\n")
+			continue
+		}
+		for i, upper := range f.buckets {
+			b.WriteString(f.name + "_bucket" + f.labelString(s.labelValues, formatFloat(upper)) + " " + strconv.FormatUint(s.counts[i], 10) + "\n")
+		}
+		b.WriteString(f.name + "_bucket" + f.labelString(s.labelValues, "+Inf") + " " + strconv.FormatUint(s.count, 10) + "\n")
+		b.WriteString(f.name + "_sum" + f.labelString(s.labelValues, "") + " " + formatFloat(s.sum) + "\n")
+		b.WriteString(f.name + "_count" + f.labelString(s.labelValues, "") + " " + strconv.FormatUint(s.count, 10) + "\n")
+	}
+}
+
+// labelString formats the labels of a series, with the le label of a histogram bucket when le isn't empty.
+func (f *family) labelString(values []string, le string) string {
+	var pairs []string
+	for i, name := range f.labels {
+		pairs = append(pairs, name+`="`+escape(values[i])+`"`)
+	}
+	if le != "" {
+		pairs = append(pairs, `le="`+le+`"`)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+var escaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escape(s string) string {
+	return escaper.Replace(s)
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// Counter is a Prometheus counter.
+type Counter struct {
+	f   *family
+	lvs []string
+}
+
+// NewCounter registers a counter with the given label names.
+func NewCounter(name, help string, labels ...string) *Counter {
+	return &Counter{f: newFamily(name, help, "counter", labels, nil)}
+}
+
+// With implements kitmetrics.Counter.
+func (c *Counter) With(labelValues ...string) kitmetrics.Counter {
+	return &Counter{f: c.f, lvs: append(c.lvs[:len(c.lvs):len(c.lvs)], labelValues...)}
+}
+
+// Add implements kitmetrics.Counter.
+func (c *Counter) Add(delta float64) {
+	c.f.add(c.lvs, delta)
+}
+
+// Gauge is a Prometheus gauge.
+type Gauge struct {
+	f   *family
+	lvs []string
+}
+
+// NewGauge registers a gauge with the given label names.
+func NewGauge(name, help string, labels ...string) *Gauge {
+	return &Gauge{f: newFamily(name, help, "gauge", labels, nil)}
+}
+
+// With implements kitmetrics.Gauge.
+func (g *Gauge) With(labelValues ...string) kitmetrics.Gauge {
+	return &Gauge{f: g.f, lvs: append(g.lvs[:len(g.lvs):len(g.lvs)], labelValues...)}
+}
+
+// Set implements kitmetrics.Gauge.
+func (g *Gauge) Set(value float64) {
+	g.f.set(g.lvs, value)
+}
+
+// Add implements kitmetrics.Gauge.
+func (g *Gauge) Add(delta float64) {
+	g.f.add(g.lvs, delta)
+}
+
+// Histogram is a Prometheus histogram.
+type Histogram struct {
+	f   *family
+	lvs []string
+}
+
+// NewHistogram registers a histogram with the given upper bucket bounds and label names.
+func NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	return &Histogram{f: newFamily(name, help, "histogram", labels, buckets)}
+}
+
+// With implements kitmetrics.Histogram.
+func (h *Histogram) With(labelValues ...string) kitmetrics.Histogram {
+	return &Histogram{f: h.f, lvs: append(h.lvs[:len(h.lvs):len(h.lvs)], labelValues...)}
+}
+
+// Observe implements kitmetrics.Histogram.
+func (h *Histogram) Observe(value float64) {
+	h.f.observe(h.lvs, value)
+}
+
+// Handler serves every registered metric in the Prometheus text format.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		registryMtx.Lock()
+		families := append([]*family(nil), registry...)
+		registryMtx.Unlock()
+
+		var b bytes.Buffer
+		for _, f := range families {
+			f.write(&b)
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		w.Write(b.Bytes())
+	})
+}
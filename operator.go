@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/go-kit/kit/log"
+	"github.com/seagullbird/headr-common/mq/dispatch"
+	"github.com/seagullbird/headr-k8s-helper/client"
+	"github.com/seagullbird/headr-k8s-helper/schema"
+	"github.com/streadway/amqp"
+)
+
+// In operator mode the listeners only declare sites as HeadrSites, which the operator provisions.
+// They keep the ledger and the site quota of the other listeners, counting the user's HeadrSites.
+
+func makeNewSiteResourceListener(c client.Client, sites client.HeadrSites, dispatcher dispatch.Dispatcher, logger log.Logger) handler {
+	return func(ctx context.Context, delivery amqp.Delivery) error {
+		event, err := decode(delivery, schema.NeedSite|schema.NeedUser, logger)
+		if err != nil {
+			return err
+		}
+		logger.Log("info", "Received newsite event", "event", event)
+		defer lockUser(event.UserID)()
+
+		applied := client.AppliedEvent{ReceivedOn: event.ReceivedOn, EventID: eventID("new_site_server", delivery, event)}
+		if skip, err := superseded(ctx, c, applied, logger, client.SiteKey(event.SiteID), client.UserKey(event.UserID)); skip || err != nil {
+			return err
+		}
+
+		_, err = applySite(ctx, c, sites, dispatcher, event, nil, applied, logger)
+		return err
+	}
+}
+
+func makeDelSiteResourceListener(c client.Client, sites client.HeadrSites, logger log.Logger) handler {
+	return func(ctx context.Context, delivery amqp.Delivery) error {
+		event, err := decode(delivery, schema.NeedSite, logger)
+		if err != nil {
+			return err
+		}
+		logger.Log("info", "Received delsite event", "event", event)
+
+		applied := client.AppliedEvent{ReceivedOn: event.ReceivedOn, EventID: eventID("del_site_server", delivery, event)}
+		if skip, err := superseded(ctx, c, applied, logger, client.SiteKey(event.SiteID)); skip || err != nil {
+			return err
+		}
+
+		return deleteSiteResource(ctx, c, sites, event.SiteID, applied, logger)
+	}
+}
+
+func makeDelUserSiteResourcesListener(c client.Client, sites client.HeadrSites, logger log.Logger) handler {
+	return func(ctx context.Context, delivery amqp.Delivery) error {
+		event, err := decode(delivery, schema.NeedUser, logger)
+		if err != nil {
+			return err
+		}
+		logger.Log("info", "Received deluser event", "event", event)
+		defer lockUser(event.UserID)()
+
+		applied := client.AppliedEvent{ReceivedOn: event.ReceivedOn, EventID: eventID("del_user_sites", delivery, event)}
+		if skip, err := superseded(ctx, c, applied, logger, client.UserKey(event.UserID)); skip || err != nil {
+			return err
+		}
+
+		list, err := sites.List(ctx, event.UserID)
+		if err != nil {
+			logger.Log("error_desc", "Failed to list user HeadrSites", "user_id", event.UserID, "error", err)
+			return err
+		}
+		failed := 0
+		for _, site := range list.Items {
+			if err := sites.Delete(ctx, site.Spec.SiteID); err != nil {
+				failed++
+				logger.Log("error_desc", "Failed to delete HeadrSite", "user_id", event.UserID, "site_id", site.Spec.SiteID, "error", err)
+			}
+		}
+		if failed > 0 {
+			return fmt.Errorf("failed to delete %d of %d HeadrSites", failed, len(list.Items))
+		}
+		recordApplied(ctx, c, client.UserKey(event.UserID), applied, logger)
+		return nil
+	}
+}
+
+// applySite applies the HeadrSite of a new site, served on domains too, within its user's site quota, counting the user's HeadrSites, and
+// records applied in the ledger; it's what new_site_server and the admin API do in operator mode. It reports whether
+// the site was refused, once the refusal is published to dispatcher. The caller holds the user's lock.
+func applySite(ctx context.Context, c client.Client, sites client.HeadrSites, dispatcher dispatch.Dispatcher, event schema.Site, domains []string, applied client.AppliedEvent, logger log.Logger) (bool, error) {
+	// The site's own HeadrSite, when it's declared again, and those being deleted don't count
+	list, err := sites.List(ctx, event.UserID)
+	if err != nil {
+		logger.Log("error_desc", "Failed to list user HeadrSites", "error", err)
+		return false, err
+	}
+	count := 0
+	for _, site := range list.Items {
+		if site.Spec.SiteID != event.SiteID && !site.Deleting() {
+			count++
+		}
+	}
+	if refused, err := overQuota(event, count, dispatcher, logger); refused || err != nil {
+		return refused, err
+	}
+
+	err = sites.Apply(ctx, client.HeadrSiteSpec{
+		SiteID:  event.SiteID,
+		UserID:  event.UserID,
+		Theme:   event.Theme,
+		Plan:    event.Plan,
+		Domains: domains,
+	})
+	if err != nil {
+		logger.Log("error_desc", "Failed to apply HeadrSite", "site_id", event.SiteID, "error", err)
+		return false, err
+	}
+	recordApplied(ctx, c, client.SiteKey(event.SiteID), applied, logger)
+	return false, nil
+}
+
+// deleteSiteResource deletes the HeadrSite of a site and records applied in the ledger;
+// it's what del_site_server and the admin API do in operator mode.
+func deleteSiteResource(ctx context.Context, c client.Client, sites client.HeadrSites, siteID uint, applied client.AppliedEvent, logger log.Logger) error {
+	if err := sites.Delete(ctx, siteID); err != nil {
+		logger.Log("error_desc", "Failed to delete HeadrSite", "site_id", siteID, "error", err)
+		return err
+	}
+	recordApplied(ctx, c, client.SiteKey(siteID), applied, logger)
+	return nil
+}
@@ -0,0 +1,3 @@
+// Package operator provisions the sites declared as HeadrSite resources and reports their state back,
+// tearing a site down before its resource is gone
+package operator
@@ -0,0 +1,257 @@
+package operator
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/go-kit/kit/log"
+	"github.com/seagullbird/headr-k8s-helper/client"
+	"github.com/seagullbird/headr-k8s-helper/config"
+	"reflect"
+	"time"
+)
+
+// Operator keeps the sites in line with their HeadrSites: it goes through every HeadrSite each resync interval,
+// and through each one that changes in between.
+type Operator struct {
+	sites  client.HeadrSites
+	c      client.Client
+	resync time.Duration
+	logger log.Logger
+}
+
+// New returns an Operator provisioning the sites of sites with c.
+func New(sites client.HeadrSites, c client.Client, resync time.Duration, logger log.Logger) *Operator {
+	return &Operator{sites: sites, c: c, resync: resync, logger: logger}
+}
+
+// Run reconciles the HeadrSites until ctx is done. Failed reconciliations are logged and tried again on the next resync.
+func (o *Operator) Run(ctx context.Context) {
+	for ctx.Err() == nil {
+		version, err := o.reconcileAll(ctx)
+		if err != nil {
+			o.logger.Log("error_desc", "Failed to list HeadrSites", "error", err)
+			sleep(ctx, o.resync)
+			continue
+		}
+		// The watch ends with the resync interval, so every HeadrSite is gone through again
+		wctx, cancel := context.WithTimeout(ctx, o.resync)
+		err = o.sites.Watch(wctx, version, func(eventType string, site *client.HeadrSite) {
+			if eventType == "DELETED" {
+				return
+			}
+			o.reconcile(ctx, site)
+		})
+		expired := wctx.Err() != nil
+		cancel()
+		if err != nil && !expired {
+			o.logger.Log("error_desc", "HeadrSite watch failed", "error", err)
+			sleep(ctx, time.Second)
+		}
+	}
+}
+
+// reconcileAll reconciles every HeadrSite, and returns the resource version of the list.
+func (o *Operator) reconcileAll(ctx context.Context) (string, error) {
+	list, err := o.sites.List(ctx, 0)
+	if err != nil {
+		return "", err
+	}
+	for _, site := range list.Items {
+		o.reconcile(ctx, site)
+	}
+	return list.Metadata.GetResourceVersion(), nil
+}
+
+func (o *Operator) reconcile(ctx context.Context, site *client.HeadrSite) {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(config.EventTimeout)*time.Second)
+	defer cancel()
+	if err := o.Reconcile(ctx, site); err != nil {
+		o.logger.Log("error_desc", "Failed to reconcile HeadrSite", "name", site.Metadata.GetName(), "site_id", site.Spec.SiteID, "error", err)
+	}
+}
+
+// Reconcile brings the site of a HeadrSite in line with its spec, and writes what it found to its status:
+// the site is created when missing, updated in place when its theme, plan or domains changed, and created again
+// when its user changed. A deleted HeadrSite has its site deleted, then its finalizer removed; a HeadrSite gets
+// the finalizer before its site is created.
+// The site is the one the HeadrSite is named after; a spec declaring another site, such as after an edit of
+// spec.siteID, is rejected rather than leave the named site behind. The site's lifecycle state moves along.
+func (o *Operator) Reconcile(ctx context.Context, site *client.HeadrSite) error {
+	siteID, named := site.SiteID()
+	if site.Deleting() {
+		if !site.HasFinalizer() {
+			return nil
+		}
+		if !named {
+			// rejected before anything was created
+			siteID = 0
+		}
+		o.moveSite(ctx, siteID, client.StateDeleting)
+		if err := o.teardown(ctx, siteID); err != nil {
+			o.moveSite(ctx, siteID, client.StateFailed)
+			site.Status.SetCondition(client.ConditionProvisioned, "Unknown", "TeardownFailed", err.Error())
+			o.writeStatus(ctx, site, nil)
+			return err
+		}
+		o.moveSite(ctx, siteID, client.StateDeleted)
+		var kept []string
+		for _, f := range site.Metadata.GetFinalizers() {
+			if f != client.SiteFinalizer {
+				kept = append(kept, f)
+			}
+		}
+		site.Metadata.Finalizers = kept
+		o.logger.Log("info", "Deleted site of HeadrSite", "name", site.Metadata.GetName(), "site_id", siteID)
+		return o.sites.Update(ctx, site)
+	}
+
+	if !named || site.Spec.SiteID != siteID {
+		before := copyStatus(site.Status)
+		err := fmt.Errorf("spec.siteID %d doesn't match the HeadrSite's name %s", site.Spec.SiteID, site.Metadata.GetName())
+		site.Status.SetCondition(client.ConditionProvisioned, "False", "InvalidSiteID", err.Error())
+		o.writeStatus(ctx, site, &before)
+		return err
+	}
+
+	if !site.HasFinalizer() {
+		site.Metadata.Finalizers = append(site.Metadata.Finalizers, client.SiteFinalizer)
+		if err := o.sites.Update(ctx, site); err != nil {
+			return err
+		}
+	}
+	before := copyStatus(site.Status)
+
+	// changed is set once the site is being created or updated, so a failure moves it to Failed
+	changed := true
+	status, err := o.c.DescribeSite(ctx, siteID)
+	switch {
+	case err == client.ErrSiteNotFound:
+		o.logger.Log("info", "Creating site of HeadrSite", "name", site.Metadata.GetName(), "site_id", siteID)
+		o.moveSite(ctx, siteID, client.StatePending, client.StateProvisioning)
+		err = o.c.CreateCaddyService(ctx, site.Spec.Site())
+		if err == nil {
+			status, err = o.c.DescribeSite(ctx, siteID)
+		}
+	case err == nil && status.UserID != site.Spec.UserID:
+		o.logger.Log("info", "User of HeadrSite changed, creating its site again", "name", site.Metadata.GetName(), "site_id", siteID)
+		o.moveSite(ctx, siteID, client.StateDeleting)
+		if err = o.c.DeleteCaddyService(ctx, siteID); err == nil {
+			o.moveSite(ctx, siteID, client.StateDeleted, client.StatePending, client.StateProvisioning)
+			err = o.c.CreateCaddyService(ctx, site.Spec.Site())
+		}
+		if err == nil {
+			status, err = o.c.DescribeSite(ctx, siteID)
+		}
+	case err == nil && !sameSite(status.Site, site.Spec.Site()):
+		o.logger.Log("info", "Spec of HeadrSite changed, updating its site", "name", site.Metadata.GetName(), "site_id", siteID)
+		o.moveSite(ctx, siteID, client.StateUpdating)
+		if err = o.c.UpdateCaddyService(ctx, site.Spec.Site()); err == nil {
+			status, err = o.c.DescribeSite(ctx, siteID)
+		}
+	default:
+		changed = false
+	}
+	if err != nil {
+		if changed {
+			o.moveSite(ctx, siteID, client.StateFailed)
+		}
+		site.Status.SetCondition(client.ConditionProvisioned, "False", "ProvisioningFailed", err.Error())
+		site.Status.SetCondition(client.ConditionReady, "False", "ProvisioningFailed", "")
+		o.writeStatus(ctx, site, &before)
+		return err
+	}
+
+	site.Status.SetCondition(client.ConditionProvisioned, "True", "Provisioned", "")
+	if status.ReadyReplicas > 0 {
+		o.moveSite(ctx, siteID, client.StatePending, client.StateProvisioning, client.StateReady)
+		site.Status.SetCondition(client.ConditionReady, "True", "Available", "")
+	} else {
+		site.Status.SetCondition(client.ConditionReady, "False", "Progressing", "waiting for a ready replica")
+	}
+	site.Status.ObservedGeneration = site.Metadata.GetGeneration()
+	return o.writeStatus(ctx, site, &before)
+}
+
+// teardown deletes a site, which is done when the site doesn't exist or siteID is 0.
+func (o *Operator) teardown(ctx context.Context, siteID uint) error {
+	if siteID == 0 {
+		return nil
+	}
+	if _, err := o.c.DescribeSite(ctx, siteID); err == client.ErrSiteNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return o.c.DeleteCaddyService(ctx, siteID)
+}
+
+// moveSite moves a site along path to its last state, starting from the furthest state of path the site can move
+// to from where it is, such as straight to Ready from Provisioning but through Pending and Provisioning from none.
+// A site at the end of path already is left alone; state errors are only logged.
+func (o *Operator) moveSite(ctx context.Context, siteID uint, path ...client.SiteState) {
+	if siteID == 0 {
+		return
+	}
+	from, err := o.c.SiteState(ctx, siteID)
+	if err != nil {
+		o.logger.Log("error_desc", "Failed to get site state", "site_id", siteID, "error", err)
+		return
+	}
+	if from == path[len(path)-1] {
+		return
+	}
+	start := -1
+	for i := range path {
+		if client.CheckTransition(siteID, from, path[i]) == nil {
+			start = i
+		}
+	}
+	if start < 0 {
+		o.logger.Log("error_desc", "Rejected site state change", "site_id", siteID, "error", client.CheckTransition(siteID, from, path[0]))
+		return
+	}
+	for _, to := range path[start:] {
+		if err := o.c.SetSiteState(ctx, siteID, to); err != nil {
+			o.logger.Log("error_desc", "Failed to set site state", "site_id", siteID, "state", to, "error", err)
+			return
+		}
+	}
+}
+
+// writeStatus writes the status of a HeadrSite back unless it's the same as before, so writing it doesn't
+// set off another reconciliation with nothing to do.
+func (o *Operator) writeStatus(ctx context.Context, site *client.HeadrSite, before *client.HeadrSiteStatus) error {
+	if before != nil {
+		was, _ := json.Marshal(before)
+		is, _ := json.Marshal(site.Status)
+		if string(was) == string(is) {
+			return nil
+		}
+	}
+	err := o.sites.Update(ctx, site)
+	if err != nil {
+		o.logger.Log("error_desc", "Failed to write HeadrSite status", "name", site.Metadata.GetName(), "error", err)
+	}
+	return err
+}
+
+// copyStatus copies a status, so setting its conditions leaves the copy as it was.
+func copyStatus(status client.HeadrSiteStatus) client.HeadrSiteStatus {
+	status.Conditions = append([]client.SiteCondition(nil), status.Conditions...)
+	return status
+}
+
+// sameSite reports whether a site as it exists matches the site its HeadrSite declares.
+func sameSite(is, declared client.Site) bool {
+	return is.UserID == declared.UserID && is.Plan == declared.Plan && is.Theme == declared.Theme &&
+		(len(is.Domains) == 0 && len(declared.Domains) == 0 || reflect.DeepEqual(is.Domains, declared.Domains))
+}
+
+// sleep waits for d, or until ctx is done.
+func sleep(ctx context.Context, d time.Duration) {
+	select {
+	case <-ctx.Done():
+	case <-time.After(d):
+	}
+}
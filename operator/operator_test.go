@@ -0,0 +1,176 @@
+package operator
+
+import (
+	"context"
+	"errors"
+	"github.com/go-kit/kit/log"
+	"github.com/seagullbird/headr-k8s-helper/client"
+	"github.com/seagullbird/headr-k8s-helper/client/fake"
+	"testing"
+	"time"
+)
+
+func condition(t *testing.T, site *client.HeadrSite, typ string) string {
+	t.Helper()
+	c := site.Status.Condition(typ)
+	if c == nil {
+		t.Fatalf("no %s condition in %+v", typ, site.Status)
+	}
+	return c.Status + " " + c.Reason
+}
+
+// reconciled reconciles the HeadrSite of a site, and returns it as stored afterwards.
+func reconciled(t *testing.T, o *Operator, sites *fake.HeadrSites, siteID uint) (*client.HeadrSite, error) {
+	t.Helper()
+	site, ok := sites.Get(siteID)
+	if !ok {
+		t.Fatalf("no HeadrSite of site %d", siteID)
+	}
+	err := o.Reconcile(context.Background(), site)
+	site, _ = sites.Get(siteID)
+	return site, err
+}
+
+// checkState fails the test unless a site is in the state want.
+func checkState(t *testing.T, c client.Client, siteID uint, want client.SiteState) {
+	t.Helper()
+	if got, err := c.SiteState(context.Background(), siteID); err != nil || got != want {
+		t.Errorf("state of site %d = %q, %v, want %q", siteID, got, err, want)
+	}
+}
+
+func TestReconcile(t *testing.T) {
+	ctx := context.Background()
+	c, sites := fake.New(), fake.NewHeadrSites()
+	o := New(sites, c, time.Minute, log.NewNopLogger())
+
+	// A new HeadrSite gets the finalizer, then its site
+	sites.Apply(ctx, client.HeadrSiteSpec{SiteID: 7, UserID: 1, Plan: "pro", Domains: []string{"blog.example.com"}})
+	site, err := reconciled(t, o, sites, 7)
+	if err != nil {
+		t.Fatalf("Reconcile() = %v", err)
+	}
+	if !site.HasFinalizer() {
+		t.Error("finalizer not added")
+	}
+	status, err := c.DescribeSite(ctx, 7)
+	if err != nil || status.Plan != "pro" || len(status.Domains) != 1 {
+		t.Fatalf("site = %+v, %v, want it created from the spec", status.Site, err)
+	}
+	if got := condition(t, site, client.ConditionProvisioned); got != "True Provisioned" {
+		t.Errorf("Provisioned = %s", got)
+	}
+	if got := condition(t, site, client.ConditionReady); got != "True Available" {
+		t.Errorf("Ready = %s", got)
+	}
+	if site.Status.ObservedGeneration != site.Metadata.GetGeneration() {
+		t.Errorf("observed generation %d, want %d", site.Status.ObservedGeneration, site.Metadata.GetGeneration())
+	}
+	checkState(t, c, 7, client.StateReady)
+
+	// Nothing to do leaves the HeadrSite alone
+	version := site.Metadata.GetResourceVersion()
+	if site, _ = reconciled(t, o, sites, 7); site.Metadata.GetResourceVersion() != version {
+		t.Error("HeadrSite written without a change")
+	}
+
+	// A changed spec updates the site in place, without deleting it
+	c.Fail(fake.OpDeleteDeployment, 7, errors.New("site deleted"))
+	sites.Apply(ctx, client.HeadrSiteSpec{SiteID: 7, UserID: 1, Plan: "basic", Theme: "hyde"})
+	if _, err := reconciled(t, o, sites, 7); err != nil {
+		t.Fatalf("Reconcile() after spec change = %v", err)
+	}
+	if status, _ := c.DescribeSite(ctx, 7); status.Plan != "basic" || status.Theme != "hyde" || len(status.Domains) != 1 {
+		t.Errorf("site = %+v, want the new plan and theme and the kept domains", status.Site)
+	}
+	checkState(t, c, 7, client.StateReady)
+	c.Fail(fake.OpDeleteDeployment, 7, nil)
+
+	// A changed user creates the site again
+	sites.Apply(ctx, client.HeadrSiteSpec{SiteID: 7, UserID: 2, Plan: "basic"})
+	if _, err := reconciled(t, o, sites, 7); err != nil {
+		t.Fatalf("Reconcile() after user change = %v", err)
+	}
+	if status, _ := c.DescribeSite(ctx, 7); status.UserID != 2 {
+		t.Errorf("site = %+v, want it moved to user 2", status.Site)
+	}
+	checkState(t, c, 7, client.StateReady)
+
+	// Deleting tears the site down, then lets the HeadrSite go
+	sites.Delete(ctx, 7)
+	if _, err := reconciled(t, o, sites, 7); err != nil {
+		t.Fatalf("Reconcile() on delete = %v", err)
+	}
+	if _, ok := sites.Get(7); ok {
+		t.Error("HeadrSite kept after its site was deleted")
+	}
+	if _, err := c.DescribeSite(ctx, 7); err != client.ErrSiteNotFound {
+		t.Errorf("DescribeSite() = %v, want the site deleted", err)
+	}
+	checkState(t, c, 7, client.StateDeleted)
+}
+
+func TestReconcileFailure(t *testing.T) {
+	ctx := context.Background()
+	c, sites := fake.New(), fake.NewHeadrSites()
+	o := New(sites, c, time.Minute, log.NewNopLogger())
+	c.Fail(fake.OpCreateDeployment, 7, errors.New("quota exceeded"))
+
+	sites.Apply(ctx, client.HeadrSiteSpec{SiteID: 7, UserID: 1})
+	site, err := reconciled(t, o, sites, 7)
+	if err == nil {
+		t.Fatal("Reconcile() = nil, want the create error")
+	}
+	if got := condition(t, site, client.ConditionProvisioned); got != "False ProvisioningFailed" {
+		t.Errorf("Provisioned = %s", got)
+	}
+	if msg := site.Status.Condition(client.ConditionProvisioned).Message; msg != "quota exceeded" {
+		t.Errorf("message = %q, want the create error", msg)
+	}
+	checkState(t, c, 7, client.StateFailed)
+
+	// A HeadrSite deleted before its site was created goes at once
+	sites.Delete(ctx, 7)
+	if _, err := reconciled(t, o, sites, 7); err != nil {
+		t.Fatalf("Reconcile() on delete = %v", err)
+	}
+	if _, ok := sites.Get(7); ok {
+		t.Error("HeadrSite kept")
+	}
+	checkState(t, c, 7, client.StateDeleted)
+}
+
+func TestReconcileSiteIDChange(t *testing.T) {
+	ctx := context.Background()
+	c, sites := fake.New(), fake.NewHeadrSites()
+	o := New(sites, c, time.Minute, log.NewNopLogger())
+	sites.Apply(ctx, client.HeadrSiteSpec{SiteID: 7, UserID: 1})
+	if _, err := reconciled(t, o, sites, 7); err != nil {
+		t.Fatal(err)
+	}
+
+	site, _ := sites.Get(7)
+	site.Spec.SiteID = 8
+	if err := sites.Update(ctx, site); err != nil {
+		t.Fatal(err)
+	}
+	site, err := reconciled(t, o, sites, 7)
+	if err == nil {
+		t.Fatal("Reconcile() = nil, want the site ID rejected")
+	}
+	if got := condition(t, site, client.ConditionProvisioned); got != "False InvalidSiteID" {
+		t.Errorf("Provisioned = %s", got)
+	}
+	if _, err := c.DescribeSite(ctx, 8); err != client.ErrSiteNotFound {
+		t.Errorf("DescribeSite(8) = %v, want no site 8", err)
+	}
+
+	// Deleting the HeadrSite still tears down the site it's named after
+	sites.Delete(ctx, 7)
+	if _, err := reconciled(t, o, sites, 7); err != nil {
+		t.Fatalf("Reconcile() on delete = %v", err)
+	}
+	if _, err := c.DescribeSite(ctx, 7); err != client.ErrSiteNotFound {
+		t.Errorf("DescribeSite(7) = %v, want the site deleted", err)
+	}
+}
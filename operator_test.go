@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"github.com/go-kit/kit/log"
+	"github.com/seagullbird/headr-k8s-helper/admin"
+	"github.com/seagullbird/headr-k8s-helper/client"
+	"github.com/seagullbird/headr-k8s-helper/client/fake"
+	"github.com/streadway/amqp"
+	"reflect"
+	"testing"
+)
+
+func TestSiteResourceListeners(t *testing.T) {
+	ctx := context.Background()
+	c, sites, d := fake.New(), fake.NewHeadrSites(), &recordingDispatcher{}
+	logger := log.NewNopLogger()
+	newSite := makeNewSiteResourceListener(c, sites, d, logger)
+	delSite := makeDelSiteResourceListener(c, sites, logger)
+	delUser := makeDelUserSiteResourcesListener(c, sites, logger)
+	deliver := func(h handler, body string) {
+		t.Helper()
+		if err := h(ctx, amqp.Delivery{Body: []byte(body)}); err != nil {
+			t.Fatalf("%s: %v", body, err)
+		}
+	}
+
+	deliver(newSite, `{"user_id": 1, "site_id": 1, "plan": "free", "theme": "hugo-theme-a"}`)
+	deliver(newSite, `{"user_id": 1, "site_id": 2, "plan": "free"}`)
+	site, ok := sites.Get(1)
+	if want := (client.HeadrSiteSpec{SiteID: 1, UserID: 1, Plan: "free", Theme: "hugo-theme-a"}); !ok || !reflect.DeepEqual(site.Spec, want) {
+		t.Fatalf("HeadrSite 1 = %+v, want it declared from the event", site)
+	}
+	if deployment, _, _ := c.State(1); deployment {
+		t.Error("site created by the listener, want it left to the operator")
+	}
+
+	// The user's HeadrSites count against the quota
+	deliver(newSite, `{"user_id": 1, "site_id": 3, "plan": "free"}`)
+	if _, ok := sites.Get(3); ok || len(d.queues) != 1 {
+		t.Errorf("HeadrSite 3 declared, %d refusals, want it refused", len(d.queues))
+	}
+
+	deliver(delSite, `{"user_id": 1, "site_id": 2}`)
+	if _, ok := sites.Get(2); ok {
+		t.Error("HeadrSite 2 not deleted")
+	}
+	deliver(delUser, `{"user_id": 1}`)
+	if _, ok := sites.Get(1); ok {
+		t.Error("HeadrSite 1 not deleted with its user")
+	}
+}
+
+func TestAdminSiteResources(t *testing.T) {
+	ctx := context.Background()
+	c, sites := fake.New(), fake.NewHeadrSites()
+	api := adminSiteResources{c: c, sites: sites, logger: log.NewNopLogger()}
+
+	for _, siteID := range []uint{1, 2} {
+		if err := api.CreateSite(ctx, client.Site{UserID: 1, SiteID: siteID, Plan: "free"}); err != nil {
+			t.Fatalf("create site %d: %v", siteID, err)
+		}
+	}
+	if deployment, _, _ := c.State(1); deployment {
+		t.Error("site created by the admin API, want it left to the operator")
+	}
+	if last, _ := c.LastApplied(ctx, client.SiteKey(1)); last.EventID == "" {
+		t.Error("create not recorded in the ledger")
+	}
+	if err := api.CreateSite(ctx, client.Site{UserID: 1, SiteID: 3, Plan: "free"}); err != admin.ErrQuotaExceeded {
+		t.Errorf("create over quota = %v, want %v", err, admin.ErrQuotaExceeded)
+	}
+	if err := api.DeleteSite(ctx, 2); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if _, ok := sites.Get(2); ok {
+		t.Error("HeadrSite 2 not deleted")
+	}
+}
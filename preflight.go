@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/go-kit/kit/log"
+	mqclient "github.com/seagullbird/headr-common/mq/client"
+	"github.com/seagullbird/headr-k8s-helper/client"
+	"github.com/seagullbird/headr-k8s-helper/config"
+	"github.com/seagullbird/headr-k8s-helper/consumer"
+	"io"
+	"os"
+)
+
+// runPreflight implements `k8s-helper preflight`, reporting whether serve can run with the current config.
+// It exits 1 when serve would refuse to start.
+func runPreflight(args []string, logger log.Logger) int {
+	fs := flag.NewFlagSet("preflight", flag.ContinueOnError)
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	var findings []client.Finding
+	c, err := client.NewClient(logger)
+	if err != nil {
+		findings = append(findings, client.Finding{
+			Check: "Kubernetes client",
+			Err:   err,
+			Fix:   "check KUBECONFIG, HEADR_KUBE_CONTEXT and HEADR_CLUSTERS, or the pod's service account",
+			Fatal: true,
+		})
+	} else {
+		findings = c.Preflight(context.Background())
+	}
+	findings = append(findings, checkSource())
+
+	printFindings(os.Stdout, findings)
+	if client.Fatal(findings) {
+		return 1
+	}
+	return 0
+}
+
+// preflight runs the checks of `k8s-helper preflight` before serving, logging the failed ones,
+// and reports whether serve can start.
+func preflight(c client.Client, logger log.Logger) bool {
+	findings := append(c.Preflight(context.Background()), checkSource())
+	for _, f := range findings {
+		if f.Err != nil {
+			logger.Log("error_desc", "Preflight check failed", "check", f.Check, "error", f.Err, "fix", f.Fix, "fatal", f.Fatal)
+		}
+	}
+	if client.Fatal(findings) {
+		logger.Log("error_desc", "Refusing to start, run `k8s-helper preflight` for a report")
+		return false
+	}
+	return true
+}
+
+// checkSource checks the source of site events chosen by config.Source.
+func checkSource() client.Finding {
+	switch config.Source {
+	case "amqp":
+		return checkAMQP(newMQClient())
+	case "nats":
+		return checkNATS(config.NATSURL)
+	case "webhook":
+		return client.Finding{Check: "webhook source on " + config.WebhookAddr}
+	}
+	return client.Finding{
+		Check: "event source",
+		Err:   fmt.Errorf("unknown source %q", config.Source),
+		Fix:   "set HEADR_SOURCE to amqp, nats or webhook",
+		Fatal: true,
+	}
+}
+
+// checkAMQP logs in to RabbitMQ with mq.
+func checkAMQP(mq mqclient.Client) client.Finding {
+	f := client.Finding{Check: "RabbitMQ login to " + os.Getenv("RABBITMQ_SERVER")}
+	if err := mq.Connect(); err != nil {
+		f.Err, f.Fatal = err, true
+		f.Fix = "check RABBITMQ_SERVER, RABBITMQ_USER and RABBITMQ_PASS, and that the broker is reachable on port 5672"
+		return f
+	}
+	mq.Close()
+	return f
+}
+
+// checkNATS connects to the NATS server at rawurl.
+func checkNATS(rawurl string) client.Finding {
+	f := client.Finding{Check: "NATS server at " + rawurl, Fatal: true}
+	nats, err := consumer.NewNATS(rawurl, nil, log.NewNopLogger())
+	if err != nil {
+		f.Err, f.Fix = err, "set HEADR_NATS_URL to a nats:// URL"
+		return f
+	}
+	if err := nats.Start(); err != nil {
+		f.Err, f.Fix = err, "check HEADR_NATS_URL and its credentials, and that the server is reachable and supports headers"
+		return f
+	}
+	nats.Shutdown(0)
+	f.Fatal = false
+	return f
+}
+
+// printFindings writes a line per check, with the fix of each failed one, and a summary.
+func printFindings(w io.Writer, findings []client.Finding) {
+	var failed, fatal int
+	for _, f := range findings {
+		switch {
+		case f.Err == nil:
+			fmt.Fprintf(w, "ok    %s\n", f.Check)
+			continue
+		case f.Fatal:
+			fatal++
+			fmt.Fprintf(w, "FAIL  %s: %v\n", f.Check, f.Err)
+		default:
+			fmt.Fprintf(w, "WARN  %s: %v\n", f.Check, f.Err)
+		}
+		failed++
+		if f.Fix != "" {
+			fmt.Fprintf(w, "      fix: %s\n", f.Fix)
+		}
+	}
+	switch {
+	case fatal > 0:
+		fmt.Fprintf(w, "\n%d of %d checks failed, %d fatal: serve won't start\n", failed, len(findings), fatal)
+	case failed > 0:
+		fmt.Fprintf(w, "\n%d of %d checks failed, none fatal\n", failed, len(findings))
+	default:
+		fmt.Fprintf(w, "\nall %d checks passed\n", len(findings))
+	}
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"flag"
+	"github.com/go-kit/kit/log"
+	"github.com/seagullbird/headr-k8s-helper/client"
+	"os"
+)
+
+// runRBAC implements `k8s-helper rbac`, printing the ServiceAccount, roles and bindings the helper needs with the current config.
+func runRBAC(args []string, logger log.Logger) int {
+	fs := flag.NewFlagSet("rbac", flag.ContinueOnError)
+	name := fs.String("name", "k8s-helper", "name of the service account, roles and bindings")
+	namespace := fs.String("namespace", "default", "namespace the helper runs in")
+	format := fs.String("o", "yaml", "output format: yaml or json")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	out, err := client.RenderObjects(client.RBAC(*name, *namespace), *format)
+	if err != nil {
+		logger.Log("error_desc", "failed to render RBAC manifests", "error", err)
+		return 1
+	}
+	os.Stdout.Write(out)
+	return 0
+}
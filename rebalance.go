@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"github.com/go-kit/kit/log"
+	"github.com/seagullbird/headr-k8s-helper/client"
+)
+
+// runRebalance implements `k8s-helper rebalance -site <id> -to <cluster>`, moving a site between clusters.
+func runRebalance(args []string, logger log.Logger) int {
+	fs := flag.NewFlagSet("rebalance", flag.ContinueOnError)
+	siteID := fs.Uint("site", 0, "ID of the site to move")
+	to := fs.String("to", "", "name of the cluster to move the site to")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *siteID == 0 || *to == "" {
+		fs.Usage()
+		return 2
+	}
+
+	c, err := client.NewClient(logger)
+	if err != nil {
+		logger.Log("error_desc", "failed to create k8s client", "error", err)
+		return 1
+	}
+	r, ok := c.(client.Rebalancer)
+	if !ok {
+		logger.Log("error_desc", "rebalance needs several clusters, set HEADR_CLUSTERS")
+		return 1
+	}
+	ctx := context.Background()
+	if err := c.SetSiteState(ctx, *siteID, client.StateUpdating); err != nil {
+		logger.Log("error_desc", "can't rebalance site", "site_id", *siteID, "error", err)
+		return 1
+	}
+	if err := r.Rebalance(ctx, *siteID, *to); err != nil {
+		logger.Log("error_desc", "failed to rebalance site", "site_id", *siteID, "to", *to, "error", err)
+		c.SetSiteState(ctx, *siteID, client.StateFailed)
+		return 1
+	}
+	if err := c.SetSiteState(ctx, *siteID, client.StateReady); err != nil {
+		logger.Log("error_desc", "failed to set site state", "site_id", *siteID, "error", err)
+		return 1
+	}
+	return 0
+}
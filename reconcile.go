@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/go-kit/kit/log"
+	"github.com/seagullbird/headr-k8s-helper/client"
+	"os"
+)
+
+// runReconcile implements `k8s-helper reconcile`, repairing services and ingress paths that don't match the site deployments.
+func runReconcile(args []string, logger log.Logger) int {
+	fs := flag.NewFlagSet("reconcile", flag.ContinueOnError)
+	format := fs.String("o", "text", "output format: text or json")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	c, err := client.NewClient(logger)
+	if err != nil {
+		logger.Log("error_desc", "failed to create k8s client", "error", err)
+		return 1
+	}
+	fixes, err := c.Reconcile(context.Background())
+	if *format == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(fixes)
+	} else {
+		for _, fix := range fixes {
+			if fix.Err != nil {
+				fmt.Printf("site %d: %s: failed: %v\n", fix.SiteID, fix.Action, fix.Err)
+				continue
+			}
+			fmt.Printf("site %d: %s\n", fix.SiteID, fix.Action)
+		}
+	}
+	if err != nil {
+		logger.Log("error_desc", "reconcile failed", "error", err)
+		return 1
+	}
+	for _, fix := range fixes {
+		if fix.Err != nil {
+			return 1
+		}
+	}
+	return 0
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"flag"
+	"github.com/go-kit/kit/log"
+	"github.com/seagullbird/headr-k8s-helper/client"
+	"os"
+)
+
+// runRender implements `k8s-helper render -site <id>`, printing what CreateCaddyService would send without contacting the cluster.
+func runRender(args []string, logger log.Logger) int {
+	fs := flag.NewFlagSet("render", flag.ContinueOnError)
+	siteID := fs.Uint("site", 0, "ID of the site to render")
+	userID := fs.Uint("user", 0, "ID of the site's user")
+	plan := fs.String("plan", "", "plan of the site's user")
+	format := fs.String("o", "yaml", "output format: yaml or json")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *siteID == 0 {
+		fs.Usage()
+		return 2
+	}
+
+	m := client.BuildManifest(client.Site{
+		UserID: *userID,
+		SiteID: *siteID,
+		Plan:   *plan,
+	})
+	out, err := client.Render(m, *format)
+	if err != nil {
+		logger.Log("error_desc", "failed to render manifest", "error", err)
+		return 1
+	}
+	os.Stdout.Write(out)
+	return 0
+}
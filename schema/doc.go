@@ -0,0 +1,3 @@
+// Package schema decodes and validates site events, published as bare JSON or as structured CloudEvents,
+// and upgrades those of older schema versions
+package schema
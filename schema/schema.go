@@ -0,0 +1,211 @@
+package schema
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/seagullbird/headr-k8s-helper/config"
+	"github.com/streadway/amqp"
+	"mime"
+	"strings"
+	"time"
+)
+
+// Content types of site events; deliveries without one are bare JSON.
+const (
+	ContentTypeJSON        = "application/json"
+	ContentTypeCloudEvents = "application/cloudevents+json"
+	// ContentTypeText is what the headr-common dispatcher labels its bare JSON events with
+	ContentTypeText = "text/plain"
+)
+
+// CurrentVersion is the schema version events are upgraded to.
+// Version 1 is the unversioned mq.SiteUpdatedEvent of headr-common; version 2 names its version,
+// may carry an event ID and requires received_on.
+const CurrentVersion = 2
+
+// A Site is a site event upgraded to CurrentVersion.
+type Site struct {
+	// SchemaVersion is the version the event was published with
+	SchemaVersion int `json:"schema_version"`
+	// EventID identifies the event for duplicate detection; the id of a CloudEvent sets it
+	EventID string `json:"event_id,omitempty"`
+	UserID  uint   `json:"user_id"`
+	SiteID  uint   `json:"site_id"`
+	Theme   string `json:"theme,omitempty"`
+	Plan    string `json:"plan,omitempty"`
+	// ReceivedOn is when sitemgr received the request, in Unix seconds; it's 0 for version 1 events without one
+	ReceivedOn int64 `json:"received_on"`
+}
+
+// Need lists the IDs a queue's events must carry.
+type Need int
+
+const (
+	NeedSite Need = 1 << iota
+	NeedUser
+)
+
+// InvalidError rejects an event no retry can handle.
+type InvalidError struct {
+	// Reason is a short label of the problem, such as "missing_site_id"
+	Reason string
+	Err    error
+}
+
+func (e InvalidError) Error() string {
+	return fmt.Sprintf("invalid event (%s): %v", e.Reason, e.Err)
+}
+
+func invalid(reason, format string, args ...interface{}) error {
+	return InvalidError{Reason: reason, Err: fmt.Errorf(format, args...)}
+}
+
+// decoders decode the body of each schema version to a Site, upgrading older versions.
+var decoders = map[int]func(body []byte) (Site, error){
+	1: decodeV1,
+	2: func(body []byte) (Site, error) {
+		var site Site
+		err := json.Unmarshal(body, &site)
+		return site, err
+	},
+}
+
+// siteV1 is a version 1 event: mq.SiteUpdatedEvent, with the plan sitemgr adds.
+type siteV1 struct {
+	UserID     uint   `json:"user_id"`
+	SiteID     uint   `json:"site_id"`
+	Theme      string `json:"theme"`
+	ReceivedOn int64  `json:"received_on"`
+	Plan       string `json:"plan"`
+}
+
+func decodeV1(body []byte) (Site, error) {
+	var v1 siteV1
+	if err := json.Unmarshal(body, &v1); err != nil {
+		return Site{}, err
+	}
+	return Site{
+		SchemaVersion: 1,
+		UserID:        v1.UserID,
+		SiteID:        v1.SiteID,
+		Theme:         v1.Theme,
+		Plan:          v1.Plan,
+		ReceivedOn:    v1.ReceivedOn,
+	}, nil
+}
+
+// Decode decodes the site event of a delivery, bare or wrapped in a CloudEvent as its content type says,
+// upgrades it to CurrentVersion and validates it. Every error is an InvalidError; the event is returned
+// as far as it decoded.
+func Decode(delivery amqp.Delivery, need Need) (Site, error) {
+	body := delivery.Body
+	var envelope *cloudEvent
+	switch contentType := mediaType(delivery.ContentType); contentType {
+	case "", ContentTypeJSON, ContentTypeText:
+	case ContentTypeCloudEvents:
+		var err error
+		if envelope, err = decodeCloudEvent(body); err != nil {
+			return Site{}, err
+		}
+		body = envelope.Data
+	default:
+		return Site{}, invalid("unsupported_content_type", "content type %q, want %s or %s", contentType, ContentTypeJSON, ContentTypeCloudEvents)
+	}
+
+	var versioned struct {
+		SchemaVersion int `json:"schema_version"`
+	}
+	if err := json.Unmarshal(body, &versioned); err != nil {
+		return Site{}, invalid("malformed", "%v", err)
+	}
+	version := versioned.SchemaVersion
+	if version == 0 {
+		version = 1
+	}
+	decode, ok := decoders[version]
+	if !ok {
+		return Site{}, invalid("unsupported_version", "schema version %d, want at most %d", version, CurrentVersion)
+	}
+	site, err := decode(body)
+	if err != nil {
+		return Site{}, invalid("malformed", "%v", err)
+	}
+	site.SchemaVersion = version
+	if envelope != nil {
+		site.EventID = envelope.ID
+		if site.ReceivedOn == 0 && !envelope.Time.IsZero() {
+			site.ReceivedOn = envelope.Time.Unix()
+		}
+	}
+	return site, site.Validate(need)
+}
+
+// Validate checks that a site event carries the IDs it needs, received_on from version 2 on, and a known theme.
+// Every error is an InvalidError.
+func (s Site) Validate(need Need) error {
+	switch {
+	case need&NeedSite != 0 && s.SiteID == 0:
+		return invalid("missing_site_id", "site_id is missing or 0")
+	case need&NeedUser != 0 && s.UserID == 0:
+		return invalid("missing_user_id", "user_id is missing or 0")
+	case s.SchemaVersion >= 2 && s.ReceivedOn == 0:
+		return invalid("missing_received_on", "received_on is missing or 0")
+	case s.Theme != "" && !knownTheme(s.Theme):
+		return invalid("unknown_theme", "theme %q isn't one of %s", s.Theme, config.Themes)
+	}
+	return nil
+}
+
+// knownTheme reports whether theme is one of config.Themes, or whether any theme goes when it's empty.
+func knownTheme(theme string) bool {
+	if config.Themes == "" {
+		return true
+	}
+	for _, t := range strings.Split(config.Themes, ",") {
+		if strings.TrimSpace(t) == theme {
+			return true
+		}
+	}
+	return false
+}
+
+// mediaType returns a content type without its parameters.
+func mediaType(contentType string) string {
+	if contentType == "" {
+		return ""
+	}
+	t, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return strings.ToLower(contentType)
+	}
+	return t
+}
+
+// cloudEvent is a structured mode CloudEvent of spec version 1.0.
+type cloudEvent struct {
+	SpecVersion     string          `json:"specversion"`
+	ID              string          `json:"id"`
+	Source          string          `json:"source"`
+	Type            string          `json:"type"`
+	Time            time.Time       `json:"time"`
+	DataContentType string          `json:"datacontenttype"`
+	Data            json.RawMessage `json:"data"`
+}
+
+func decodeCloudEvent(body []byte) (*cloudEvent, error) {
+	var e cloudEvent
+	if err := json.Unmarshal(body, &e); err != nil {
+		return nil, invalid("malformed", "%v", err)
+	}
+	switch {
+	case e.SpecVersion != "1.0":
+		return nil, invalid("unsupported_specversion", "CloudEvents spec version %q, want 1.0", e.SpecVersion)
+	case e.ID == "" || e.Source == "" || e.Type == "":
+		return nil, invalid("malformed", "CloudEvent without id, source or type")
+	case e.DataContentType != "" && mediaType(e.DataContentType) != ContentTypeJSON:
+		return nil, invalid("unsupported_content_type", "CloudEvent data content type %q, want %s", e.DataContentType, ContentTypeJSON)
+	case len(e.Data) == 0:
+		return nil, invalid("malformed", "CloudEvent without data")
+	}
+	return &e, nil
+}
@@ -0,0 +1,121 @@
+package schema
+
+import (
+	"github.com/seagullbird/headr-k8s-helper/config"
+	"github.com/streadway/amqp"
+	"testing"
+)
+
+func TestDecode(t *testing.T) {
+	defer func(themes string) { config.Themes = themes }(config.Themes)
+	config.Themes = "hugo-theme-a, hugo-theme-b"
+
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		need        Need
+		want        Site
+		wantReason  string
+	}{
+		{
+			name: "unversioned event is version 1",
+			body: `{"user_id": 1, "site_id": 7, "theme": "hugo-theme-a", "plan": "pro"}`,
+			need: NeedSite | NeedUser,
+			want: Site{SchemaVersion: 1, UserID: 1, SiteID: 7, Theme: "hugo-theme-a", Plan: "pro"},
+		},
+		{
+			name:        "version 2 event",
+			contentType: "application/json; charset=utf-8",
+			body:        `{"schema_version": 2, "event_id": "e1", "user_id": 1, "site_id": 7, "received_on": 10}`,
+			want:        Site{SchemaVersion: 2, EventID: "e1", UserID: 1, SiteID: 7, ReceivedOn: 10},
+		},
+		{
+			name:        "structured CloudEvent",
+			contentType: ContentTypeCloudEvents,
+			body: `{"specversion": "1.0", "id": "ce1", "source": "/sitemgr", "type": "io.headr.site.created",
+				"time": "2018-05-11T12:00:00Z", "data": {"user_id": 1, "site_id": 7}}`,
+			want: Site{SchemaVersion: 1, EventID: "ce1", UserID: 1, SiteID: 7, ReceivedOn: 1526040000},
+		},
+		{
+			name:       "missing site",
+			body:       `{"user_id": 1}`,
+			need:       NeedSite,
+			want:       Site{SchemaVersion: 1, UserID: 1},
+			wantReason: "missing_site_id",
+		},
+		{
+			name:       "missing user",
+			body:       `{"site_id": 7, "user_id": 0}`,
+			need:       NeedUser,
+			want:       Site{SchemaVersion: 1, SiteID: 7},
+			wantReason: "missing_user_id",
+		},
+		{
+			name:       "version 2 needs received_on",
+			body:       `{"schema_version": 2, "user_id": 1, "site_id": 7}`,
+			want:       Site{SchemaVersion: 2, UserID: 1, SiteID: 7},
+			wantReason: "missing_received_on",
+		},
+		{
+			name:       "unknown theme",
+			body:       `{"user_id": 1, "site_id": 7, "theme": "nope"}`,
+			want:       Site{SchemaVersion: 1, UserID: 1, SiteID: 7, Theme: "nope"},
+			wantReason: "unknown_theme",
+		},
+		{
+			name:       "future version",
+			body:       `{"schema_version": 3, "user_id": 1, "site_id": 7}`,
+			wantReason: "unsupported_version",
+		},
+		{
+			name:       "malformed",
+			body:       `{"user_id": "one"}`,
+			wantReason: "malformed",
+		},
+		{
+			name:        "headr-common event",
+			contentType: "text/plain",
+			body:        `{"user_id": 1, "site_id": 7}`,
+			want:        Site{SchemaVersion: 1, UserID: 1, SiteID: 7},
+		},
+		{
+			name:        "unknown content type",
+			contentType: "application/xml",
+			body:        `{"user_id": 1, "site_id": 7}`,
+			wantReason:  "unsupported_content_type",
+		},
+		{
+			name:        "CloudEvent of another spec version",
+			contentType: ContentTypeCloudEvents,
+			body:        `{"specversion": "0.3", "id": "ce1", "source": "/sitemgr", "type": "t", "data": {"site_id": 7}}`,
+			wantReason:  "unsupported_specversion",
+		},
+		{
+			name:        "CloudEvent without data",
+			contentType: ContentTypeCloudEvents,
+			body:        `{"specversion": "1.0", "id": "ce1", "source": "/sitemgr", "type": "t"}`,
+			wantReason:  "malformed",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Decode(amqp.Delivery{ContentType: tt.contentType, Body: []byte(tt.body)}, tt.need)
+			reason := ""
+			if err != nil {
+				invalid, ok := err.(InvalidError)
+				if !ok {
+					t.Fatalf("Decode() error = %#v, want an InvalidError", err)
+				}
+				reason = invalid.Reason
+			}
+			if reason != tt.wantReason {
+				t.Fatalf("Decode() error = %v, want reason %q", err, tt.wantReason)
+			}
+			if got != tt.want {
+				t.Errorf("Decode() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/go-kit/kit/log"
+	mqclient "github.com/seagullbird/headr-common/mq/client"
+	"github.com/seagullbird/headr-common/mq/dispatch"
+	"github.com/seagullbird/headr-k8s-helper/admin"
+	"github.com/seagullbird/headr-k8s-helper/client"
+	"github.com/seagullbird/headr-k8s-helper/config"
+	"github.com/seagullbird/headr-k8s-helper/consumer"
+	"github.com/seagullbird/headr-k8s-helper/health"
+	"github.com/seagullbird/headr-k8s-helper/metrics"
+	"github.com/seagullbird/headr-k8s-helper/operator"
+	"github.com/seagullbird/headr-k8s-helper/signing"
+	"github.com/seagullbird/headr-k8s-helper/tracing"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// readinessTimeout bounds the Kubernetes API check of /readyz, so an API server that doesn't answer fails the probe
+// rather than hang it.
+const readinessTimeout = 5 * time.Second
+
+// runServe implements `k8s-helper serve`, handling site events from the source in config.Source until SIGTERM or SIGINT.
+func runServe(logger log.Logger) int {
+	// tracing
+	if err := tracing.Init(config.Tracing, config.TracingEndpoint, "k8s-helper", logger); err != nil {
+		logger.Log("error_desc", "failed to set up tracing", "error", err)
+		return 1
+	}
+
+	//	new k8s client
+	c, err := client.NewClient(logger)
+	if err != nil {
+		logger.Log("error_desc", "failed to create k8s client", "error", err)
+		return 1
+	}
+	if !preflight(c, logger) {
+		return 1
+	}
+
+	// event source, and dispatcher for refusals
+	events, dispatcher, err := newSource(logger)
+	if err != nil {
+		logger.Log("error_desc", "failed to set up the event source", "source", config.Source, "error", err)
+		return 1
+	}
+
+	// Register listeners and start consuming; the work they leave running stops on shutdown
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	bg := newBackground(ctx)
+	var adminAPI admin.Sites = adminSites{c: c, bg: bg, logger: logger}
+	listeners := map[string]handler{
+		"new_site_server": makeNewSiteServerListener(c, dispatcher, bg, logger),
+		"del_site_server": makeDelSiteServerListener(c, logger),
+		"del_user_sites":  makeDelUserSitesListener(c, logger),
+	}
+	if config.Operator {
+		sites, err := client.NewHeadrSites(logger)
+		if err != nil {
+			logger.Log("error_desc", "failed to create HeadrSite client", "error", err)
+			return 1
+		}
+		listeners = map[string]handler{
+			"new_site_server": makeNewSiteResourceListener(c, sites, dispatcher, logger),
+			"del_site_server": makeDelSiteResourceListener(c, sites, logger),
+			"del_user_sites":  makeDelUserSiteResourcesListener(c, sites, logger),
+		}
+		adminAPI = adminSiteResources{c: c, sites: sites, logger: logger}
+		resync := time.Duration(config.OperatorResync) * time.Second
+		bg.Go(operator.New(sites, c, resync, log.With(logger, "component", "operator")).Run)
+	}
+	if config.SigningKeys != "" {
+		keys, err := signing.NewKeyring(config.SigningKeys)
+		if err != nil {
+			logger.Log("error_desc", "failed to load signing keys", "error", err)
+			return 1
+		}
+		for queue, listener := range listeners {
+			listeners[queue] = verified(keys, queue, listener, logger)
+		}
+	}
+	for queue, listener := range listeners {
+		events.Register(queue, instrument(queue, listener))
+	}
+	if err := events.Start(); err != nil {
+		logger.Log("error_desc", "failed to consume site events", "error", err)
+		return 1
+	}
+
+	// admin API, stopped when the shutdown starts
+	var adminServer *http.Server
+	if config.AdminToken != "" {
+		adminServer = &http.Server{
+			Addr:    config.AdminAddr,
+			Handler: admin.NewHandler(c, adminAPI, config.AdminToken, log.With(logger, "component", "admin")),
+		}
+		go func() {
+			logger.Log("info", "Serving admin API", "addr", config.AdminAddr)
+			if err := adminServer.ListenAndServe(); err != http.ErrServerClosed {
+				logger.Log("error_desc", "admin API stopped", "error", err)
+			}
+		}()
+	}
+
+	// Watch the sites an earlier run left Provisioning
+	if !config.Operator && !config.DryRun {
+		resumeProvisioning(c, bg, logger)
+	}
+
+	// health and readiness probes, and metrics, served until the events are drained
+	bg.Go(func(ctx context.Context) {
+		countSites(ctx, c, time.Minute, logger)
+	})
+	// The source reconnects on its own, so an outage only makes the helper unready
+	live := map[string]health.Check{}
+	ready := map[string]health.Check{
+		config.Source: events.Check,
+		"kubernetes": func() error {
+			ctx, cancel := context.WithTimeout(context.Background(), readinessTimeout)
+			defer cancel()
+			return c.Check(ctx)
+		},
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/", health.NewHandler(live, ready))
+	mux.Handle("/metrics", metrics.Handler())
+	healthServer := &http.Server{Addr: config.HealthAddr, Handler: mux}
+	go func() {
+		logger.Log("info", "Serving health checks and metrics", "addr", config.HealthAddr)
+		if err := healthServer.ListenAndServe(); err != http.ErrServerClosed {
+			logger.Log("error_desc", "health server stopped", "error", err)
+		}
+	}()
+
+	// Run until told to stop, then finish the events being handled
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, syscall.SIGINT)
+	sig := <-stop
+	logger.Log("info", "Shutting down", "signal", sig, "timeout", config.ShutdownTimeout)
+	cancel()
+	timeout := time.Duration(config.ShutdownTimeout) * time.Second
+	adminStopped := make(chan struct{})
+	go func() {
+		defer close(adminStopped)
+		if adminServer != nil {
+			stopServer(adminServer, timeout, "admin API", logger)
+		}
+	}()
+	err = events.Shutdown(timeout)
+	bg.Wait()
+	<-adminStopped
+	stopServer(healthServer, time.Second, "health server", logger)
+	if err != nil {
+		logger.Log("error_desc", "Shut down before all events were handled, they will be delivered again", "error", err)
+		return 1
+	}
+	logger.Log("info", "Shut down")
+	return 0
+}
+
+// stopServer stops a server from accepting requests and gives those being served timeout to finish.
+func stopServer(s *http.Server, timeout time.Duration, name string, logger log.Logger) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		logger.Log("error_desc", "Failed to stop the "+name, "error", err)
+	}
+}
+
+// newSource returns the source of site events chosen by config.Source, and the dispatcher of refusals going
+// back the same way.
+func newSource(logger log.Logger) (consumer.Source, dispatch.Dispatcher, error) {
+	logger = log.With(logger, "component", "consumer", "source", config.Source)
+	switch config.Source {
+	case "amqp":
+		dispatcher, err := dispatch.NewDispatcher(newMQClient(), logger)
+		if err != nil {
+			return nil, nil, err
+		}
+		return consumer.New(newMQClient(), siteKey, logger), dispatcher, nil
+	case "nats":
+		nats, err := consumer.NewNATS(config.NATSURL, siteKey, logger)
+		if err != nil {
+			return nil, nil, err
+		}
+		return nats, nats, nil
+	case "webhook":
+		var dispatcher dispatch.Dispatcher = discard{logger}
+		if config.WebhookCallback != "" {
+			dispatcher = consumer.Callback{URL: config.WebhookCallback, Client: &http.Client{Timeout: time.Duration(config.RequestTimeout) * time.Second}}
+		}
+		return consumer.NewWebhook(config.WebhookAddr, config.WebhookToken, siteKey, logger), dispatcher, nil
+	}
+	return nil, nil, fmt.Errorf("unknown source %q", config.Source)
+}
+
+// discard is the dispatcher of webhook deployments without a callback: it logs the messages and drops them.
+type discard struct {
+	logger log.Logger
+}
+
+func (d discard) DispatchMessage(queue string, message interface{}) error {
+	d.logger.Log("info", "No callback, dropping message", "queue", queue, "message", fmt.Sprintf("%+v", message))
+	return nil
+}
+
+// newMQClient returns a RabbitMQ client for the server and credentials in RABBITMQ_SERVER, RABBITMQ_USER and RABBITMQ_PASS.
+func newMQClient() mqclient.Client {
+	return mqclient.New(os.Getenv("RABBITMQ_SERVER"), os.Getenv("RABBITMQ_USER"), os.Getenv("RABBITMQ_PASS"))
+}
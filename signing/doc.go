@@ -0,0 +1,3 @@
+// Package signing signs site events with HMAC-SHA256 and verifies them against a directory of shared keys,
+// so only publishers holding a key can drive the helper
+package signing
@@ -0,0 +1,140 @@
+package signing
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/streadway/amqp"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Header carries the signature of a message as "<key id>:<hex HMAC-SHA256 of the queue name, a newline and the body>".
+// The queue is signed too, so a message can't be replayed to another queue.
+const Header = "x-signature"
+
+// Sign returns the Header value of a message to queue, signed with the key named keyID.
+func Sign(keyID string, key []byte, queue string, body []byte) string {
+	return keyID + ":" + hex.EncodeToString(mac(key, queue, body))
+}
+
+// Publishing returns a persistent JSON message to queue, signed with the key named keyID.
+func Publishing(keyID string, key []byte, queue string, body []byte) amqp.Publishing {
+	return amqp.Publishing{
+		Headers:      amqp.Table{Header: Sign(keyID, key, queue, body)},
+		ContentType:  "application/json",
+		DeliveryMode: amqp.Persistent,
+		Body:         body,
+	}
+}
+
+func mac(key []byte, queue string, body []byte) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(queue + "\n"))
+	h.Write(body)
+	return h.Sum(nil)
+}
+
+// A VerifyError rejects a message without a valid signature.
+type VerifyError struct {
+	// Reason is unsigned, unknown_key or bad_signature
+	Reason string
+	KeyID  string
+}
+
+func (e VerifyError) Error() string {
+	if e.KeyID == "" {
+		return "signature: " + e.Reason
+	}
+	return fmt.Sprintf("signature: %s (key %s)", e.Reason, e.KeyID)
+}
+
+// reloadInterval is how often a Keyring reads its directory again.
+var reloadInterval = 30 * time.Second
+
+// A Keyring holds the keys of a directory, such as a mounted Secret: each file is a key named after the file.
+// It reads the directory again every reloadInterval, so keys are rotated by adding the new key, moving
+// publishers to it, then removing the old one.
+type Keyring struct {
+	dir string
+
+	mtx    sync.Mutex
+	keys   map[string][]byte
+	loaded time.Time
+}
+
+// NewKeyring reads the keys of dir, failing when there are none.
+func NewKeyring(dir string) (*Keyring, error) {
+	k := &Keyring{dir: dir}
+	keys, err := readKeys(dir)
+	if err != nil {
+		return nil, err
+	}
+	k.keys, k.loaded = keys, time.Now()
+	return k, nil
+}
+
+// Verify checks the signature of a message to queue.
+func (k *Keyring) Verify(queue string, headers amqp.Table, body []byte) error {
+	value, _ := headers[Header].(string)
+	i := strings.LastIndex(value, ":")
+	if i < 0 {
+		return VerifyError{Reason: "unsigned"}
+	}
+	keyID := value[:i]
+	sig, err := hex.DecodeString(value[i+1:])
+	if err != nil {
+		return VerifyError{Reason: "bad_signature", KeyID: keyID}
+	}
+	key, ok := k.key(keyID)
+	if !ok {
+		return VerifyError{Reason: "unknown_key", KeyID: keyID}
+	}
+	if !hmac.Equal(sig, mac(key, queue, body)) {
+		return VerifyError{Reason: "bad_signature", KeyID: keyID}
+	}
+	return nil
+}
+
+func (k *Keyring) key(id string) ([]byte, bool) {
+	k.mtx.Lock()
+	defer k.mtx.Unlock()
+	if time.Since(k.loaded) >= reloadInterval {
+		// keep the old keys when the directory can't be read, and try again next time
+		if keys, err := readKeys(k.dir); err == nil {
+			k.keys = keys
+		}
+		k.loaded = time.Now()
+	}
+	key, ok := k.keys[id]
+	return key, ok
+}
+
+// readKeys reads the keys of dir, skipping the hidden files and directories Kubernetes mounts Secrets with.
+func readKeys(dir string) (map[string][]byte, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	keys := make(map[string][]byte)
+	for _, f := range files {
+		if strings.HasPrefix(f.Name(), ".") || f.IsDir() {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(dir, f.Name()))
+		if err != nil {
+			return nil, err
+		}
+		if key := strings.TrimSpace(string(data)); key != "" {
+			keys[f.Name()] = []byte(key)
+		}
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no signing keys in %s", dir)
+	}
+	return keys, nil
+}
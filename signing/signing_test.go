@@ -0,0 +1,93 @@
+package signing
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestVerify(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	write := func(name, key string) {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(key), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("k1", "secret-1\n")
+	k, err := NewKeyring(dir)
+	if err != nil {
+		t.Fatalf("NewKeyring() = %v", err)
+	}
+
+	body := []byte(`{"user_id": 1, "site_id": 7}`)
+	tests := []struct {
+		name       string
+		signature  interface{}
+		queue      string
+		wantReason string
+	}{
+		{name: "signed", signature: Sign("k1", []byte("secret-1"), "new_site_server", body), queue: "new_site_server"},
+		{name: "unsigned", queue: "new_site_server", wantReason: "unsigned"},
+		{name: "not a signature", signature: "abc", queue: "new_site_server", wantReason: "unsigned"},
+		{name: "signed for another queue", signature: Sign("k1", []byte("secret-1"), "new_site_server", body),
+			queue: "del_site_server", wantReason: "bad_signature"},
+		{name: "signed with another key", signature: Sign("k1", []byte("secret-2"), "new_site_server", body),
+			queue: "new_site_server", wantReason: "bad_signature"},
+		{name: "unknown key", signature: Sign("k2", []byte("secret-2"), "new_site_server", body),
+			queue: "new_site_server", wantReason: "unknown_key"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := Publishing("k1", nil, tt.queue, body)
+			msg.Headers[Header] = tt.signature
+			err := k.Verify(tt.queue, msg.Headers, body)
+			reason := ""
+			if err != nil {
+				reason = err.(VerifyError).Reason
+			}
+			if reason != tt.wantReason {
+				t.Errorf("Verify() = %v, want reason %q", err, tt.wantReason)
+			}
+		})
+	}
+}
+
+func TestKeyringRotation(t *testing.T) {
+	defer func(d time.Duration) { reloadInterval = d }(reloadInterval)
+	reloadInterval = 0
+	dir, err := ioutil.TempDir("", "keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "old"), []byte("secret-old"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	k, err := NewKeyring(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body := []byte(`{"site_id": 7}`)
+	signed := func(id, key string) map[string]interface{} {
+		return map[string]interface{}{Header: Sign(id, []byte(key), "del_site_server", body)}
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "new"), []byte("secret-new"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := k.Verify("del_site_server", signed("new", "secret-new"), body); err != nil {
+		t.Errorf("added key: Verify() = %v", err)
+	}
+	if err := os.Remove(filepath.Join(dir, "old")); err != nil {
+		t.Fatal(err)
+	}
+	if err := k.Verify("del_site_server", signed("old", "secret-old"), body); err == nil {
+		t.Error("removed key: Verify() = nil, want unknown_key")
+	}
+}
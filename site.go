@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/go-kit/kit/log"
+	"github.com/seagullbird/headr-k8s-helper/admin"
+	"github.com/seagullbird/headr-k8s-helper/client"
+	"github.com/seagullbird/headr-k8s-helper/config"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+)
+
+// runSite implements `k8s-helper site create|delete|describe <id>`.
+func runSite(args []string, logger log.Logger) int {
+	if len(args) < 2 {
+		fmt.Fprintln(os.Stderr, "usage: k8s-helper site create|delete|describe <id> [flags]")
+		return 2
+	}
+	siteID, err := strconv.ParseUint(args[1], 10, 0)
+	if err != nil || siteID == 0 {
+		fmt.Fprintf(os.Stderr, "invalid site id %q\n", args[1])
+		return 2
+	}
+
+	fs := flag.NewFlagSet("site "+args[0], flag.ContinueOnError)
+	var (
+		userID = fs.Uint("user", 0, "ID of the site's user (create)")
+		plan   = fs.String("plan", "", "plan of the site's user (create)")
+		format = fs.String("o", "text", "output format: text or json (describe)")
+	)
+	if err := fs.Parse(args[2:]); err != nil {
+		return 2
+	}
+
+	c, err := client.NewClient(logger)
+	if err != nil {
+		logger.Log("error_desc", "failed to create k8s client", "error", err)
+		return 1
+	}
+
+	// Sites are created and deleted through the ledger, site states and quota like the admin API does,
+	// and as HeadrSites, which serve provisions, in operator mode
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	bg := newBackground(ctx)
+	var sites admin.Sites = adminSites{c: c, bg: bg, logger: logger}
+	if config.Operator && (args[0] == "create" || args[0] == "delete") {
+		headrSites, err := client.NewHeadrSites(logger)
+		if err != nil {
+			logger.Log("error_desc", "failed to create HeadrSite client", "error", err)
+			return 1
+		}
+		sites = adminSiteResources{c: c, sites: headrSites, logger: logger}
+	}
+
+	switch args[0] {
+	case "create":
+		if *userID == 0 {
+			fmt.Fprintln(os.Stderr, "site create needs -user")
+			return 2
+		}
+		err = sites.CreateSite(ctx, client.Site{
+			UserID: *userID,
+			SiteID: uint(siteID),
+			Plan:   *plan,
+		})
+		if err == nil {
+			// Wait for the site to become ready, or fail, unless interrupted
+			stop := make(chan os.Signal, 1)
+			signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+			go func() {
+				<-stop
+				cancel()
+			}()
+			bg.Wait()
+		}
+	case "delete":
+		err = sites.DeleteSite(ctx, uint(siteID))
+	case "describe":
+		var status client.SiteStatus
+		status, err = c.DescribeSite(context.Background(), uint(siteID))
+		if err == nil && *format == "json" {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			err = enc.Encode(status)
+		} else if err == nil {
+			err = printStatuses([]client.SiteStatus{status}, *format)
+		}
+	default:
+		fmt.Fprintf(os.Stderr, "unknown site command %q\n", args[0])
+		return 2
+	}
+	if err != nil {
+		logger.Log("error_desc", "site "+args[0]+" failed", "site_id", siteID, "error", err)
+		return 1
+	}
+	return 0
+}
+
+// runSites implements `k8s-helper sites list`.
+func runSites(args []string, logger log.Logger) int {
+	if len(args) < 1 || args[0] != "list" {
+		fmt.Fprintln(os.Stderr, "usage: k8s-helper sites list [-o table|json]")
+		return 2
+	}
+	fs := flag.NewFlagSet("sites list", flag.ContinueOnError)
+	format := fs.String("o", "table", "output format: table or json")
+	if err := fs.Parse(args[1:]); err != nil {
+		return 2
+	}
+
+	c, err := client.NewClient(logger)
+	if err != nil {
+		logger.Log("error_desc", "failed to create k8s client", "error", err)
+		return 1
+	}
+	statuses, err := c.ListSites(context.Background())
+	if err != nil {
+		logger.Log("error_desc", "failed to list sites", "error", err)
+		return 1
+	}
+	if err := printStatuses(statuses, *format); err != nil {
+		logger.Log("error_desc", "failed to print sites", "error", err)
+		return 1
+	}
+	return 0
+}
+
+// printStatuses prints site statuses as JSON, as a table, or as one key: value block per site.
+func printStatuses(statuses []client.SiteStatus, format string) error {
+	switch format {
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(statuses)
+	case "table":
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "SITE\tUSER\tPLAN\tCLUSTER\tNAMESPACE\tREADY\tPORT\tINGRESS")
+		for _, s := range statuses {
+			fmt.Fprintf(w, "%d\t%d\t%s\t%s\t%s\t%d/%d\t%d\t%s\n",
+				s.SiteID, s.UserID, s.Plan, s.Cluster, s.Namespace, s.ReadyReplicas, s.Replicas, s.ServicePort, strings.Join(s.IngressPaths, ","))
+		}
+		return w.Flush()
+	case "text":
+		for _, s := range statuses {
+			w := tabwriter.NewWriter(os.Stdout, 0, 4, 1, ' ', 0)
+			fmt.Fprintf(w, "Site:\t%d\n", s.SiteID)
+			fmt.Fprintf(w, "User:\t%d\n", s.UserID)
+			fmt.Fprintf(w, "Plan:\t%s\n", s.Plan)
+			if s.Cluster != "" {
+				fmt.Fprintf(w, "Cluster:\t%s\n", s.Cluster)
+			}
+			fmt.Fprintf(w, "Namespace:\t%s\n", s.Namespace)
+			if s.State != client.StateNone {
+				fmt.Fprintf(w, "State:\t%s\n", s.State)
+			}
+			fmt.Fprintf(w, "Replicas:\t%d desired, %d ready, %d available\n", s.Replicas, s.ReadyReplicas, s.AvailableReplicas)
+			fmt.Fprintf(w, "Service port:\t%d\n", s.ServicePort)
+			if s.NodePort != 0 {
+				fmt.Fprintf(w, "Node port:\t%d\n", s.NodePort)
+			}
+			fmt.Fprintf(w, "Ingress paths:\t%s\n", strings.Join(s.IngressPaths, ", "))
+			if err := w.Flush(); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown format %q", format)
+}
@@ -0,0 +1,2 @@
+// Package tracing records spans of the event pipeline and exports them to stdout or a Zipkin compatible collector
+package tracing
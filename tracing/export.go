@@ -0,0 +1,149 @@
+package tracing
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/go-kit/kit/log"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// An Exporter sends finished spans somewhere.
+type Exporter interface {
+	Export(s *Span)
+}
+
+var (
+	exporterMtx sync.RWMutex
+	exporter    Exporter
+)
+
+// SetExporter sets where finished spans go; spans are dropped while it is nil.
+func SetExporter(e Exporter) {
+	exporterMtx.Lock()
+	exporter = e
+	exporterMtx.Unlock()
+}
+
+// Init sets the exporter named by kind: "stdout", "zipkin" posting to endpoint, or "" to drop spans.
+func Init(kind, endpoint, service string, logger log.Logger) error {
+	switch kind {
+	case "":
+		SetExporter(nil)
+	case "stdout":
+		SetExporter(NewWriterExporter(os.Stdout, service))
+	case "zipkin":
+		if endpoint == "" {
+			return fmt.Errorf("the zipkin exporter needs an endpoint")
+		}
+		SetExporter(NewZipkinExporter(endpoint, service, logger))
+	default:
+		return fmt.Errorf("unknown tracing exporter %q, want stdout or zipkin", kind)
+	}
+	return nil
+}
+
+// zipkinSpan is a span in the Zipkin v2 JSON format, which Zipkin, Jaeger and the OpenTelemetry Collector accept.
+type zipkinSpan struct {
+	TraceID       string            `json:"traceId"`
+	ID            string            `json:"id"`
+	ParentID      string            `json:"parentId,omitempty"`
+	Name          string            `json:"name"`
+	Kind          string            `json:"kind,omitempty"`
+	Timestamp     int64             `json:"timestamp"`
+	Duration      int64             `json:"duration"`
+	LocalEndpoint map[string]string `json:"localEndpoint"`
+	Tags          map[string]string `json:"tags,omitempty"`
+}
+
+func toZipkin(s *Span, service string) zipkinSpan {
+	return zipkinSpan{
+		TraceID:       s.TraceID,
+		ID:            s.SpanID,
+		ParentID:      s.ParentID,
+		Name:          s.Name,
+		Kind:          s.Kind,
+		Timestamp:     s.Start.UnixNano() / int64(time.Microsecond),
+		Duration:      int64(s.Duration / time.Microsecond),
+		LocalEndpoint: map[string]string{"serviceName": service},
+		Tags:          s.Tags(),
+	}
+}
+
+type writerExporter struct {
+	mtx     sync.Mutex
+	w       io.Writer
+	service string
+}
+
+// NewWriterExporter writes each span to w as a line of Zipkin JSON.
+func NewWriterExporter(w io.Writer, service string) Exporter {
+	return &writerExporter{w: w, service: service}
+}
+
+func (e *writerExporter) Export(s *Span) {
+	data, _ := json.Marshal(toZipkin(s, e.service))
+	e.mtx.Lock()
+	e.w.Write(append(data, '\n'))
+	e.mtx.Unlock()
+}
+
+type zipkinExporter struct {
+	endpoint string
+	service  string
+	logger   log.Logger
+	client   *http.Client
+
+	mtx     sync.Mutex
+	pending []zipkinSpan
+}
+
+// NewZipkinExporter posts spans in batches, once a second, to a Zipkin v2 endpoint such as http://zipkin:9411/api/v2/spans.
+func NewZipkinExporter(endpoint, service string, logger log.Logger) Exporter {
+	e := &zipkinExporter{
+		endpoint: endpoint,
+		service:  service,
+		logger:   logger,
+		client:   &http.Client{Timeout: 5 * time.Second},
+	}
+	go func() {
+		for range time.Tick(time.Second) {
+			e.flush()
+		}
+	}()
+	return e
+}
+
+func (e *zipkinExporter) Export(s *Span) {
+	e.mtx.Lock()
+	// drop spans rather than grow without bound while the collector is away
+	if len(e.pending) < 10000 {
+		e.pending = append(e.pending, toZipkin(s, e.service))
+	}
+	e.mtx.Unlock()
+}
+
+func (e *zipkinExporter) flush() {
+	e.mtx.Lock()
+	batch := e.pending
+	e.pending = nil
+	e.mtx.Unlock()
+	if len(batch) == 0 {
+		return
+	}
+
+	data, _ := json.Marshal(batch)
+	resp, err := e.client.Post(e.endpoint, "application/json", bytes.NewReader(data))
+	if err != nil {
+		e.logger.Log("error_desc", "failed to export spans", "spans", len(batch), "error", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		e.logger.Log("error_desc", "failed to export spans", "spans", len(batch), "status", resp.Status)
+	}
+}
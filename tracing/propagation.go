@@ -0,0 +1,32 @@
+package tracing
+
+import (
+	"github.com/streadway/amqp"
+	"strings"
+)
+
+// Extract reads the trace context from AMQP headers, in the W3C traceparent or the Zipkin B3 format.
+// It returns a zero SpanContext when the headers carry none.
+func Extract(headers amqp.Table) SpanContext {
+	get := func(key string) string {
+		for k, v := range headers {
+			if s, ok := v.(string); ok && strings.EqualFold(k, key) {
+				return s
+			}
+		}
+		return ""
+	}
+
+	// traceparent: version-traceid-spanid-flags
+	if parts := strings.Split(get("traceparent"), "-"); len(parts) == 4 && len(parts[1]) == 32 && len(parts[2]) == 16 {
+		return SpanContext{TraceID: parts[1], SpanID: parts[2]}
+	}
+	// b3: traceid-spanid[-sampled[-parentspanid]]
+	if parts := strings.Split(get("b3"), "-"); len(parts) >= 2 {
+		return SpanContext{TraceID: parts[0], SpanID: parts[1]}
+	}
+	if traceID, spanID := get("X-B3-TraceId"), get("X-B3-SpanId"); traceID != "" && spanID != "" {
+		return SpanContext{TraceID: traceID, SpanID: spanID}
+	}
+	return SpanContext{}
+}
@@ -0,0 +1,110 @@
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+// Span kinds, as Zipkin names them.
+const (
+	KindConsumer = "CONSUMER"
+	KindClient   = "CLIENT"
+	KindServer   = "SERVER"
+)
+
+// SpanContext identifies a span across process boundaries.
+type SpanContext struct {
+	TraceID string
+	SpanID  string
+}
+
+// Span is one timed operation of a trace.
+type Span struct {
+	SpanContext
+	ParentID string
+	Name     string
+	Kind     string
+	Start    time.Time
+	Duration time.Duration
+
+	mtx  sync.Mutex
+	tags map[string]string
+}
+
+// SetTag records a key/value pair on the span.
+func (s *Span) SetTag(key, value string) {
+	s.mtx.Lock()
+	if s.tags == nil {
+		s.tags = make(map[string]string)
+	}
+	s.tags[key] = value
+	s.mtx.Unlock()
+}
+
+// SetError marks the span as failed when err isn't nil.
+func (s *Span) SetError(err error) {
+	if err != nil {
+		s.SetTag("error", err.Error())
+	}
+}
+
+// Tags returns a copy of the span's tags.
+func (s *Span) Tags() map[string]string {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	tags := make(map[string]string, len(s.tags))
+	for k, v := range s.tags {
+		tags[k] = v
+	}
+	return tags
+}
+
+// Finish ends the span and hands it to the exporter.
+func (s *Span) Finish() {
+	s.Duration = time.Since(s.Start)
+	exporterMtx.RLock()
+	e := exporter
+	exporterMtx.RUnlock()
+	if e != nil {
+		e.Export(s)
+	}
+}
+
+type spanKey struct{}
+
+type remoteKey struct{}
+
+// StartSpan starts a span that is a child of the span in ctx, or of a remote parent set with ContextWithRemote.
+// Without either it starts a new trace.
+func StartSpan(ctx context.Context, name, kind string) (*Span, context.Context) {
+	s := &Span{Name: name, Kind: kind, Start: time.Now()}
+	if parent, ok := ctx.Value(spanKey{}).(*Span); ok {
+		s.TraceID, s.ParentID = parent.TraceID, parent.SpanID
+	} else if remote, ok := ctx.Value(remoteKey{}).(SpanContext); ok && remote.TraceID != "" {
+		s.TraceID, s.ParentID = remote.TraceID, remote.SpanID
+	} else {
+		s.TraceID = newID(16)
+	}
+	s.SpanID = newID(8)
+	return s, context.WithValue(ctx, spanKey{}, s)
+}
+
+// FromContext returns the current span of ctx, or nil.
+func FromContext(ctx context.Context) *Span {
+	s, _ := ctx.Value(spanKey{}).(*Span)
+	return s
+}
+
+// ContextWithRemote returns a context whose next span continues the trace of a span in another process.
+func ContextWithRemote(ctx context.Context, sc SpanContext) context.Context {
+	return context.WithValue(ctx, remoteKey{}, sc)
+}
+
+func newID(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}